@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/bschofield/pg_prefaulter/agent/fhcache"
 	"github.com/bschofield/pg_prefaulter/agent/iocache"
 	"github.com/bschofield/pg_prefaulter/agent/walcache"
@@ -44,7 +45,8 @@ type Agent struct {
 
 	// pgStateLock protects the following values.  lastWALLog and lastTimelineID
 	// are the WAL filename and timeline ID from previous call to queryLastLog()
-	// operation.
+	// operation.  lastReplayLSN is the most recent replay LSN observed on
+	// lastTimelineID or the timelines it descends from.
 	pgStateLock    sync.RWMutex
 	pgConnCtx      context.Context
 	pgConnShutdown func()
@@ -52,17 +54,30 @@ type Agent struct {
 	poolConfig     *config.DBPool
 	lastWALLog     pg.WALFilename
 	lastTimelineID pg.TimelineID
+	lastReplayLSN  pg.LSN
 
 	fileHandleCache *fhcache.FileHandleCache
 	ioCache         *iocache.IOCache
 	walCache        *walcache.WALCache
 	walTranslations *pg.WALTranslations
+	readahead       *_ReadaheadController
+	lagGate         *_LagGate
+
+	// walWatcher and walWatchFailed are only accessed from Start()'s loop.
+	walWatcher     *_WALWatcher
+	walWatchFailed bool
+
+	// history is the most recently read timeline history.  Only accessed from
+	// Start()'s loop, see timelineHistory().
+	history pg.TimelineHistory
 }
 
 func New(cfg *config.Config) (a *Agent, err error) {
 	a = &Agent{
 		cfg:             &cfg.Agent,
 		walTranslations: &pg.WALTranslations{},
+		readahead:       newReadaheadController(cfg.WALCacheConfig.ReadaheadLeadTime, cfg.WALCacheConfig.ReadaheadBytes),
+		lagGate:         newLagGate(&cfg.Agent),
 	}
 
 	a.setupSignals()
@@ -71,6 +86,20 @@ func New(cfg *config.Config) (a *Agent, err error) {
 		return nil, errors.Wrap(err, "unable to initialize db connection pool")
 	}
 
+	{
+		geometry, err := a.detectGeometry(viper.GetString(config.KeyPGData))
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to detect cluster geometry, assuming PostgreSQL's defaults")
+		}
+
+		log.Info().
+			Str("heap-page-size", geometry.HeapPageSize.String()).
+			Str("heap-segment-size", geometry.HeapMaxSegmentSize.String()).
+			Str("wal-page-size", geometry.WALPageSize.String()).
+			Str("wal-segment-size", geometry.WALSegmentSize.String()).
+			Msg("cluster geometry")
+	}
+
 	{
 		fhCache, err := fhcache.New(a.shutdownCtx, cfg)
 		if err != nil {
@@ -182,14 +211,13 @@ RETRY:
 			break RETRY
 		}
 
-		// 2) Sleep.  Sleep before purging the WALCache in order to allow processes
-		//    in flight to complete.  If the sleep is not called before the purge,
-		//    it's possible that an in-flight pg_waldump(1) would be cancelled
-		//    before it completed a run.  This means that during an unexpected
-		//    shutdown, FDs won't be closed for up to config.KeyPGPollInterval.
+		// 2) Sleep until the next poll or until a new WAL segment appears (see
+		//    waitForWAL()).  Sleep before purging the WALCache in order to allow
+		//    processes in flight to complete.  If the sleep is not called before
+		//    the purge, it's possible that an in-flight pg_waldump(1) would be
+		//    cancelled before it completed a run.
 		if !sleepBetweenIterations {
-			d := viper.GetDuration(config.KeyPGPollInterval)
-			time.Sleep(d)
+			a.waitForWAL()
 			sleepBetweenIterations = false
 		}
 
@@ -274,6 +302,15 @@ func (a *Agent) setWALTranslations() error {
 		return newVersionError(err, true)
 	}
 
+	// Select the pg_waldump(1) for the cluster's major version on startup and
+	// whenever the version changes (e.g. after pg_upgrade(1)).  A mismatched
+	// pg_waldump(1) is fatal.
+	if pgVersion != a.walTranslations.Major {
+		if err := a.walCache.SelectWalDump(pgVersion); err != nil {
+			return newVersionError(errors.Wrap(err, "unable to select pg_waldump(1)"), false)
+		}
+	}
+
 	*a.walTranslations = pg.Translate(pgVersion)
 
 	return nil
@@ -284,11 +321,20 @@ func (a *Agent) setWALTranslations() error {
 // being applied.  If the database is starting up and can not accept new
 // connections, attempt to extract the WAL file from the process args.  If the
 // database socket is unavailable, do nothing and do not attempt to process the
-// ps(1) args.
+// ps(1) args.  In connectionless mode the database is never contacted, see
+// getWALFilesControl().
 //
 // FIXME(seanc@): Create a WALFaulter interface that can be DB-backed or
 // process-arg backed.
 func (a *Agent) getWALFiles() (pg.WALFiles, error) {
+	if a.cfg.Connectionless {
+		walFiles, err := a.getWALFilesControl()
+		if err != nil {
+			return nil, newWALError(err, true, true)
+		}
+
+		return walFiles, nil
+	}
 
 	var dbErr error
 	var walFiles pg.WALFiles
@@ -354,6 +400,17 @@ func (a *Agent) getWALFiles() (pg.WALFiles, error) {
 func (a *Agent) prefaultWALFiles(walFiles pg.WALFiles) (moreWork bool, err error) {
 	uniqueWALFiles := walFiles.Unique()
 
+	// pg_waldump(1) decodes a single timeline.  When the readahead window
+	// crosses a timeline switch, the segments before the switch only exist
+	// under the parent timeline, so prefault one WAL file at a time until
+	// replay has moved past the switch.
+	if a.walCache.Streaming() {
+		if !crossesTimelineSwitch(uniqueWALFiles) {
+			return false, a.streamWALFiles(uniqueWALFiles)
+		}
+		a.walCache.StopStream()
+	}
+
 	// Read through the cache to prefault a given WAL file.  The cache
 	// begins to fault the WAL file as soon as requested in the event of
 	// a cache miss.  FaultWALFile() dedupes requests and prevents a WAL
@@ -368,6 +425,91 @@ func (a *Agent) prefaultWALFiles(walFiles pg.WALFiles) (moreWork bool, err error
 	return len(waitWALFiles) > pg.NumOldLSNs, nil
 }
 
+// crossesTimelineSwitch returns true if the sorted walFiles are not all on the
+// same timeline.
+func crossesTimelineSwitch(walFiles pg.WALFiles) bool {
+	if len(walFiles) < 2 {
+		return false
+	}
+
+	first, _, err := pg.ParseWalfile(walFiles[0])
+	if err != nil {
+		return false
+	}
+	last, _, err := pg.ParseWalfile(walFiles[len(walFiles)-1])
+	if err != nil {
+		return false
+	}
+
+	return first != last
+}
+
+// streamWALFiles prefaults the WAL from the replay LSN through the end of the
+// last of the sorted walFiles with a single pg_waldump(1).  The stream is
+// stopped when there are no WAL files to prefault (e.g. the lag gate is
+// closed).
+func (a *Agent) streamWALFiles(walFiles pg.WALFiles) error {
+	if len(walFiles) == 0 {
+		a.walCache.StopStream()
+		return nil
+	}
+
+	_, firstLSN, err := pg.ParseWalfile(walFiles[0])
+	if err != nil {
+		return errors.Wrap(err, "unable to parse the first WAL file")
+	}
+
+	timelineID, lastLSN, err := pg.ParseWalfile(walFiles[len(walFiles)-1])
+	if err != nil {
+		return errors.Wrap(err, "unable to parse the last WAL file")
+	}
+
+	// ParseWalfile() returns the LSN one byte into the segment.
+	start := firstLSN - 1
+	end := (lastLSN - 1).AddBytes(pg.WALSegmentSize)
+
+	a.pgStateLock.RLock()
+	if a.lastReplayLSN > start && a.lastReplayLSN < end {
+		start = a.lastReplayLSN
+	}
+	a.pgStateLock.RUnlock()
+
+	return a.walCache.StreamWAL(timelineID, start, end)
+}
+
+// setReplayLSN records lsn as the position PostgreSQL has replayed up to.  The
+// replay LSN only moves forward, unless the timeline changed (which resets
+// lastReplayLSN).  The IOCache drops queued IOs for records behind it and the
+// readahead controller measures the replay rate from it.  setReplayLSN must
+// be called once per poll, even if replay has not advanced.
+func (a *Agent) setReplayLSN(lsn pg.LSN) {
+	a.pgStateLock.Lock()
+	defer a.pgStateLock.Unlock()
+
+	if lsn > a.lastReplayLSN {
+		a.lastReplayLSN = lsn
+		a.ioCache.SetReplayLSN(lsn)
+	}
+
+	a.readahead.observe(a.lastReplayLSN, time.Now())
+}
+
+// readaheadBytes returns the number of bytes of WAL to read ahead of replay.
+// lagBytes is the amount of WAL received but not yet replayed.
+func (a *Agent) readaheadBytes(lagBytes units.Base2Bytes) units.Base2Bytes {
+	maxBytes := a.readahead.window(lagBytes)
+
+	if rate, ok := a.readahead.replayRate(); ok {
+		log.Debug().
+			Float64("replay-rate-bytes-per-sec", rate).
+			Str("lag", lagBytes.String()).
+			Str("readahead", maxBytes.String()).
+			Msg("readahead window")
+	}
+
+	return maxBytes
+}
+
 // resetPGConnCtx resets the PostgreSQL connection context.
 func (a *Agent) resetPGConnCtx() {
 	a.pgStateLock.Lock()
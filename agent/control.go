@@ -0,0 +1,76 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// getWALFilesControl returns a list of WAL files to be processed for
+// prefaulting without connecting to the database.  The replay position is
+// estimated from the REDO location and minRecoveryPoint in global/pg_control,
+// and refined using the WAL file in the startup process's args when available.
+// pg_control is only updated at restartpoints and buffer flushes, so the
+// process args are usually the more current of the two.
+func (a *Agent) getWALFilesControl() (pg.WALFiles, error) {
+	cf, err := pg.ReadControlFile(viper.GetString(config.KeyPGData))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read pg_control")
+	}
+
+	switch mode := viper.GetString(config.KeyPGMode); mode {
+	case "primary":
+		return pg.WALFiles{}, nil
+	case "follower":
+		break
+	case "auto":
+		if !cf.State.InRecovery() {
+			// Nothing to prefault if the database is a primary or shut down.
+			return pg.WALFiles{}, nil
+		}
+	default:
+		panic(fmt.Sprintf("invalid mode: %q", mode))
+	}
+
+	timelineID, lsn := cf.RedoTimelineID, cf.Redo
+	if cf.MinRecoveryPoint > lsn && cf.MinRecoveryPointTimelineID != pg.InvalidTimelineID {
+		timelineID, lsn = cf.MinRecoveryPointTimelineID, cf.MinRecoveryPoint
+	}
+
+	if walFile, err := a.findProcArgsWALFile(); err != nil {
+		log.Debug().Err(err).Msg("unable to find WAL file in process args, using pg_control")
+	} else {
+		procTimelineID, procLSN, err := pg.ParseWalfile(walFile)
+		switch {
+		case err != nil:
+			log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to parse WAL file from process args")
+		case procLSN > lsn:
+			timelineID, lsn = procTimelineID, procLSN
+		}
+	}
+
+	a.setTimelineID(timelineID)
+
+	// pg_control and the process args lag the startup process, so lsn is a
+	// lower bound of the replay LSN.
+	a.setReplayLSN(lsn)
+
+	return a.readaheadWALFiles(timelineID, lsn, a.readaheadBytes(unknownLagBytes)), nil
+}
@@ -19,9 +19,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
-	"path"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/alecthomas/units"
 	"github.com/bschofield/pg_prefaulter/agent/proc"
@@ -169,18 +168,21 @@ func (a *Agent) getWALFilesDB() (pg.WALFiles, error) {
 
 	var numWALFiles uint64
 
-	func() {
-		// If the timeline changed, purge the walCache assuming we're going to need
-		// to prefault in new heap data.
-		a.pgStateLock.Lock()
-		defer a.pgStateLock.Unlock()
-		if a.lastTimelineID != timelineID {
-			if a.lastTimelineID != 0 {
-				a.walCache.Purge()
-			}
-			a.lastTimelineID = timelineID
+	a.setTimelineID(timelineID)
+
+	// The replay location, when present, is the newest of the oldLSNs.
+	var replayLSN pg.LSN
+	for _, oldLSN := range oldLSNs {
+		if oldLSN > replayLSN {
+			replayLSN = oldLSN
 		}
-	}()
+	}
+	a.setReplayLSN(replayLSN)
+
+	prefault, err := a.checkReplayLag()
+	if err != nil {
+		log.Debug().Err(err).Msg("unable to check replay lag, prefaulting")
+	}
 
 	walFiles := make(pg.WALFiles, 0, len(oldLSNs))
 	for _, oldLSN := range oldLSNs {
@@ -199,6 +201,10 @@ func (a *Agent) getWALFilesDB() (pg.WALFiles, error) {
 			}
 		}()
 
+		if !prefault {
+			continue
+		}
+
 		predictedWALFiles, err := a.predictDBWALFilenames(walFile)
 		if err != nil {
 			log.Debug().Err(err).
@@ -241,10 +247,21 @@ const (
 	_QueryLagFollower
 )
 
+// _ReplayLag is the lag reported by queryLag().
+type _ReplayLag struct {
+	// bytes is the visibility lag: WAL received (or sent, on a primary) but not
+	// yet replayed.
+	bytes units.Base2Bytes
+
+	// time is the age of the last replayed transaction.  On an idle cluster
+	// this keeps growing even though nothing is left to replay.
+	time time.Duration
+}
+
 // queryLag queries the database for its understanding of lag.
-func (a *Agent) queryLag(lagQuery _QueryLag) (units.Base2Bytes, error) {
+func (a *Agent) queryLag(lagQuery _QueryLag) (_ReplayLag, error) {
 	// FIXME(seanc@): units.Base2Bytes is an int64
-	const unknownLag = units.Base2Bytes(math.MaxInt64)
+	unknownLag := _ReplayLag{bytes: units.Base2Bytes(math.MaxInt64)}
 
 	var sql string
 	switch lagQuery {
@@ -276,11 +293,23 @@ func (a *Agent) queryLag(lagQuery _QueryLag) (units.Base2Bytes, error) {
 		numRows++
 	}
 
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return unknownLag, errors.Wrap(err, "unable to process lag")
 	}
 
-	return units.Base2Bytes(visibilityLagBytes), nil
+	// Without a row every lag is NaN, which compares false against any
+	// threshold.
+	if numRows == 0 {
+		return unknownLag, fmt.Errorf("no lag reported: %v", lagQuery)
+	}
+
+	// NOTE: visibility_lag_ms is EXTRACT(EPOCH ...), which is in seconds.
+	lag := _ReplayLag{bytes: units.Base2Bytes(visibilityLagBytes)}
+	if !math.IsNaN(visibilityLagMs) {
+		lag.time = time.Duration(visibilityLagMs * float64(time.Second))
+	}
+
+	return lag, nil
 }
 
 type LSNQuery int
@@ -321,7 +350,7 @@ func (a *Agent) predictDBWALFilenames(walFile pg.WALFilename) ([]pg.WALFilename,
 		panic(fmt.Sprintf("unknown state: %+v", state))
 	}
 
-	visibilityLagBytes, err := a.queryLag(_QueryLagFollower)
+	lag, err := a.queryLag(_QueryLagFollower)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to query follower lag")
 	}
@@ -331,14 +360,11 @@ func (a *Agent) predictDBWALFilenames(walFile pg.WALFilename) ([]pg.WALFilename,
 		return nil, errors.Wrap(err, "unable to parse WAL file while predicting names from the DB")
 	}
 
-	// Clamp the number of bytes we'll readahead in order to prevent reading into
-	// the future.
-	maxBytes := a.walCache.ReadaheadBytes()
-	if maxBytes > visibilityLagBytes {
-		maxBytes = visibilityLagBytes
-	}
+	// Size the readahead to stay ahead of replay, clamped in order to prevent
+	// reading into the future.
+	maxBytes := a.readaheadBytes(lag.bytes)
 
-	return lsn.Readahead(timelineID, maxBytes), nil
+	return a.readaheadWALFiles(timelineID, lsn, maxBytes), nil
 }
 
 // getPostgresVersion reads PG_VERSION in the provided data path, parses its value, and
@@ -352,40 +378,63 @@ func (a *Agent) predictDBWALFilenames(walFile pg.WALFilename) ([]pg.WALFilename,
 // this function will not return the exact version (i.e. the minor) of the database; it will
 // look like the minor version is always 0.
 func (a *Agent) getPostgresVersion(pgDataPath string) (pgMajor uint64, err error) {
-	versionFileAbs := path.Join(pgDataPath, "PG_VERSION")
-	buf, err := ioutil.ReadFile(versionFileAbs)
+	versionStringRaw, err := pg.ReadVersionFile(pgDataPath)
 	if err != nil {
-		return pgMajor, errors.Wrap(err, "unable to read PG_VERSION")
+		return pgMajor, err
 	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(buf))
-	var versionStringRaw string
-	for scanner.Scan() {
-		versionStringRaw = scanner.Text()
-		break
+	pgMajor, err = pg.ParseMajorVersion(versionStringRaw)
+	if err != nil {
+		return pgMajor, errors.Wrap(err, "unable to parse PG_VERSION")
 	}
-	if err := scanner.Err(); err != nil {
-		return pgMajor, errors.Wrap(err, "unable to extract PostgreSQL's version string")
+
+	return pgMajor, nil
+}
+
+// detectGeometry determines the page and segment sizes of the cluster and
+// configures the pg package accordingly.  global/pg_control is preferred
+// because it is available before PostgreSQL has started accepting connections.
+// If pg_control can not be read, pg_control_init() is queried instead (9.6+)
+// unless the agent is connectionless.
+// detectGeometry must be called before any caches are started.
+func (a *Agent) detectGeometry(pgDataPath string) (pg.Geometry, error) {
+	cf, err := pg.ReadControlFile(pgDataPath)
+	if err == nil {
+		if err := pg.SetGeometry(cf.Geometry); err != nil {
+			return pg.CurrentGeometry(), errors.Wrap(err, "unable to set geometry from pg_control")
+		}
+
+		return cf.Geometry, nil
+	}
+
+	if a.cfg.Connectionless {
+		return pg.CurrentGeometry(), err
 	}
 
-	parts := strings.Split(versionStringRaw, ".")
-	first, err := strconv.ParseUint(parts[0], 10, 32)
+	log.Debug().Err(err).Msg("unable to read pg_control, querying pg_control_init()")
+
+	// Use a one-off connection: the pool is reset when the agent is Start()'ed.
+	conn, err := pgx.Connect(a.poolConfig.ConnConfig)
 	if err != nil {
-		return pgMajor, errors.Wrap(err, "unable to parse first section of version")
+		return pg.CurrentGeometry(), errors.Wrap(err, "unable to connect to query cluster geometry")
 	}
+	defer conn.Close()
 
-	var pgVersionString string
-	if first < 10 {
-		second := parts[1]
-		pgVersionString = fmt.Sprintf("%d%s00", (first * 10), second)
-	} else {
-		pgVersionString = fmt.Sprintf("%d0000", first)
+	var blckSize, blocksPerSegment, walBlckSize, walSegmentSize int64
+	const sql = `SELECT database_block_size, blocks_per_segment, wal_block_size, bytes_per_wal_segment FROM pg_control_init()`
+	if err := conn.QueryRowEx(a.shutdownCtx, sql, nil).Scan(&blckSize, &blocksPerSegment, &walBlckSize, &walSegmentSize); err != nil {
+		return pg.CurrentGeometry(), errors.Wrap(err, "unable to query pg_control_init()")
 	}
 
-	pgMajor, err = strconv.ParseUint(pgVersionString, 10, 32)
-	if err != nil {
-		return pgMajor, errors.Wrap(err, "unable to parse version back to integer")
+	g := pg.Geometry{
+		HeapPageSize:       units.Base2Bytes(blckSize),
+		HeapMaxSegmentSize: units.Base2Bytes(blocksPerSegment * blckSize),
+		WALPageSize:        units.Base2Bytes(walBlckSize),
+		WALSegmentSize:     units.Base2Bytes(walSegmentSize),
+	}
+	if err := pg.SetGeometry(g); err != nil {
+		return pg.CurrentGeometry(), errors.Wrap(err, "unable to set geometry from pg_control_init()")
 	}
 
-	return pgMajor, nil
+	return g, nil
 }
@@ -15,6 +15,7 @@ package fhcache
 
 import (
 	"context"
+	"os"
 	"sync"
 	"time"
 
@@ -39,20 +40,34 @@ var (
 // FileHandleCache is a file descriptor cache to prevent re-open(2)'ing files
 // continually.
 type FileHandleCache struct {
-	ctx context.Context
-	cfg *config.FHCacheConfig
+	ctx         context.Context
+	cfg         *config.FHCacheConfig
+	tablespaces *_Tablespaces
+	prefetcher  _Prefetcher
 
 	purgeLock sync.Mutex
 	c         gcache.Cache
+
+	// index indexes the relation segments in c by relation fork for
+	// Invalidate().
+	index *structs.RelationKeyIndex
 }
 
 // New creates a new FileHandleCache
 func New(ctx context.Context, cfg *config.Config) (*FileHandleCache, error) {
 	fhc := &FileHandleCache{
-		ctx: ctx,
-		cfg: &cfg.FHCacheConfig,
+		ctx:         ctx,
+		cfg:         &cfg.FHCacheConfig,
+		tablespaces: _NewTablespaces(cfg.FHCacheConfig.PGDataPath),
+	}
+
+	prefetcher, err := newPrefetcher(fhc.cfg.PrefetchBackend, fhc.cfg.PGDataPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to initialize prefetch backend")
 	}
+	fhc.prefetcher = prefetcher
 
+	fhc.index = structs.NewRelationKeyIndex()
 	fhc.c = gcache.New(int(fhc.cfg.Size)).
 		ARC().
 		LoaderExpireFunc(func(fhCacheKeyRaw interface{}) (interface{}, *time.Duration, error) {
@@ -69,12 +84,21 @@ func New(ctx context.Context, cfg *config.Config) (*FileHandleCache, error) {
 			}
 			return &fhCacheVal, &fhc.cfg.TTL, nil
 		}).
+		AddedFunc(func(fhCacheKeyRaw, _ interface{}) {
+			if fhCacheKey := fhCacheKeyRaw.(_Key); fhCacheKey.slru == pg.NoSLRU {
+				fhc.index.Add(fhCacheKey.lastBlock().RelationForkKey(), fhCacheKey)
+			}
+		}).
 		EvictedFunc(func(fhCacheKeyRaw, fhCacheValueRaw interface{}) {
 			fhCacheValue, ok := fhCacheValueRaw.(*_Value)
 			if !ok {
 				log.Panic().Msgf("bad, evicting something not a file handle: %+v", fhCacheValue)
 			}
 			defer fhCacheValue.close()
+
+			if fhCacheKey := fhCacheKeyRaw.(_Key); fhCacheKey.slru == pg.NoSLRU {
+				fhc.index.Remove(fhCacheKey.lastBlock().RelationForkKey(), fhCacheKey)
+			}
 		}).
 		PurgeVisitorFunc(func(fhCacheKeyRaw, fhCacheValueRaw interface{}) {
 			fhCacheValue, ok := fhCacheValueRaw.(*_Value)
@@ -91,6 +115,7 @@ func New(ctx context.Context, cfg *config.Config) (*FileHandleCache, error) {
 		Uint("rlimit-nofile", fhc.cfg.MaxOpenFiles).
 		Uint("filehandle-cache-size", fhc.cfg.Size).
 		Dur("filehandle-cache-ttl", fhc.cfg.TTL).
+		Str("prefetch-backend", fhc.prefetcher.String()).
 		Msg("filehandle cache initialized")
 	return fhc, nil
 }
@@ -103,13 +128,21 @@ var (
 // PrefaultPage uses the given IOCacheKey to:
 //
 // 1) open a relation's segment, if necessary
-// 2) pre-fault a given heap page into the OS's filesystem cache using pread(2)
+// 2) pre-fault a given heap page into the OS's filesystem cache using the
+//    configured prefetch backend (e.g. pread(2), posix_fadvise(2))
 func (fhc *FileHandleCache) PrefaultPage(ioCacheKey structs.IOCacheKey) error {
-	fhcValue, err := fhc.getLocked(ioCacheKey)
+	return fhc.PrefaultRange(ioCacheKey, 1)
+}
+
+// PrefaultRange is PrefaultPage() for numPages consecutive heap pages starting
+// with the page referenced by ioCacheKey.  The pages MUST be in the same
+// relation segment.
+func (fhc *FileHandleCache) PrefaultRange(ioCacheKey structs.IOCacheKey, numPages uint32) error {
+	f, off, release, err := fhc.AcquirePage(ioCacheKey)
 	if err != nil {
-		return errors.Wrap(err, "unable to obtain file handle")
+		return err
 	}
-	defer fhcValue.lock.RUnlock()
+	defer release()
 
 	numConcurrentReadLock.Lock()
 	numConcurrentReads++
@@ -120,12 +153,82 @@ func (fhc *FileHandleCache) PrefaultPage(ioCacheKey structs.IOCacheKey) error {
 		numConcurrentReadLock.Unlock()
 	}()
 
-	pageNum := pg.HeapSegmentPageNum(ioCacheKey.Block)
-	Fadvise(int(fhcValue.f.Fd()), int64(uint64(pageNum)*uint64(pg.HeapPageSize)), int64(pg.HeapPageSize))
+	if err := fhc.prefetcher.prefetch(f, off, int64(numPages)*int64(pg.HeapPageSize)); err != nil {
+		return errors.Wrapf(err, "unable to prefetch %d page(s) with %s", numPages, fhc.prefetcher)
+	}
 
 	return nil
 }
 
+// AcquirePage returns the open relation segment and byte offset of the heap
+// page referenced by ioCacheKey.  AcquirePage is used by IO engines that
+// perform their own IO instead of calling PrefaultPage().  Upon success,
+// callers MUST call release() once they are done with f.
+func (fhc *FileHandleCache) AcquirePage(ioCacheKey structs.IOCacheKey) (f *os.File, off int64, release func(), err error) {
+	fhcValue, err := fhc.getLocked(ioCacheKey)
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "unable to obtain file handle")
+	}
+
+	pageNum := ioCacheKey.SegmentPageNum()
+	off = int64(uint64(pageNum) * uint64(pg.HeapPageSize))
+
+	return fhcValue.f, off, fhcValue.lock.RUnlock, nil
+}
+
+// Resident reports which of the numPages heap pages starting with the page
+// referenced by ioCacheKey are resident in the OS's page cache.  The pages
+// MUST be in the same relation segment.  Pages beyond the end of the segment
+// when it was opened are reported as not resident.
+func (fhc *FileHandleCache) Resident(ioCacheKey structs.IOCacheKey, numPages uint32) ([]bool, error) {
+	fhcValue, err := fhc.getLocked(ioCacheKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to obtain file handle")
+	}
+	defer fhcValue.lock.RUnlock()
+
+	resident := make([]bool, numPages)
+	if fhcValue.m == nil {
+		return resident, nil
+	}
+
+	heapPageSize := int64(pg.HeapPageSize)
+	off := int64(uint64(ioCacheKey.SegmentPageNum()) * uint64(heapPageSize))
+	end := off + int64(numPages)*heapPageSize
+	if end > int64(len(fhcValue.m)) {
+		end = int64(len(fhcValue.m))
+	}
+	if off >= end {
+		return resident, nil
+	}
+
+	// mincore(2) reports residency in units of the system's page size, which
+	// may be larger or smaller than a heap page.
+	sysPageSize := int64(os.Getpagesize())
+	alignedOff := off &^ (sysPageSize - 1)
+	vec := make([]byte, (end-alignedOff+sysPageSize-1)/sysPageSize)
+	if err := mincore(fhcValue.m[alignedOff:end], vec); err != nil {
+		return nil, err
+	}
+
+	for i := range resident {
+		pageOff := off + int64(i)*heapPageSize
+		if pageOff+heapPageSize > end {
+			break
+		}
+
+		resident[i] = true
+		for j := (pageOff - alignedOff) / sysPageSize; j <= (pageOff+heapPageSize-1-alignedOff)/sysPageSize; j++ {
+			if vec[j]&1 == 0 {
+				resident[i] = false
+				break
+			}
+		}
+	}
+
+	return resident, nil
+}
+
 // getLocked returns a read-locked _Value.  Upon success, callers MUST call
 // RUnlock().  On error _Value will return nil and the caller will not have to
 // release any outstanding locks.
@@ -159,23 +262,58 @@ func (fhc *FileHandleCache) getLocked(ioReq structs.IOCacheKey) (*_Value, error)
 			continue
 		}
 
-		f, err := value.open(fhc.cfg.PGDataPath)
+		f, err := value.open(fhc.tablespaces)
 		if err != nil {
 			log.Warn().Err(err).Msgf("unable to open relation file: %+v", key)
 			value.lock.Unlock()
 			return nil, errors.Wrapf(err, "unable to re-open file: %+v", value._Key)
 		}
 		value.f = f
+
+		if fhc.cfg.ResidencyCheck {
+			// A segment that can't be mapped is treated as never resident.
+			if value.m, err = mmapSegment(f); err != nil {
+				log.Debug().Err(err).Msgf("unable to map relation file: %+v", key)
+			}
+		}
 		value.lock.Unlock()
 	}
 }
 
+// Invalidate closes the file handles of every relation segment containing a
+// block invalidated by inv so that unlinked relation files are not held open
+// and truncated segments are re-opened (and re-mapped) on their next use.
+// Invalidate returns the number of file handles closed.
+func (fhc *FileHandleCache) Invalidate(inv structs.Invalidations) int {
+	fhc.purgeLock.Lock()
+	defer fhc.purgeLock.Unlock()
+
+	var closed int
+	for _, keyRaw := range fhc.index.Keys(inv) {
+		key, ok := keyRaw.(_Key)
+		if !ok {
+			log.Panic().Msgf("unable to type assert key in file handle cache: %T %+v", keyRaw, keyRaw)
+		}
+
+		if !inv.Invalid(key.lastBlock()) {
+			continue
+		}
+
+		if fhc.c.Remove(key) {
+			closed++
+		}
+	}
+
+	return closed
+}
+
 // Purge purges the FileHandleCache of its cache (and all downstream caches)
 func (fhc *FileHandleCache) Purge() {
 	fhc.purgeLock.Lock()
 	defer fhc.purgeLock.Unlock()
 
 	fhc.c.Purge()
+	fhc.index.Purge()
 
 	openLock.RLock()
 	defer openLock.RUnlock()
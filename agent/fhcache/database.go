@@ -0,0 +1,114 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// relationFilenameRE matches the filename of a relation segment (e.g. "16385",
+// "16385_vm" or "16385_fsm.1").  Temporary relations and the other files in a
+// database's directory (e.g. PG_VERSION and pg_filenode.map) do not match.
+var relationFilenameRE = regexp.MustCompile(`^(?P<relation>[\d]+)(?:_(?P<fork>fsm|vm|init))?(?:\.(?P<segment>[\d]+))?$`)
+
+// parseRelationFilename parses the filename of a relation segment stored in the
+// directory of database in tablespace.  ok is false if filename is not a
+// relation segment.
+func parseRelationFilename(tablespace, database pg.OID, filename string) (key _Key, ok bool) {
+	matches := relationFilenameRE.FindStringSubmatch(filename)
+	if matches == nil {
+		return _Key{}, false
+	}
+
+	relation, err := strconv.ParseUint(matches[relationFilenameRE.SubexpIndex("relation")], 10, 32)
+	if err != nil {
+		return _Key{}, false
+	}
+
+	fork := pg.MainForkNum
+	if forkName := matches[relationFilenameRE.SubexpIndex("fork")]; forkName != "" {
+		if fork, err = pg.ParseForkName(forkName); err != nil {
+			return _Key{}, false
+		}
+	}
+
+	var segment uint64
+	if segmentNum := matches[relationFilenameRE.SubexpIndex("segment")]; segmentNum != "" {
+		if segment, err = strconv.ParseUint(segmentNum, 10, 32); err != nil {
+			return _Key{}, false
+		}
+	}
+
+	return _Key{
+		tablespace: tablespace,
+		database:   database,
+		relation:   pg.OID(relation),
+		fork:       fork,
+		segment:    pg.HeapSegmentNumber(segment),
+	}, true
+}
+
+// DatabaseSegments returns an extent covering each relation segment in the
+// directory of database in tablespace (i.e. the files read when a database
+// is created from it as a template).  Empty segments are skipped.
+func (fhc *FileHandleCache) DatabaseSegments(tablespace, database pg.OID) ([]structs.IOCacheExtent, error) {
+	tablespaceDir, err := fhc.tablespaces.dir(tablespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve tablespace %d", tablespace)
+	}
+
+	dbDir := path.Join(tablespaceDir, strconv.FormatUint(uint64(database), 10))
+	fis, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read database directory %q", dbDir)
+	}
+
+	blocksPerSegment := uint64(pg.HeapMaxSegmentSize / pg.HeapPageSize)
+	extents := make([]structs.IOCacheExtent, 0, len(fis))
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		key, ok := parseRelationFilename(tablespace, database, fi.Name())
+		if !ok {
+			continue
+		}
+
+		numPages := uint64(fi.Size()) / uint64(pg.HeapPageSize)
+		if numPages == 0 {
+			continue
+		}
+
+		extents = append(extents, structs.IOCacheExtent{
+			Start: structs.IOCacheKey{
+				Tablespace: key.tablespace,
+				Database:   key.database,
+				Relation:   key.relation,
+				Fork:       key.fork,
+				Block:      pg.HeapBlockNumber(uint64(key.segment) * blocksPerSegment),
+			},
+			NumPages: uint32(numPages),
+		})
+	}
+
+	return extents, nil
+}
@@ -0,0 +1,68 @@
+package fhcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_FileHandleCache_DatabaseSegments(t *testing.T) {
+	pgdata, err := ioutil.TempDir("", "pgdata")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(pgdata)
+
+	dbDir := path.Join(pgdata, "base", "1")
+	if err := os.MkdirAll(path.Join(dbDir, "pgsql_tmp"), 0700); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	pageSize := int(pg.HeapPageSize)
+	files := map[string]int{
+		"1259":             3 * pageSize,
+		"1259_fsm":         2 * pageSize,
+		"1259_vm":          pageSize,
+		"2619.1":           pageSize,
+		"2619_init":        0,
+		"PG_VERSION":       3,
+		"pg_filenode.map":  512,
+		"pg_internal.init": 2 * pageSize,
+		"t3_16385":         pageSize,
+	}
+	for name, size := range files {
+		if err := ioutil.WriteFile(path.Join(dbDir, name), make([]byte, size), 0600); err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	fhc := &FileHandleCache{tablespaces: _NewTablespaces(pgdata)}
+	got, err := fhc.DatabaseSegments(pg.DefaultTablespaceOID, 1)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	key := func(relation pg.OID, fork pg.ForkNumber, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: pg.DefaultTablespaceOID, Database: 1, Relation: relation, Fork: fork, Block: block}
+	}
+	blocksPerSegment := pg.HeapBlockNumber(pg.HeapMaxSegmentSize / pg.HeapPageSize)
+
+	want := []structs.IOCacheExtent{
+		{Start: key(1259, pg.MainForkNum, 0), NumPages: 3},
+		{Start: key(1259, pg.FSMForkNum, 0), NumPages: 2},
+		{Start: key(1259, pg.VisibilityMapForkNum, 0), NumPages: 1},
+		{Start: key(2619, pg.MainForkNum, blocksPerSegment), NumPages: 1},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("segments diff: (-got +want)\n%s", diff)
+	}
+
+	if _, err := fhc.DatabaseSegments(pg.DefaultTablespaceOID, 2); err == nil {
+		t.Fatalf("expected an error for a missing database")
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/bschofield/pg_prefaulter/agent/structs"
 	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
 )
 
 // _Key is a comparable forward lookup key.  These values almost certainly need
@@ -29,6 +30,8 @@ type _Key struct {
 	tablespace pg.OID
 	database   pg.OID
 	relation   pg.OID
+	fork       pg.ForkNumber
+	slru       pg.SLRU
 	segment    pg.HeapSegmentNumber
 }
 
@@ -37,25 +40,63 @@ func _NewKey(ioCacheKey structs.IOCacheKey) _Key {
 		tablespace: ioCacheKey.Tablespace,
 		database:   ioCacheKey.Database,
 		relation:   ioCacheKey.Relation,
-		segment:    ioCacheKey.Block.SegmentNumber(),
+		fork:       ioCacheKey.Fork,
+		slru:       ioCacheKey.SLRU,
+		segment:    ioCacheKey.SegmentNumber(),
 	}
 }
 
-// filename generates the absolute path filename for a given _Key.
-func (key *_Key) filename(pgdataPath string) string {
+// lastBlock returns an IOCacheKey referencing the last block that can be
+// stored in the segment.
+func (key *_Key) lastBlock() structs.IOCacheKey {
+	blocksPerSegment := uint64(pg.HeapMaxSegmentSize / pg.HeapPageSize)
+	return structs.IOCacheKey{
+		Tablespace: key.tablespace,
+		Database:   key.database,
+		Relation:   key.relation,
+		Fork:       key.fork,
+		Block:      pg.HeapBlockNumber((uint64(key.segment)+1)*blocksPerSegment - 1),
+		SLRU:       key.slru,
+	}
+}
+
+// filename generates the absolute path filename for a given _Key.  Relations
+// in the pg_global tablespace are not stored in a per-database directory.
+func (key *_Key) filename(tablespaces *_Tablespaces) (string, error) {
+	if key.slru != pg.NoSLRU {
+		slruDir, err := tablespaces.slruDir(key.slru)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to resolve %s SLRU", key.slru)
+		}
+
+		return path.Join(slruDir, pg.SLRUSegmentFilename(key.segment)), nil
+	}
+
 	// FIXME(seanc@): Move this logic to the pg package.  Create an "LSN"
 	// interface that requires the necessary helper functions so that a
 	// fhcache.Key can be used to pg.* methods.
+	//
+	// Non-main forks are stored in files with a fork suffix, e.g. 16384_vm or
+	// 16384_fsm.1.
 	var filename string
 	if key.segment > 0 {
 		// It's easier to abuse Relation here than to support a parallel refilno
 		// struct member
-		filename = fmt.Sprintf("%d.%d", key.relation, key.segment)
+		filename = fmt.Sprintf("%d%s.%d", key.relation, key.fork.FileSuffix(), key.segment)
 	} else {
-		filename = strconv.FormatUint(uint64(key.relation), 10)
+		filename = strconv.FormatUint(uint64(key.relation), 10) + key.fork.FileSuffix()
+	}
+
+	tablespaceDir, err := tablespaces.dir(key.tablespace)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to resolve tablespace %d", key.tablespace)
+	}
+
+	if key.tablespace == pg.GlobalTablespaceOID {
+		return path.Join(tablespaceDir, filename), nil
 	}
 
-	filename = path.Join(pgdataPath, "base", strconv.FormatUint(uint64(key.database), 10), string(filename))
+	filename = path.Join(tablespaceDir, strconv.FormatUint(uint64(key.database), 10), string(filename))
 
-	return filename
+	return filename, nil
 }
@@ -1,8 +1,13 @@
 package fhcache
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
 	"github.com/kylelemons/godebug/pretty"
 )
 
@@ -22,11 +27,182 @@ func Test_Key_filename(t *testing.T) {
 			path:     "/test/path/pgdata",
 			filename: "/test/path/pgdata/base/16398/24576",
 		},
+		{
+			key: _Key{
+				tablespace: 1663,
+				database:   16398,
+				relation:   24576,
+				segment:    3,
+			},
+			path:     "/test/path/pgdata",
+			filename: "/test/path/pgdata/base/16398/24576.3",
+		},
+		{
+			key: _Key{
+				tablespace: 1663,
+				database:   16400,
+				relation:   2619,
+				fork:       pg.VisibilityMapForkNum,
+				segment:    0,
+			},
+			path:     "/test/path/pgdata",
+			filename: "/test/path/pgdata/base/16400/2619_vm",
+		},
+		{
+			key: _Key{
+				tablespace: 1663,
+				database:   16400,
+				relation:   2619,
+				fork:       pg.FSMForkNum,
+				segment:    2,
+			},
+			path:     "/test/path/pgdata",
+			filename: "/test/path/pgdata/base/16400/2619_fsm.2",
+		},
+		{
+			key: _Key{
+				tablespace: 1664,
+				database:   0,
+				relation:   1262,
+				segment:    0,
+			},
+			path:     "/test/path/pgdata",
+			filename: "/test/path/pgdata/global/1262",
+		},
 	}
 
 	for n, test := range tests {
-		if diff := pretty.Compare(test.key.filename(test.path), test.filename); diff != "" {
+		filename, err := test.key.filename(_NewTablespaces(test.path))
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(filename, test.filename); diff != "" {
 			t.Fatalf("%d: filename diff: (-got +want)\n%s", n, diff)
 		}
 	}
 }
+
+func Test_Key_filenameTablespace(t *testing.T) {
+	pgdata, err := ioutil.TempDir("", "pgdata")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(pgdata)
+
+	if err := ioutil.WriteFile(path.Join(pgdata, "PG_VERSION"), []byte("10\n"), 0600); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// A tablespace left behind by pg_upgrade(1) must not be confused with the
+	// current major version's directory.
+	for _, dir := range []string{"PG_9.6_201608131", "PG_10_201707211"} {
+		if err := os.MkdirAll(path.Join(pgdata, "pg_tblspc", "16500", dir), 0700); err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	tablespaces := _NewTablespaces(pgdata)
+	key := _Key{
+		tablespace: 16500,
+		database:   16398,
+		relation:   24576,
+		segment:    1,
+	}
+
+	filename, err := key.filename(tablespaces)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	want := path.Join(pgdata, "pg_tblspc/16500/PG_10_201707211/16398/24576.1")
+	if diff := pretty.Compare(filename, want); diff != "" {
+		t.Fatalf("filename diff: (-got +want)\n%s", diff)
+	}
+
+	key.tablespace = 16501
+	if _, err := key.filename(tablespaces); err == nil {
+		t.Fatalf("expected an error for a missing tablespace")
+	}
+}
+
+func Test_Key_filenameSLRU(t *testing.T) {
+	tests := []struct {
+		version  string
+		page     pg.SLRUPage
+		filename string
+	}{
+		{
+			version:  "9.6",
+			page:     pg.XactPage(70000),
+			filename: "pg_clog/0000",
+		},
+		{
+			version:  "10",
+			page:     pg.XactPage(70000),
+			filename: "pg_xact/0000",
+		},
+		{
+			version:  "16",
+			page:     pg.XactPage(4000000000),
+			filename: "pg_xact/0EE6",
+		},
+		{
+			version:  "16",
+			page:     pg.SubtransPage(70000),
+			filename: "pg_subtrans/0001",
+		},
+		{
+			version:  "16",
+			page:     pg.MultiXactOffsetPage(4097),
+			filename: "pg_multixact/offsets/0000",
+		},
+		{
+			version:  "16",
+			page:     pg.MultiXactMemberPage(4000000000),
+			filename: "pg_multixact/members/12A75",
+		},
+	}
+
+	for n, test := range tests {
+		pgdata, err := ioutil.TempDir("", "pgdata")
+		if err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+		defer os.RemoveAll(pgdata)
+
+		if err := ioutil.WriteFile(path.Join(pgdata, "PG_VERSION"), []byte(test.version+"\n"), 0600); err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+
+		key := _NewKey(structs.NewSLRUKey(test.page))
+		filename, err := key.filename(_NewTablespaces(pgdata))
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(filename, path.Join(pgdata, test.filename)); diff != "" {
+			t.Errorf("%d: filename diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func Test_Key_lastBlock(t *testing.T) {
+	rel := pg.RelFileNode{Tablespace: 1663, Database: 16398, Relation: 24576}
+	inv := structs.NewInvalidations(pg.SMGRTruncateEvents(rel, 200000, 0x1))
+
+	// 131072 blocks of 8KB per 1GB segment.  Segment 1 holds the truncation
+	// point and every later segment is truncated too.
+	for segment, want := range []bool{false, true, true} {
+		key := _Key{
+			tablespace: rel.Tablespace,
+			database:   rel.Database,
+			relation:   rel.Relation,
+			segment:    pg.HeapSegmentNumber(segment),
+		}
+
+		if got := inv.Invalid(key.lastBlock()); got != want {
+			t.Errorf("segment %d: invalid: got %t want %t", segment, got, want)
+		}
+	}
+}
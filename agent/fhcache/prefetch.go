@@ -0,0 +1,79 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+)
+
+// _Prefetcher faults a byte range of an open relation segment into the OS's
+// filesystem cache.
+type _Prefetcher interface {
+	prefetch(f *os.File, off, length int64) error
+	fmt.Stringer
+}
+
+// newPrefetcher returns the _Prefetcher for the configured backend.  When the
+// backend is config.PrefetchBackendAuto, the backend is selected based on the
+// filesystem pgdataPath resides on.
+func newPrefetcher(backend config.PrefetchBackend, pgdataPath string) (_Prefetcher, error) {
+	if backend == config.PrefetchBackendAuto {
+		var err error
+		if backend, err = autoPrefetchBackend(pgdataPath); err != nil {
+			return nil, errors.Wrap(err, "unable to select a prefetch backend")
+		}
+	}
+
+	switch backend {
+	case config.PrefetchBackendPread:
+		return &_PreadPrefetcher{}, nil
+	default:
+		return newPlatformPrefetcher(backend)
+	}
+}
+
+// _PreadPrefetcher reads pages into a scratch buffer using pread(2).  pread(2)
+// is the only portable backend and works on filesystems that ignore advisory
+// hints (e.g. ZFS), at the cost of copying every page into userland.
+type _PreadPrefetcher struct {
+	bufs sync.Pool
+}
+
+func (p *_PreadPrefetcher) prefetch(f *os.File, off, length int64) error {
+	var buf []byte
+	if bufRaw := p.bufs.Get(); bufRaw != nil {
+		buf = *bufRaw.(*[]byte)
+	}
+	if int64(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	defer p.bufs.Put(&buf)
+
+	if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return errors.Wrap(err, "unable to pread(2)")
+	}
+
+	return nil
+}
+
+func (p *_PreadPrefetcher) String() string {
+	return config.PrefetchBackendPread.String()
+}
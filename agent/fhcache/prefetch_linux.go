@@ -0,0 +1,126 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fhcache
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// zfsSuperMagic is the f_type reported by statfs(2) for ZFS on Linux.
+const zfsSuperMagic = 0x2fc12fc1
+
+// autoPrefetchBackend selects a backend based on the filesystem path resides
+// on.  ZFS does not implement posix_fadvise(2), readahead(2), or
+// madvise(MADV_WILLNEED) for files in the ARC, so the only way to fault pages
+// in is to read them.
+func autoPrefetchBackend(path string) (config.PrefetchBackend, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return config.PrefetchBackendAuto, errors.Wrapf(err, "unable to statfs(2) %q", path)
+	}
+
+	backend := config.PrefetchBackendFadvise
+	if fs.Type == zfsSuperMagic {
+		backend = config.PrefetchBackendPread
+	}
+
+	log.Debug().Str("path", path).Str("fs-type", fmt.Sprintf("0x%x", fs.Type)).
+		Str("backend", backend.String()).Msg("selected prefetch backend")
+
+	return backend, nil
+}
+
+func newPlatformPrefetcher(backend config.PrefetchBackend) (_Prefetcher, error) {
+	switch backend {
+	case config.PrefetchBackendFadvise:
+		return _FadvisePrefetcher{}, nil
+	case config.PrefetchBackendReadahead:
+		return _ReadaheadPrefetcher{}, nil
+	case config.PrefetchBackendMmap:
+		return _MmapPrefetcher{pageSize: int64(os.Getpagesize())}, nil
+	default:
+		return nil, errors.Errorf("unsupported prefetch backend: %s", backend)
+	}
+}
+
+// _FadvisePrefetcher advises the kernel that the range will be needed using
+// posix_fadvise(POSIX_FADV_WILLNEED).  The kernel initiates readahead
+// asynchronously and the call returns without waiting for the IO.
+type _FadvisePrefetcher struct{}
+
+func (_FadvisePrefetcher) prefetch(f *os.File, off, length int64) error {
+	if err := unix.Fadvise(int(f.Fd()), off, length, unix.FADV_WILLNEED); err != nil {
+		return errors.Wrap(err, "unable to posix_fadvise(2)")
+	}
+
+	return nil
+}
+
+func (_FadvisePrefetcher) String() string {
+	return config.PrefetchBackendFadvise.String()
+}
+
+// _ReadaheadPrefetcher uses readahead(2), which blocks until the range has
+// been read into the page cache.
+type _ReadaheadPrefetcher struct{}
+
+func (_ReadaheadPrefetcher) prefetch(f *os.File, off, length int64) error {
+	_, _, errno := unix.Syscall(unix.SYS_READAHEAD, f.Fd(), uintptr(off), uintptr(length))
+	if errno != 0 {
+		return errors.Wrap(errno, "unable to readahead(2)")
+	}
+
+	return nil
+}
+
+func (_ReadaheadPrefetcher) String() string {
+	return config.PrefetchBackendReadahead.String()
+}
+
+// _MmapPrefetcher maps the range and advises the kernel using
+// madvise(MADV_WILLNEED).  The mapping is released immediately, the readahead
+// initiated by madvise(2) populates the page cache, not the mapping.
+type _MmapPrefetcher struct {
+	pageSize int64
+}
+
+func (p _MmapPrefetcher) prefetch(f *os.File, off, length int64) error {
+	// mmap(2) requires an offset aligned to the system's page size.
+	alignedOff := off &^ (p.pageSize - 1)
+	length += off - alignedOff
+
+	buf, err := unix.Mmap(int(f.Fd()), alignedOff, int(length), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return errors.Wrap(err, "unable to mmap(2)")
+	}
+	defer unix.Munmap(buf)
+
+	if err := unix.Madvise(buf, unix.MADV_WILLNEED); err != nil {
+		return errors.Wrap(err, "unable to madvise(2)")
+	}
+
+	return nil
+}
+
+func (_MmapPrefetcher) String() string {
+	return config.PrefetchBackendMmap.String()
+}
@@ -0,0 +1,55 @@
+// +build linux
+
+package fhcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_Prefetcher(t *testing.T) {
+	f, err := ioutil.TempFile("", "prefetch")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, 3*8192)); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	backends := []config.PrefetchBackend{
+		config.PrefetchBackendPread,
+		config.PrefetchBackendFadvise,
+		config.PrefetchBackendReadahead,
+		config.PrefetchBackendMmap,
+	}
+
+	for n, backend := range backends {
+		p, err := newPrefetcher(backend, os.TempDir())
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(p.String(), backend.String()); diff != "" {
+			t.Fatalf("%d: backend diff: (-got +want)\n%s", n, diff)
+		}
+
+		// Exercise an offset that is not aligned to the system's page size and a
+		// range that extends past the end of the file.
+		for _, off := range []int64{0, 8192, 100, 2 * 8192} {
+			if err := p.prefetch(f, off, 8192+1); err != nil {
+				t.Fatalf("%d: %s prefetch at %d: %v", n, backend, off, err)
+			}
+		}
+	}
+
+	if _, err := newPrefetcher(config.PrefetchBackendAuto, os.TempDir()); err != nil {
+		t.Fatalf("auto: bad: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin dragonfly freebsd netbsd openbsd solaris
+
+package fhcache
+
+import (
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+)
+
+// autoPrefetchBackend always selects pread(2): it is the only backend
+// available on every platform.
+func autoPrefetchBackend(path string) (config.PrefetchBackend, error) {
+	return config.PrefetchBackendPread, nil
+}
+
+func newPlatformPrefetcher(backend config.PrefetchBackend) (_Prefetcher, error) {
+	return nil, errors.Errorf("prefetch backend %s is only supported on Linux", backend)
+}
@@ -0,0 +1,59 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fhcache
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mmapSegment maps f read-only.  Mapping a file does not fault in any of its
+// pages.  An empty file is not mapped and returns a nil slice.
+func mmapSegment(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to stat relation segment")
+	}
+
+	if fi.Size() == 0 {
+		return nil, nil
+	}
+
+	m, err := unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to mmap(2) relation segment")
+	}
+
+	return m, nil
+}
+
+func munmapSegment(m []byte) error {
+	return unix.Munmap(m)
+}
+
+// mincore is a wrapper around mincore(2).  b MUST start on a page boundary and
+// vec MUST have one byte for every page in b.
+func mincore(b []byte, vec []byte) error {
+	_, _, errno := unix.Syscall(unix.SYS_MINCORE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return errors.Wrap(errno, "unable to mincore(2)")
+	}
+
+	return nil
+}
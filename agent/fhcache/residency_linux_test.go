@@ -0,0 +1,67 @@
+// +build linux
+
+package fhcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_FileHandleCache_Resident(t *testing.T) {
+	pgdata, err := ioutil.TempDir("", "pgdata")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(pgdata)
+
+	if err := os.MkdirAll(path.Join(pgdata, "base", "16398"), 0700); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Freshly written pages are resident in the page cache.
+	if err := ioutil.WriteFile(path.Join(pgdata, "base", "16398", "24576"), make([]byte, 3*8192), 0600); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fhc, err := New(ctx, &config.Config{
+		FHCacheConfig: config.FHCacheConfig{
+			Size:            10,
+			TTL:             time.Minute,
+			PGDataPath:      pgdata,
+			PrefetchBackend: config.PrefetchBackendPread,
+			ResidencyCheck:  true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer fhc.Purge()
+
+	key := structs.IOCacheKey{
+		Tablespace: 1663,
+		Database:   16398,
+		Relation:   24576,
+		Block:      1,
+	}
+
+	// The last two pages are beyond the end of the segment.
+	resident, err := fhc.Resident(key, 4)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if diff := pretty.Compare(resident, []bool{true, true, false, false}); diff != "" {
+		t.Fatalf("resident diff: (-got +want)\n%s", diff)
+	}
+}
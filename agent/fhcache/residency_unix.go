@@ -0,0 +1,36 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin dragonfly freebsd netbsd openbsd solaris
+
+package fhcache
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mmapSegment is only implemented on Linux, residency checks are skipped
+// elsewhere.
+func mmapSegment(f *os.File) ([]byte, error) {
+	return nil, errors.New("residency checks are only supported on Linux")
+}
+
+func munmapSegment(m []byte) error {
+	return nil
+}
+
+func mincore(b []byte, vec []byte) error {
+	return errors.New("residency checks are only supported on Linux")
+}
@@ -0,0 +1,109 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhcache
+
+import (
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+)
+
+// _Tablespaces resolves a tablespace OID to the directory that contains the
+// tablespace's per-database directories.  Resolved directories are cached
+// because the version directory of a tablespace does not change while
+// PostgreSQL is running.
+type _Tablespaces struct {
+	pgdataPath string
+
+	lock  sync.RWMutex
+	dirs  map[pg.OID]string
+	major uint64
+}
+
+func _NewTablespaces(pgdataPath string) *_Tablespaces {
+	return &_Tablespaces{
+		pgdataPath: pgdataPath,
+		dirs: map[pg.OID]string{
+			pg.DefaultTablespaceOID: path.Join(pgdataPath, "base"),
+			pg.GlobalTablespaceOID:  path.Join(pgdataPath, "global"),
+		},
+	}
+}
+
+// dir returns the directory of the given tablespace.  User-defined tablespaces
+// are found in pg_tblspc/<oid>/PG_<major>_<catversion>.
+func (ts *_Tablespaces) dir(tablespace pg.OID) (string, error) {
+	ts.lock.RLock()
+	dir, found := ts.dirs[tablespace]
+	ts.lock.RUnlock()
+	if found {
+		return dir, nil
+	}
+
+	pgVersion, err := pg.ReadVersionFile(ts.pgdataPath)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to determine the tablespace version directory")
+	}
+
+	// The catalog version is not known without reading pg_control, however
+	// PostgreSQL only ever creates one version directory per major version.
+	// Failures are not cached: the tablespace may not exist yet.
+	pattern := path.Join(ts.pgdataPath, pg.TablespaceDirectory,
+		strconv.FormatUint(uint64(tablespace), 10), pg.TablespaceVersionPrefix(pgVersion)+"*")
+	matches, err := filepath.Glob(pattern)
+	switch {
+	case err != nil:
+		return "", errors.Wrapf(err, "unable to search for tablespace %d", tablespace)
+	case len(matches) == 0:
+		return "", errors.Errorf("unable to find tablespace %d (%q)", tablespace, pattern)
+	case len(matches) > 1:
+		return "", errors.Errorf("found %d version directories for tablespace %d: %q", len(matches), tablespace, matches)
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.dirs[tablespace] = matches[0]
+
+	return matches[0], nil
+}
+
+// slruDir returns the directory of the given SLRU.  The directory of some SLRUs
+// depends on the major version of PostgreSQL (e.g. pg_clog was renamed to
+// pg_xact in PostgreSQL 10).
+func (ts *_Tablespaces) slruDir(slru pg.SLRU) (string, error) {
+	ts.lock.RLock()
+	major := ts.major
+	ts.lock.RUnlock()
+
+	if major == 0 {
+		pgVersion, err := pg.ReadVersionFile(ts.pgdataPath)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to determine the SLRU directory")
+		}
+
+		if major, err = pg.ParseMajorVersion(pgVersion); err != nil {
+			return "", errors.Wrap(err, "unable to determine the SLRU directory")
+		}
+
+		ts.lock.Lock()
+		ts.major = major
+		ts.lock.Unlock()
+	}
+
+	return path.Join(ts.pgdataPath, slru.Dir(major)), nil
+}
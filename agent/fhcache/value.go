@@ -32,6 +32,10 @@ type _Value struct {
 	// need it?
 	lock *sync.RWMutex
 	f    *os.File
+
+	// m is a read-only mapping of f used to check residency with mincore(2).
+	// m is nil if residency checks are disabled or f could not be mapped.
+	m []byte
 }
 
 func (fh *_Value) close() {
@@ -45,6 +49,13 @@ func (fh *_Value) close() {
 		return
 	}
 
+	if fh.m != nil {
+		if err := munmapSegment(fh.m); err != nil {
+			log.Error().Err(err).Msg("unable to unmap relation segment")
+		}
+		fh.m = nil
+	}
+
 	if err := fh.f.Close(); err != nil {
 		log.Error().Err(err).Msg("unable to close FD")
 	}
@@ -54,8 +65,12 @@ func (fh *_Value) close() {
 	closeLock.Unlock()
 }
 
-func (value *_Value) open(pgdataPath string) (*os.File, error) {
-	filename := value._Key.filename(pgdataPath)
+func (value *_Value) open(tablespaces *_Tablespaces) (*os.File, error) {
+	filename, err := value._Key.filename(tablespaces)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to determine relation segment filename")
+	}
+
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to open relation segment %q", filename)
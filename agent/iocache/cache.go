@@ -15,7 +15,9 @@ package iocache
 
 import (
 	"context"
+	"expvar"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluele/gcache"
@@ -23,9 +25,27 @@ import (
 	"github.com/bschofield/pg_prefaulter/agent/structs"
 	"github.com/bschofield/pg_prefaulter/config"
 	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
 	log "github.com/rs/zerolog/log"
 )
 
+var (
+	// residentPages counts the requested pages that were skipped because they
+	// were already resident in the page cache.  faultedPages counts the pages
+	// spanned by the ranges handed to the _Engine, including the unrequested
+	// pages read to merge two requests.  stalePages counts the requested pages
+	// that were discarded because PostgreSQL had already replayed the WAL
+	// record referencing them.  invalidatedPages counts the queued pages that
+	// were discarded because their relation was dropped or truncated.
+	// throttledPages counts the requested pages that waited for room in a full
+	// queue.
+	residentPages    = expvar.NewInt("iocache-resident-pages")
+	faultedPages     = expvar.NewInt("iocache-faulted-pages")
+	stalePages       = expvar.NewInt("iocache-stale-pages")
+	invalidatedPages = expvar.NewInt("iocache-invalidated-pages")
+	throttledPages   = expvar.NewInt("iocache-throttled-pages")
+)
+
 // IOCache is a read-through cache to:
 //
 // a) provide a reentrant interface
@@ -36,13 +56,38 @@ import (
 // d) sized sufficiently large so that we can spend our time faulting in pages
 //    vs performing cache hits.
 type IOCache struct {
+	// replayLSN is the most recent replay LSN reported by PostgreSQL.  Accessed
+	// atomically and kept first in the struct for 64-bit alignment.
+	replayLSN uint64
+
 	ctx context.Context
 	wg  sync.WaitGroup
 	cfg *config.IOCacheConfig
 
-	purgeLock sync.Mutex
-	c         gcache.Cache
-	fhCache   *fhcache.FileHandleCache
+	purgeLock  sync.Mutex
+	submitLock sync.Mutex
+	c          gcache.Cache
+	index      *structs.RelationKeyIndex
+	fhCache    *fhcache.FileHandleCache
+	engine     _Engine
+
+	// requests holds the pages waiting to be coalesced and ranges holds the
+	// ranges waiting on the _Engine.  Both are ordered by LSN.  queued counts
+	// the requests held by both queues and bounds them to MaxQueuedPages.
+	requests *lib.PriorityQueue
+	ranges   *lib.PriorityQueue
+	queued   *_QueueLimit
+
+	// maxSpanPages and maxGapPages are the coalescing limits in units of heap
+	// pages.
+	maxSpanPages uint32
+	maxGapPages  uint32
+
+	// residencyCheck is set when pages are checked with mincore(2) before
+	// issuing IO.  ttl is the lifetime of cache entries, which is shortened to
+	// the revalidate interval when residencyCheck is set.
+	residencyCheck bool
+	ttl            time.Duration
 }
 
 // New creates a new IOCache.
@@ -51,70 +96,321 @@ func New(ctx context.Context, cfg *config.Config, fhc *fhcache.FileHandleCache)
 		ctx:     ctx,
 		cfg:     &cfg.IOCacheConfig,
 		fhCache: fhc,
+
+		residencyCheck: cfg.FHCacheConfig.ResidencyCheck,
+		ttl:            cfg.IOCacheConfig.TTL,
 	}
 
-	ioWorkQueue := make(chan structs.IOCacheKey)
-	for ioWorker := uint(0); ioWorker < ioc.cfg.MaxConcurrentIOs; ioWorker++ {
-		ioc.wg.Add(1)
-		go func(threadID uint) {
-			defer func() {
-				ioc.wg.Done()
-			}()
-
-			for {
-				select {
-				case <-ioc.ctx.Done():
-					return
-				case ioReq, ok := <-ioWorkQueue:
-					if !ok {
-						return
-					}
-
-					if err := ioc.fhCache.PrefaultPage(ioReq); err != nil {
-						// If we had a problem prefaulting in the WAL file, for whatever
-						// reason, attempt to remove it from the cache.
-						ioc.c.Remove(ioReq)
-
-						log.Warn().Uint("io-worker-thread-id", threadID).Err(err).
-							Uint64("database", uint64(ioReq.Database)).
-							Uint64("relation", uint64(ioReq.Relation)).
-							Uint64("block", uint64(ioReq.Block)).Msg("unable to prefault page")
-					}
-				}
-			}
-		}(ioWorker)
+	if ioc.residencyCheck && ioc.cfg.RevalidateInterval > 0 && ioc.cfg.RevalidateInterval < ioc.ttl {
+		ioc.ttl = ioc.cfg.RevalidateInterval
 	}
-	log.Info().Uint("io-worker-threads", ioc.cfg.MaxConcurrentIOs).Msg("started IO worker threads")
 
-	ioc.c = gcache.New(int(ioc.cfg.Size)).
-		ARC().
-		LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
-			select {
-			case <-ioc.ctx.Done():
-			case ioWorkQueue <- key.(structs.IOCacheKey):
-			}
+	// The cluster's geometry has been detected by now, convert the coalescing
+	// limits from bytes to pages.
+	ioc.maxSpanPages = uint32(ioc.cfg.CoalesceMaxSpan / pg.HeapPageSize)
+	if ioc.maxSpanPages == 0 {
+		ioc.maxSpanPages = 1
+	}
+	ioc.maxGapPages = uint32(ioc.cfg.CoalesceMaxGap / pg.HeapPageSize)
 
-			return struct{}{}, &ioc.cfg.TTL, nil
+	ioc.requests = lib.NewPriorityQueue()
+	ioc.ranges = lib.NewPriorityQueue()
+	ioc.queued = newQueueLimit(ioc.cfg.MaxQueuedPages)
+	go func() {
+		<-ioc.ctx.Done()
+		ioc.queued.close()
+		ioc.requests.Close()
+		ioc.ranges.Close()
+	}()
 
-		}).
-		Build()
+	ioc.wg.Add(1)
+	go ioc.coalesceIOs()
+
+	ioc.engine = newEngine(ioc)
+	ioc.engine.start()
+
+	// The cache only records which pages have been prefaulted recently.  Misses
+	// are queued by Prefault() rather than loaded by gcache so that IOs can be
+	// issued in LSN order.
+	ioc.index = structs.NewRelationKeyIndex()
+	ioc.c = newPageCache(int(ioc.cfg.Size), ioc.index)
 
 	go lib.LogCacheStats(ioc.ctx, ioc.c, "iocache-stats")
+	go ioc.logIOStats()
 
 	return ioc, nil
 }
 
-// GetIFPresent forwards to gcache.Cache's GetIFPresent().
-func (ioc *IOCache) GetIFPresent(k interface{}) (interface{}, error) {
-	return ioc.c.GetIFPresent(k)
+// newPageCache returns the cache of recently prefaulted pages.  The cache's keys
+// are indexed by relation fork in index for Invalidate().  SLRU pages are never
+// invalidated and are not indexed.
+func newPageCache(size int, index *structs.RelationKeyIndex) gcache.Cache {
+	return gcache.New(size).
+		ARC().
+		AddedFunc(func(keyRaw, _ interface{}) {
+			if key := keyRaw.(structs.IOCacheKey); key.SLRU == pg.NoSLRU {
+				index.Add(key.RelationForkKey(), key)
+			}
+		}).
+		EvictedFunc(func(keyRaw, _ interface{}) {
+			if key := keyRaw.(structs.IOCacheKey); key.SLRU == pg.NoSLRU {
+				index.Remove(key.RelationForkKey(), key)
+			}
+		}).
+		Build()
+}
+
+// logIOStats periodically logs the number of requested pages that were found
+// resident, faulted in, or discarded as stale.
+func (ioc *IOCache) logIOStats() {
+	for {
+		select {
+		case <-ioc.ctx.Done():
+			return
+		case <-time.After(config.StatsInterval):
+			log.Debug().
+				Int64("resident", residentPages.Value()).
+				Int64("faulted", faultedPages.Value()).
+				Int64("stale", stalePages.Value()).
+				Int64("invalidated", invalidatedPages.Value()).
+				Int64("throttled", throttledPages.Value()).
+				Msg("iocache-io-stats")
+		}
+	}
 }
 
-// Purge purges the IOCache of its cache (and all downstream caches)
+// Prefault queues an IO for the page referenced by ioCacheKey unless the page
+// has been prefaulted recently.  lsn is the LSN of the WAL record referencing
+// the page: queued IOs are issued lowest LSN first so that the startup process
+// never waits on a page that is queued behind pages it needs later.  Requests
+// for records PostgreSQL has already replayed are discarded.  When
+// MaxQueuedPages requests are already queued, Prefault blocks until the
+// _Engine has made room.  Prefault returns true when the page was found in the
+// IOCache.
+func (ioc *IOCache) Prefault(ioCacheKey structs.IOCacheKey, lsn pg.LSN) (hit bool) {
+	if lsn < ioc.ReplayLSN() {
+		stalePages.Add(1)
+		return false
+	}
+
+	// Reserve room in the queues before taking submitLock so that Invalidate(),
+	// Purge() and PrefaultDatabase() never wait behind a throttled caller.  The
+	// reservation is returned if the page turns out to need no IO.
+	if ioc.queued.full() {
+		throttledPages.Add(1)
+	}
+	if !ioc.queued.add(1, true) {
+		return false
+	}
+
+	ioc.submitLock.Lock()
+	defer ioc.submitLock.Unlock()
+
+	// Replay may have moved past lsn while waiting for room.
+	if lsn < ioc.ReplayLSN() {
+		ioc.queued.done(1)
+		stalePages.Add(1)
+		return false
+	}
+
+	if _, err := ioc.c.GetIFPresent(ioCacheKey); err == nil {
+		ioc.queued.done(1)
+		return true
+	}
+
+	if err := ioc.c.SetWithExpire(ioCacheKey, struct{}{}, ioc.ttl); err != nil {
+		log.Debug().Err(err).Msg("iocache Prefault()")
+	}
+	ioc.requests.Push(_IORequest{key: ioCacheKey, lsn: lsn}, uint64(lsn))
+
+	return false
+}
+
+// PrefaultDatabase queues IOs for every relation segment in the directory of
+// database in tablespace.  The startup process reads every file of a template
+// database when replaying a Database CREATE record at lsn.  The segments are
+// read sequentially in ranges of at most the coalescing span and bypass the
+// cache: they are read once and would otherwise displace the pages of
+// individual WAL records.  The ranges count towards MaxQueuedPages but never
+// wait for room.  PrefaultDatabase returns the number of pages queued.
+func (ioc *IOCache) PrefaultDatabase(tablespace, database pg.OID, lsn pg.LSN) (pages uint64, err error) {
+	if lsn < ioc.ReplayLSN() {
+		return 0, nil
+	}
+
+	extents, err := ioc.fhCache.DatabaseSegments(tablespace, database)
+	if err != nil {
+		return 0, err
+	}
+
+	ioc.submitLock.Lock()
+	defer ioc.submitLock.Unlock()
+
+	ranges := extentRanges(extents, ioc.maxSpanPages, lsn)
+	ioc.queued.add(len(ranges), false)
+	for _, r := range ranges {
+		ioc.ranges.Push(r, uint64(lsn))
+		pages += uint64(r.numPages)
+	}
+	faultedPages.Add(int64(pages))
+
+	return pages, nil
+}
+
+// ReplayLSN returns the most recent replay LSN passed to SetReplayLSN().
+func (ioc *IOCache) ReplayLSN() pg.LSN {
+	return pg.LSN(atomic.LoadUint64(&ioc.replayLSN))
+}
+
+// SetReplayLSN records the LSN PostgreSQL has replayed up to.  Queued IOs for
+// WAL records behind lsn are discarded instead of being issued.
+func (ioc *IOCache) SetReplayLSN(lsn pg.LSN) {
+	atomic.StoreUint64(&ioc.replayLSN, uint64(lsn))
+}
+
+// popRange returns the next range for the _Engine.  Requests for WAL records
+// behind the replay LSN are dropped and ranges with no remaining requests are
+// skipped.  When wait is false popRange does not block.  ok is false if no
+// range is available or the queue has been closed.
+func (ioc *IOCache) popRange(wait bool) (r _IORange, ok bool) {
+	for {
+		var rRaw interface{}
+		if wait {
+			rRaw, ok = ioc.ranges.Pop()
+		} else {
+			rRaw, ok = ioc.ranges.TryPop()
+		}
+		if !ok {
+			return _IORange{}, false
+		}
+
+		r = rRaw.(_IORange)
+		ioc.queued.done(len(r.reqs))
+		replayLSN := ioc.ReplayLSN()
+		if r.lsn >= replayLSN {
+			return r, true
+		}
+
+		reqs := make([]_IORequest, 0, len(r.reqs))
+		for _, ioReq := range r.reqs {
+			if ioReq.lsn >= replayLSN {
+				reqs = append(reqs, ioReq)
+				continue
+			}
+
+			// Forget the page so that a later record referencing it is prefaulted.
+			ioc.c.Remove(ioReq.key)
+		}
+		stalePages.Add(int64(len(r.reqs) - len(reqs)))
+
+		if len(reqs) > 0 {
+			return newIORange(reqs), true
+		}
+	}
+}
+
+// prefaultFailed is called by an _Engine when an IO fails.
+func (ioc *IOCache) prefaultFailed(workerID uint, r _IORange, err error) {
+	// If we had a problem prefaulting in the WAL file, for whatever reason,
+	// attempt to remove it from the cache.
+	for _, ioReq := range r.reqs {
+		ioc.c.Remove(ioReq.key)
+	}
+
+	log.Warn().Uint("io-worker-thread-id", workerID).Err(err).
+		Str("io-engine", ioc.engine.String()).
+		Uint64("database", uint64(r.start.Database)).
+		Uint64("relation", uint64(r.start.Relation)).
+		Str("fork", r.start.Fork.String()).
+		Uint64("block", uint64(r.start.Block)).
+		Uint32("pages", r.numPages).Msg("unable to prefault page")
+}
+
+// Invalidate forgets the pages of relation forks that have been created,
+// truncated, or dropped: queued IOs for the affected blocks are discarded, the
+// blocks are removed from the cache so that later records referencing them
+// are prefaulted again, and the file handles of the affected segments are
+// closed.
+func (ioc *IOCache) Invalidate(events []pg.RelationEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	ioc.purgeLock.Lock()
+	defer ioc.purgeLock.Unlock()
+
+	inv := structs.NewInvalidations(events)
+	pages := ioc.invalidate(inv)
+	closed := ioc.fhCache.Invalidate(inv)
+
+	log.Debug().
+		Int("relation-forks", len(inv)).
+		Int("queued-pages", pages).
+		Int("file-handles", closed).
+		Msg("invalidated relations")
+}
+
+// invalidate discards the queued requests and cached pages invalidated by
+// inv and returns the number of queued requests discarded.
+func (ioc *IOCache) invalidate(inv structs.Invalidations) int {
+	ioc.submitLock.Lock()
+	defer ioc.submitLock.Unlock()
+
+	pages := ioc.requests.Filter(func(ioReqRaw interface{}) (interface{}, bool) {
+		return ioReqRaw, !inv.Invalid(ioReqRaw.(_IORequest).key)
+	})
+
+	ioc.ranges.Filter(func(rRaw interface{}) (interface{}, bool) {
+		// The requests of a range are sorted by block and the invalid blocks of a
+		// fork are those at or beyond the first invalid block.
+		r := rRaw.(_IORange)
+		if !inv.Invalid(r.reqs[len(r.reqs)-1].key) {
+			return r, true
+		}
+
+		reqs := make([]_IORequest, 0, len(r.reqs))
+		for _, ioReq := range r.reqs {
+			if !inv.Invalid(ioReq.key) {
+				reqs = append(reqs, ioReq)
+			}
+		}
+		pages += len(r.reqs) - len(reqs)
+
+		if len(reqs) == 0 {
+			return nil, false
+		}
+		return newIORange(reqs), true
+	})
+	invalidatedPages.Add(int64(pages))
+	ioc.queued.done(pages)
+
+	// The index is locked by the cache's callbacks: it is not held while
+	// removing keys from the cache.
+	for _, keyRaw := range ioc.index.Keys(inv) {
+		if inv.Invalid(keyRaw.(structs.IOCacheKey)) {
+			ioc.c.Remove(keyRaw)
+		}
+	}
+
+	return pages
+}
+
+// Purge purges the IOCache of its cache and queued IOs (and all downstream
+// caches)
 func (ioc *IOCache) Purge() {
 	ioc.purgeLock.Lock()
 	defer ioc.purgeLock.Unlock()
 
+	ioc.submitLock.Lock()
+	pages := len(ioc.requests.Purge())
+	for _, rRaw := range ioc.ranges.Purge() {
+		pages += len(rRaw.(_IORange).reqs)
+	}
+	ioc.queued.done(pages)
 	ioc.c.Purge()
+	ioc.index.Purge()
+	ioc.submitLock.Unlock()
+
 	ioc.fhCache.Purge()
 }
 
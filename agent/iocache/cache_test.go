@@ -0,0 +1,187 @@
+package iocache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestIOCache_popRange(t *testing.T) {
+	ioc := &IOCache{
+		c:      gcache.New(16).ARC().Build(),
+		ranges: lib.NewPriorityQueue(),
+		queued: newQueueLimit(0),
+	}
+
+	key := func(block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 16398, Relation: 24576, Block: block}
+	}
+
+	push := func(reqs ..._IORequest) {
+		for _, ioReq := range reqs {
+			ioc.c.Set(ioReq.key, struct{}{})
+		}
+		r := newIORange(reqs)
+		ioc.ranges.Push(r, uint64(r.lsn))
+	}
+
+	push(_IORequest{key: key(0), lsn: 100})
+	push(_IORequest{key: key(10), lsn: 150}, _IORequest{key: key(11), lsn: 300}, _IORequest{key: key(12), lsn: 250})
+	push(_IORequest{key: key(20), lsn: 400})
+
+	ioc.SetReplayLSN(200)
+	before := stalePages.Value()
+
+	r, ok := ioc.popRange(false)
+	if !ok {
+		t.Fatalf("expected a range")
+	}
+
+	// The range is trimmed to the requests at or beyond replay.
+	if diff := pretty.Compare([]interface{}{r.start, r.numPages, r.lsn, len(r.reqs)}, []interface{}{key(11), uint32(2), pg.LSN(250), 2}); diff != "" {
+		t.Fatalf("range diff: (-got +want)\n%s", diff)
+	}
+
+	if diff := pretty.Compare(stalePages.Value()-before, int64(2)); diff != "" {
+		t.Fatalf("stale pages diff: (-got +want)\n%s", diff)
+	}
+
+	// Stale pages are forgotten so that later records prefault them again.
+	for _, k := range []structs.IOCacheKey{key(0), key(10)} {
+		if _, err := ioc.c.GetIFPresent(k); err != gcache.KeyNotFoundError {
+			t.Fatalf("expected %v to be evicted: %v", k, err)
+		}
+	}
+
+	if r, ok = ioc.popRange(false); !ok || r.start != key(20) {
+		t.Fatalf("expected block 20, got %v (%t)", r.start, ok)
+	}
+
+	if _, ok = ioc.popRange(false); ok {
+		t.Fatalf("expected an empty queue")
+	}
+}
+
+func TestIOCache_invalidate(t *testing.T) {
+	index := structs.NewRelationKeyIndex()
+	ioc := &IOCache{
+		c:        newPageCache(16, index),
+		index:    index,
+		requests: lib.NewPriorityQueue(),
+		ranges:   lib.NewPriorityQueue(),
+		queued:   newQueueLimit(0),
+	}
+
+	rel := pg.RelFileNode{Tablespace: 1663, Database: 16398, Relation: 24576}
+	dropped := pg.RelFileNode{Tablespace: 1663, Database: 16398, Relation: 24580}
+	key := func(rnode pg.RelFileNode, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: rnode.Tablespace, Database: rnode.Database, Relation: rnode.Relation, Block: block}
+	}
+
+	for _, k := range []structs.IOCacheKey{key(rel, 1), key(rel, 10), key(dropped, 3)} {
+		ioc.c.Set(k, struct{}{})
+		ioc.requests.Push(_IORequest{key: k, lsn: 100}, 100)
+	}
+
+	reqs := []_IORequest{{key: key(rel, 5), lsn: 200}, {key: key(rel, 9), lsn: 150}, {key: key(rel, 12), lsn: 210}}
+	for _, ioReq := range reqs {
+		ioc.c.Set(ioReq.key, struct{}{})
+	}
+	ioc.ranges.Push(newIORange(reqs), 150)
+	ioc.ranges.Push(newIORange([]_IORequest{{key: key(dropped, 7), lsn: 220}}), 220)
+	ioc.queued.add(7, false)
+
+	events := append(pg.SMGRTruncateEvents(rel, 9, 0x1), pg.DropEvents(dropped)...)
+	before := invalidatedPages.Value()
+	if pages := ioc.invalidate(structs.NewInvalidations(events)); pages != 5 {
+		t.Fatalf("expected 5 pages invalidated, got %d", pages)
+	}
+
+	if diff := pretty.Compare(invalidatedPages.Value()-before, int64(5)); diff != "" {
+		t.Fatalf("invalidated pages diff: (-got +want)\n%s", diff)
+	}
+
+	if diff := pretty.Compare(ioc.queued.queued, 2); diff != "" {
+		t.Fatalf("queued diff: (-got +want)\n%s", diff)
+	}
+
+	if diff := pretty.Compare(ioc.requests.Purge(), []interface{}{_IORequest{key: key(rel, 1), lsn: 100}}); diff != "" {
+		t.Fatalf("requests diff: (-got +want)\n%s", diff)
+	}
+
+	r, ok := ioc.popRange(false)
+	if !ok {
+		t.Fatalf("expected a range")
+	}
+	if diff := pretty.Compare([]interface{}{r.start, r.numPages, r.lsn, len(r.reqs)}, []interface{}{key(rel, 5), uint32(1), pg.LSN(200), 1}); diff != "" {
+		t.Fatalf("range diff: (-got +want)\n%s", diff)
+	}
+	if _, ok = ioc.popRange(false); ok {
+		t.Fatalf("expected an empty queue")
+	}
+
+	// Invalidation must not look up (and promote) every cached page.
+	if hits := ioc.c.HitCount(); hits != 0 {
+		t.Fatalf("expected no cache hits, got %d", hits)
+	}
+
+	for _, k := range []structs.IOCacheKey{key(rel, 9), key(rel, 10), key(rel, 12), key(dropped, 3), key(dropped, 7)} {
+		if _, err := ioc.c.GetIFPresent(k); err != gcache.KeyNotFoundError {
+			t.Fatalf("expected %v to be evicted: %v", k, err)
+		}
+	}
+	for _, k := range []structs.IOCacheKey{key(rel, 1), key(rel, 5)} {
+		if _, err := ioc.c.GetIFPresent(k); err != nil {
+			t.Fatalf("expected %v to be cached: %v", k, err)
+		}
+	}
+}
+
+func TestIOCache_PrefaultThrottled(t *testing.T) {
+	index := structs.NewRelationKeyIndex()
+	ioc := &IOCache{
+		c:        newPageCache(16, index),
+		index:    index,
+		requests: lib.NewPriorityQueue(),
+		ranges:   lib.NewPriorityQueue(),
+		queued:   newQueueLimit(1),
+		ttl:      time.Minute,
+	}
+	ioc.queued.add(1, false)
+
+	key := structs.IOCacheKey{Tablespace: 1663, Database: 16398, Relation: 24576, Block: 3}
+	done := make(chan bool)
+	go func() {
+		done <- ioc.Prefault(key, 100)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected Prefault to wait for room in the queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// A throttled Prefault must not hold up invalidation.
+	invalidated := make(chan int)
+	go func() {
+		invalidated <- ioc.invalidate(structs.NewInvalidations(pg.DropEvents(pg.RelFileNode{Tablespace: 1663, Database: 16398, Relation: 24580})))
+	}()
+	select {
+	case <-invalidated:
+	case <-time.After(time.Second):
+		t.Fatalf("invalidate blocked behind a throttled Prefault")
+	}
+
+	ioc.queued.done(1)
+	if hit := <-done; hit {
+		t.Fatalf("expected a miss")
+	}
+	if diff := pretty.Compare(ioc.requests.Purge(), []interface{}{_IORequest{key: key, lsn: 100}}); diff != "" {
+		t.Fatalf("requests diff: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"sort"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// maxCoalesceBatch is the maximum number of IO requests considered at once
+// when merging requests into ranges.
+const maxCoalesceBatch = 1024
+
+// _IORequest is a request to prefault a single page.  lsn is the LSN of the
+// WAL record that references the page and determines when the page is needed
+// by the startup process.
+type _IORequest struct {
+	key structs.IOCacheKey
+	lsn pg.LSN
+}
+
+// _IORange is a run of pages in a single relation segment that is read using a
+// single IO.  The range starts at the page referenced by start and spans
+// numPages pages, which may include pages that were not requested.
+type _IORange struct {
+	start    structs.IOCacheKey
+	numPages uint32
+
+	// lsn is the lowest LSN of the requests satisfied by the range.
+	lsn pg.LSN
+
+	// reqs are the requests satisfied by the range.
+	reqs []_IORequest
+}
+
+// newIORange returns the range spanning reqs.  reqs MUST be sorted by block
+// and reference the same relation segment.
+func newIORange(reqs []_IORequest) _IORange {
+	r := _IORange{
+		start:    reqs[0].key,
+		numPages: uint32(reqs[len(reqs)-1].key.Block-reqs[0].key.Block) + 1,
+		lsn:      reqs[0].lsn,
+		reqs:     reqs,
+	}
+	for _, ioReq := range reqs[1:] {
+		if ioReq.lsn < r.lsn {
+			r.lsn = ioReq.lsn
+		}
+	}
+
+	return r
+}
+
+// extentRanges splits extents into ranges of at most maxSpan pages for the
+// WAL record at lsn.
+func extentRanges(extents []structs.IOCacheExtent, maxSpan uint32, lsn pg.LSN) []_IORange {
+	if maxSpan == 0 {
+		maxSpan = 1
+	}
+
+	var ranges []_IORange
+	for _, extent := range extents {
+		for offset := uint32(0); offset < extent.NumPages; offset += maxSpan {
+			start := extent.Start
+			start.Block += pg.HeapBlockNumber(offset)
+
+			numPages := extent.NumPages - offset
+			if numPages > maxSpan {
+				numPages = maxSpan
+			}
+
+			ranges = append(ranges, _IORange{
+				start:    start,
+				numPages: numPages,
+				lsn:      lsn,
+				reqs:     []_IORequest{{key: start, lsn: lsn}},
+			})
+		}
+	}
+
+	return ranges
+}
+
+// _SegmentKey identifies a relation or SLRU segment.
+type _SegmentKey struct {
+	tablespace pg.OID
+	database   pg.OID
+	relation   pg.OID
+	fork       pg.ForkNumber
+	slru       pg.SLRU
+	segment    pg.HeapSegmentNumber
+}
+
+func newSegmentKey(k structs.IOCacheKey) _SegmentKey {
+	return _SegmentKey{
+		tablespace: k.Tablespace,
+		database:   k.Database,
+		relation:   k.Relation,
+		fork:       k.Fork,
+		slru:       k.SLRU,
+		segment:    k.SegmentNumber(),
+	}
+}
+
+func (a _SegmentKey) less(b _SegmentKey) bool {
+	switch {
+	case a.tablespace != b.tablespace:
+		return a.tablespace < b.tablespace
+	case a.database != b.database:
+		return a.database < b.database
+	case a.relation != b.relation:
+		return a.relation < b.relation
+	case a.fork != b.fork:
+		return a.fork < b.fork
+	case a.slru != b.slru:
+		return a.slru < b.slru
+	default:
+		return a.segment < b.segment
+	}
+}
+
+// coalesce merges requests for nearby pages of the same relation segment into
+// ranges.  A range spans at most maxSpan pages and two requests are only
+// merged if at most maxGap unrequested pages separate them.  reqs is sorted in
+// place.
+func coalesce(reqs []_IORequest, maxSpan, maxGap uint32) []_IORange {
+	if maxSpan == 0 {
+		maxSpan = 1
+	}
+
+	sort.Slice(reqs, func(i, j int) bool {
+		si, sj := newSegmentKey(reqs[i].key), newSegmentKey(reqs[j].key)
+		if si != sj {
+			return si.less(sj)
+		}
+		return reqs[i].key.Block < reqs[j].key.Block
+	})
+
+	ranges := make([]_IORange, 0, len(reqs))
+	for i := 0; i < len(reqs); {
+		r := _IORange{start: reqs[i].key, numPages: 1, lsn: reqs[i].lsn}
+		seg := newSegmentKey(reqs[i].key)
+
+		j := i + 1
+		for ; j < len(reqs); j++ {
+			next := reqs[j].key
+			if newSegmentKey(next) != seg {
+				break
+			}
+
+			last := reqs[j-1].key.Block
+			span := uint64(next.Block-r.start.Block) + 1
+			gap := uint64(next.Block-last) - 1
+			if span > uint64(maxSpan) || (next.Block != last && gap > uint64(maxGap)) {
+				break
+			}
+			r.numPages = uint32(span)
+			if reqs[j].lsn < r.lsn {
+				r.lsn = reqs[j].lsn
+			}
+		}
+
+		r.reqs = append([]_IORequest(nil), reqs[i:j]...)
+		ranges = append(ranges, r)
+		i = j
+	}
+
+	return ranges
+}
+
+// coalesceIOs batches the queued requests, merges them into ranges, and
+// queues the ranges for the _Engine.  Both queues are ordered by LSN so the
+// requests needed soonest by the startup process are merged and issued first.
+// Requests are not delayed: a batch is whatever is waiting when the previous
+// batch has been queued, so merging happens naturally when requests arrive in
+// bursts (e.g. a WAL segment full of COPY or CREATE INDEX records).
+func (ioc *IOCache) coalesceIOs() {
+	defer ioc.wg.Done()
+
+	batch := make([]_IORequest, 0, maxCoalesceBatch)
+	for {
+		ioReq, ok := ioc.requests.Pop()
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], ioReq.(_IORequest))
+
+		for len(batch) < maxCoalesceBatch {
+			ioReq, ok := ioc.requests.TryPop()
+			if !ok {
+				break
+			}
+			batch = append(batch, ioReq.(_IORequest))
+		}
+
+		for _, r := range coalesce(batch, ioc.maxSpanPages, ioc.maxGapPages) {
+			if ioc.residencyCheck {
+				numReqs := len(r.reqs)
+				var needIO bool
+				r, needIO = ioc.skipResident(r)
+				if !needIO {
+					ioc.queued.done(numReqs)
+					continue
+				}
+				ioc.queued.done(numReqs - len(r.reqs))
+			}
+			faultedPages.Add(int64(r.numPages))
+
+			ioc.ranges.Push(r, uint64(r.lsn))
+		}
+	}
+}
+
+// skipResident removes the pages that are already resident in the page cache
+// from r and shrinks r to span the remaining pages.  needIO is false if every
+// page in r is resident.
+func (ioc *IOCache) skipResident(r _IORange) (_ _IORange, needIO bool) {
+	resident, err := ioc.fhCache.Resident(r.start, r.numPages)
+	if err != nil {
+		// Let the _Engine report the error when it attempts the IO.
+		return r, true
+	}
+
+	reqs := r.reqs[:0]
+	for _, ioReq := range r.reqs {
+		if !resident[ioReq.key.Block-r.start.Block] {
+			reqs = append(reqs, ioReq)
+		}
+	}
+	residentPages.Add(int64(len(r.reqs) - len(reqs)))
+
+	if len(reqs) == 0 {
+		return r, false
+	}
+
+	return newIORange(reqs), true
+}
@@ -0,0 +1,138 @@
+package iocache
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_coalesce(t *testing.T) {
+	key := func(relation pg.OID, fork pg.ForkNumber, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{
+			Tablespace: 1663,
+			Database:   16398,
+			Relation:   relation,
+			Fork:       fork,
+			Block:      block,
+		}
+	}
+
+	req := func(relation pg.OID, fork pg.ForkNumber, block pg.HeapBlockNumber) _IORequest {
+		return _IORequest{key: key(relation, fork, block), lsn: pg.LSN(block)}
+	}
+
+	type _Range struct {
+		Start    structs.IOCacheKey
+		NumPages uint32
+		LSN      pg.LSN
+		NumReqs  int
+	}
+
+	tests := []struct {
+		reqs    []_IORequest
+		maxSpan uint32
+		maxGap  uint32
+		want    []_Range
+	}{
+		{ // 0: a sequential run, delivered out of order, split at maxSpan
+			reqs:    []_IORequest{req(1, 0, 3), req(1, 0, 0), req(1, 0, 2), req(1, 0, 1), req(1, 0, 4)},
+			maxSpan: 4,
+			want: []_Range{
+				{Start: key(1, 0, 0), NumPages: 4, LSN: 0, NumReqs: 4},
+				{Start: key(1, 0, 4), NumPages: 1, LSN: 4, NumReqs: 1},
+			},
+		},
+		{ // 1: gaps at most maxGap pages are read through
+			reqs:    []_IORequest{req(1, 0, 10), req(1, 0, 12), req(1, 0, 15), req(1, 0, 19)},
+			maxSpan: 16,
+			maxGap:  2,
+			want: []_Range{
+				{Start: key(1, 0, 10), NumPages: 6, LSN: 10, NumReqs: 3},
+				{Start: key(1, 0, 19), NumPages: 1, LSN: 19, NumReqs: 1},
+			},
+		},
+		{ // 2: different relations and forks are never merged
+			reqs:    []_IORequest{req(1, 0, 0), req(2, 0, 1), req(1, pg.VisibilityMapForkNum, 1)},
+			maxSpan: 16,
+			maxGap:  16,
+			want: []_Range{
+				{Start: key(1, 0, 0), NumPages: 1, LSN: 0, NumReqs: 1},
+				{Start: key(1, pg.VisibilityMapForkNum, 1), NumPages: 1, LSN: 1, NumReqs: 1},
+				{Start: key(2, 0, 1), NumPages: 1, LSN: 1, NumReqs: 1},
+			},
+		},
+		{ // 3: ranges do not cross a segment boundary
+			reqs:    []_IORequest{req(1, 0, 131071), req(1, 0, 131072)},
+			maxSpan: 16,
+			want: []_Range{
+				{Start: key(1, 0, 131071), NumPages: 1, LSN: 131071, NumReqs: 1},
+				{Start: key(1, 0, 131072), NumPages: 1, LSN: 131072, NumReqs: 1},
+			},
+		},
+		{ // 4: merging disabled
+			reqs:    []_IORequest{req(1, 0, 0), req(1, 0, 1)},
+			maxSpan: 1,
+			want: []_Range{
+				{Start: key(1, 0, 0), NumPages: 1, LSN: 0, NumReqs: 1},
+				{Start: key(1, 0, 1), NumPages: 1, LSN: 1, NumReqs: 1},
+			},
+		},
+		{ // 5: a range is needed as soon as its earliest request
+			reqs: []_IORequest{
+				{key: key(1, 0, 0), lsn: 300},
+				{key: key(1, 0, 1), lsn: 100},
+				{key: key(1, 0, 2), lsn: 200},
+			},
+			maxSpan: 16,
+			want: []_Range{
+				{Start: key(1, 0, 0), NumPages: 3, LSN: 100, NumReqs: 3},
+			},
+		},
+	}
+
+	for n, test := range tests {
+		got := []_Range{}
+		for _, r := range coalesce(test.reqs, test.maxSpan, test.maxGap) {
+			got = append(got, _Range{Start: r.start, NumPages: r.numPages, LSN: r.lsn, NumReqs: len(r.reqs)})
+		}
+
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Fatalf("%d: ranges diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func Test_extentRanges(t *testing.T) {
+	key := func(relation pg.OID, block pg.HeapBlockNumber) structs.IOCacheKey {
+		return structs.IOCacheKey{Tablespace: 1663, Database: 1, Relation: relation, Block: block}
+	}
+
+	type _Range struct {
+		Start    structs.IOCacheKey
+		NumPages uint32
+		LSN      pg.LSN
+		NumReqs  int
+	}
+
+	extents := []structs.IOCacheExtent{
+		{Start: key(1259, 0), NumPages: 10},
+		{Start: key(1249, 131072), NumPages: 3},
+	}
+
+	var got []_Range
+	for _, r := range extentRanges(extents, 4, 100) {
+		got = append(got, _Range{Start: r.start, NumPages: r.numPages, LSN: r.lsn, NumReqs: len(r.reqs)})
+	}
+
+	want := []_Range{
+		{Start: key(1259, 0), NumPages: 4, LSN: 100, NumReqs: 1},
+		{Start: key(1259, 4), NumPages: 4, LSN: 100, NumReqs: 1},
+		{Start: key(1259, 8), NumPages: 2, LSN: 100, NumReqs: 1},
+		{Start: key(1249, 131072), NumPages: 3, LSN: 100, NumReqs: 1},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatalf("ranges diff: (-got +want)\n%s", diff)
+	}
+}
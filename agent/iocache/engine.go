@@ -0,0 +1,86 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import (
+	"fmt"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	log "github.com/rs/zerolog/log"
+)
+
+// _Engine performs the IOs requested by the IOCache.
+type _Engine interface {
+	// start launches the engine's workers.  Workers consume IO ranges via
+	// ioc.popRange(), lowest LSN first, until the queue is closed when the
+	// IOCache's context is cancelled and MUST call ioc.wg.Done() when they
+	// exit.
+	start()
+	fmt.Stringer
+}
+
+// newEngine returns the configured _Engine.  If the configured engine is not
+// available on this system, newEngine falls back to the threads engine.
+func newEngine(ioc *IOCache) _Engine {
+	switch ioc.cfg.Engine {
+	case config.IOEngineThreads:
+		break
+	case config.IOEngineURing:
+		e, err := newURingEngine(ioc)
+		if err == nil {
+			return e
+		}
+
+		log.Warn().Err(err).Str("fallback", config.IOEngineThreads.String()).
+			Msg("io_uring is unavailable")
+	default:
+		panic(fmt.Sprintf("unknown IO engine: %v", ioc.cfg.Engine))
+	}
+
+	return &_ThreadsEngine{ioc: ioc}
+}
+
+// _ThreadsEngine spawns MaxConcurrentIOs goroutines, each of which prefaults
+// one range at a time using the FileHandleCache's prefetch backend.
+type _ThreadsEngine struct {
+	ioc *IOCache
+}
+
+func (e *_ThreadsEngine) start() {
+	ioc := e.ioc
+	for ioWorker := uint(0); ioWorker < ioc.cfg.MaxConcurrentIOs; ioWorker++ {
+		ioc.wg.Add(1)
+		go func(threadID uint) {
+			defer func() {
+				ioc.wg.Done()
+			}()
+
+			for {
+				r, ok := ioc.popRange(true)
+				if !ok {
+					return
+				}
+
+				if err := ioc.fhCache.PrefaultRange(r.start, r.numPages); err != nil {
+					ioc.prefaultFailed(threadID, r, err)
+				}
+			}
+		}(ioWorker)
+	}
+	log.Info().Uint("io-worker-threads", ioc.cfg.MaxConcurrentIOs).Msg("started IO worker threads")
+}
+
+func (e *_ThreadsEngine) String() string {
+	return config.IOEngineThreads.String()
+}
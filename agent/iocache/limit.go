@@ -0,0 +1,85 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iocache
+
+import "sync"
+
+// _QueueLimit bounds the number of requests queued by the IOCache, whether
+// they are waiting to be coalesced or waiting on the _Engine.  A limit of zero
+// is unbounded.
+type _QueueLimit struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	queued int
+	closed bool
+}
+
+func newQueueLimit(limit uint) *_QueueLimit {
+	l := &_QueueLimit{limit: int(limit)}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+// add accounts for n newly queued requests.  When wait is set add blocks
+// until the queue is below its limit, otherwise the limit may be exceeded.
+// ok is false once the limit has been closed.
+func (l *_QueueLimit) add(n int, wait bool) (ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for wait && l.limit > 0 && l.queued >= l.limit && !l.closed {
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return false
+	}
+
+	l.queued += n
+	return true
+}
+
+// full returns true if a call to add() with wait set would block.
+func (l *_QueueLimit) full() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.limit > 0 && l.queued >= l.limit
+}
+
+// done accounts for n requests that have left the queues.
+func (l *_QueueLimit) done(n int) {
+	if n == 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.queued -= n; l.queued < 0 {
+		l.queued = 0
+	}
+	l.cond.Broadcast()
+}
+
+// close wakes all blocked callers of add() and causes all subsequent calls to
+// add() to fail.
+func (l *_QueueLimit) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	l.cond.Broadcast()
+}
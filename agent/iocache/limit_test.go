@@ -0,0 +1,48 @@
+package iocache
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_QueueLimit(t *testing.T) {
+	l := newQueueLimit(2)
+	if !l.add(1, true) || !l.add(1, true) {
+		t.Fatalf("expected room in the queue")
+	}
+	if !l.full() {
+		t.Fatalf("expected a full queue")
+	}
+
+	// Requests that do not wait may exceed the limit.
+	if !l.add(3, false) {
+		t.Fatalf("expected add without wait to succeed")
+	}
+
+	added := make(chan bool)
+	go func() {
+		added <- l.add(1, true)
+	}()
+
+	select {
+	case <-added:
+		t.Fatalf("expected add to block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.done(4)
+	if ok := <-added; !ok {
+		t.Fatalf("expected add to succeed once the queue drained")
+	}
+	if l.queued != 2 {
+		t.Fatalf("expected 2 queued, got %d", l.queued)
+	}
+
+	go func() {
+		added <- l.add(1, true)
+	}()
+	l.close()
+	if ok := <-added; ok {
+		t.Fatalf("expected add to fail once closed")
+	}
+}
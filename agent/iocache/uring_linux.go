@@ -0,0 +1,394 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package iocache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/io_uring.h.
+const (
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEnterGetEvents = 1 << 0
+
+	// IORING_OP_READV is used instead of IORING_OP_READ because it is supported
+	// by every kernel with io_uring (5.1+).
+	uringOpReadv = 1
+
+	uringSQESize = int(unsafe.Sizeof(uringSQE{}))
+	uringCQESize = int(unsafe.Sizeof(uringCQE{}))
+)
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+// uringSQE is struct io_uring_sqe.
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	pad         [2]uint64
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// _URing is a minimal io_uring(7) implementation: just enough to submit reads
+// and reap their completions from a single goroutine.
+type _URing struct {
+	fd     int
+	params uringParams
+
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray *[1 << 28]uint32
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+}
+
+// newURing creates an io_uring with at least entries submission queue
+// entries.  An error is returned if the kernel does not support io_uring
+// (ENOSYS) or io_uring has been disabled (EPERM).
+func newURing(entries uint32) (r *_URing, err error) {
+	r = &_URing{}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "unable to io_uring_setup(2)")
+	}
+	r.fd = int(fd)
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+
+	p := &r.params
+	const prot, flags = unix.PROT_READ | unix.PROT_WRITE, unix.MAP_SHARED | unix.MAP_POPULATE
+	if r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4), prot, flags); err != nil {
+		return nil, errors.Wrap(err, "unable to mmap(2) io_uring submission queue")
+	}
+	if r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes)+int(p.cqEntries)*uringCQESize, prot, flags); err != nil {
+		return nil, errors.Wrap(err, "unable to mmap(2) io_uring completion queue")
+	}
+	if r.sqes, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries)*uringSQESize, prot, flags); err != nil {
+		return nil, errors.Wrap(err, "unable to mmap(2) io_uring submission queue entries")
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = (*[1 << 28]uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array]))
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+
+	return r, nil
+}
+
+// close unmaps the rings and closes the io_uring.  Callers MUST ensure no IOs
+// are in flight.
+func (r *_URing) close() {
+	for _, b := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+// prepareReadv queues a readv into iov using the submission queue entry idx.
+// Each idx MUST have at most one IO outstanding and iov MUST remain valid
+// until the IO's completion has been reaped.  The IO is not submitted to the
+// kernel until enter() is called.
+func (r *_URing) prepareReadv(idx uint32, fd int, iov *unix.Iovec, off int64, userData uint64) {
+	sqe := (*uringSQE)(unsafe.Pointer(&r.sqes[int(idx)*uringSQESize]))
+	*sqe = uringSQE{
+		opcode:   uringOpReadv,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(iov))),
+		len:      1,
+		userData: userData,
+	}
+
+	// This goroutine is the only producer so the tail does not need to be
+	// loaded atomically, however the kernel must observe the SQE before the
+	// new tail.
+	tail := *r.sqTail
+	r.sqArray[tail&r.sqMask] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// enter submits toSubmit prepared IOs and optionally waits for minComplete
+// completions.  enter returns the number of IOs consumed by the kernel.
+func (r *_URing) enter(toSubmit, minComplete uint32) (uint32, error) {
+	var flags uintptr
+	if minComplete > 0 {
+		flags = uringEnterGetEvents
+	}
+
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+		switch errno {
+		case 0:
+			return uint32(n), nil
+		case unix.EINTR:
+			continue
+		default:
+			return 0, errors.Wrap(errno, "unable to io_uring_enter(2)")
+		}
+	}
+}
+
+// reap calls fn for every completion in the completion queue and returns the
+// number of completions reaped.
+func (r *_URing) reap(fn func(userData uint64, res int32)) uint32 {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	var n uint32
+	for ; head != tail; head++ {
+		cqe := (*uringCQE)(unsafe.Pointer(&r.cqRing[int(r.params.cqOff.cqes)+int(head&r.cqMask)*uringCQESize]))
+		fn(cqe.userData, cqe.res)
+		n++
+	}
+	atomic.StoreUint32(r.cqHead, head)
+
+	return n
+}
+
+// _URingEngine reads pages through one or more io_urings.  Each ring is
+// serviced by a single goroutine that keeps up to URingQueueDepth reads in
+// flight.  Pages are read into scratch buffers, so the FileHandleCache's
+// prefetch backend is not used.
+type _URingEngine struct {
+	ioc   *IOCache
+	rings []*_URing
+
+	// fallback starts the threads engine the first time a ring fails.
+	fallback sync.Once
+}
+
+const (
+	// uringMinBackoff and uringMaxBackoff bound how long a ring waits before
+	// resubmitting when the kernel reports EAGAIN or EBUSY and there are no
+	// completions to wait for.
+	uringMinBackoff = time.Millisecond
+	uringMaxBackoff = 100 * time.Millisecond
+)
+
+type _URingSlot struct {
+	r       _IORange
+	release func()
+}
+
+func newURingEngine(ioc *IOCache) (_Engine, error) {
+	e := &_URingEngine{ioc: ioc}
+	for i := uint(0); i < ioc.cfg.URingRings; i++ {
+		r, err := newURing(uint32(ioc.cfg.URingQueueDepth))
+		if err != nil {
+			for _, r := range e.rings {
+				r.close()
+			}
+			return nil, err
+		}
+		e.rings = append(e.rings, r)
+	}
+
+	return e, nil
+}
+
+func (e *_URingEngine) start() {
+	for ringID, r := range e.rings {
+		e.ioc.wg.Add(1)
+		go e.run(uint(ringID), r)
+	}
+	log.Info().Uint("io-uring-rings", uint(len(e.rings))).
+		Uint("io-uring-queue-depth", e.ioc.cfg.URingQueueDepth).
+		Msg("started io_uring IO workers")
+}
+
+func (e *_URingEngine) run(ringID uint, r *_URing) {
+	ioc := e.ioc
+	defer ioc.wg.Done()
+	defer r.close()
+
+	// The buffers and iovecs are referenced by the kernel until an IO's
+	// completion is reaped.  Both are heap allocated and outlive the ring.
+	// Every slot's buffer is large enough for the largest coalesced range.
+	depth := int(ioc.cfg.URingQueueDepth)
+	pageSize := int(pg.HeapPageSize)
+	bufSize := int(ioc.maxSpanPages) * pageSize
+	bufs := make([]byte, depth*bufSize)
+	iovecs := make([]unix.Iovec, depth)
+	slots := make([]_URingSlot, depth)
+	free := make([]uint32, 0, depth)
+	for i := depth - 1; i >= 0; i-- {
+		iovecs[i].Base = &bufs[i*bufSize]
+		free = append(free, uint32(i))
+	}
+
+	complete := func(userData uint64, res int32) {
+		slot := &slots[userData]
+		slot.release()
+		if res < 0 {
+			ioc.prefaultFailed(ringID, slot.r, errors.Wrap(unix.Errno(-res), "unable to read page via io_uring"))
+		}
+		*slot = _URingSlot{}
+		free = append(free, uint32(userData))
+	}
+
+	var inflight, pending uint32
+	var shuttingDown bool
+	backoff := uringMinBackoff
+	for {
+		// Queue as many IOs as there are free slots.  Only block waiting for new
+		// IOs when nothing is in flight.
+	QUEUE:
+		for len(free) > 0 && !shuttingDown {
+			ioRange, ok := ioc.popRange(inflight+pending == 0)
+			if !ok {
+				select {
+				case <-ioc.ctx.Done():
+					shuttingDown = true
+				default:
+				}
+				break QUEUE
+			}
+
+			f, off, release, err := ioc.fhCache.AcquirePage(ioRange.start)
+			if err != nil {
+				ioc.prefaultFailed(ringID, ioRange, err)
+				continue
+			}
+
+			idx := free[len(free)-1]
+			free = free[:len(free)-1]
+			slots[idx] = _URingSlot{r: ioRange, release: release}
+			iovecs[idx].SetLen(int(ioRange.numPages) * pageSize)
+			r.prepareReadv(idx, int(f.Fd()), &iovecs[idx], off, uint64(idx))
+			pending++
+		}
+
+		if inflight+pending == 0 {
+			if shuttingDown {
+				return
+			}
+			continue
+		}
+
+		// Wait for a completion unless new IOs were queued and there is room to
+		// queue more.
+		var minComplete uint32
+		if pending == 0 || len(free) == 0 || shuttingDown {
+			minComplete = 1
+		}
+
+		submitted, err := r.enter(pending, minComplete)
+		switch errors.Cause(err) {
+		case nil:
+			backoff = uringMinBackoff
+		case unix.EAGAIN, unix.EBUSY:
+			// The kernel is temporarily out of resources.  Wait for a completion to
+			// free some up if any IOs are in flight, otherwise back off before
+			// resubmitting.
+			submitted, err = 0, nil
+			if inflight > 0 {
+				_, err = r.enter(0, 1)
+				switch errors.Cause(err) {
+				case unix.EAGAIN, unix.EBUSY:
+					err = nil
+				}
+			} else {
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > uringMaxBackoff {
+					backoff = uringMaxBackoff
+				}
+			}
+		}
+		if err != nil {
+			// Any other error (e.g. EBADF, EFAULT) means the ring itself is unusable
+			// and no IOs will complete.  Release every outstanding page so the
+			// FileHandleCache can close its files and hand the queue over to the
+			// threads engine.
+			log.Error().Err(err).Uint("io-uring-id", ringID).Msg("io_uring failed, stopping ring")
+			for i := range slots {
+				if slots[i].release != nil {
+					slots[i].release()
+					ioc.prefaultFailed(ringID, slots[i].r, err)
+				}
+			}
+			e.fallback.Do(func() {
+				log.Warn().Str("fallback", config.IOEngineThreads.String()).
+					Msg("io_uring failed")
+				(&_ThreadsEngine{ioc: ioc}).start()
+			})
+			return
+		}
+		inflight += submitted
+		pending -= submitted
+
+		inflight -= r.reap(complete)
+	}
+}
+
+func (e *_URingEngine) String() string {
+	return config.IOEngineURing.String()
+}
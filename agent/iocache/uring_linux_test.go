@@ -0,0 +1,77 @@
+// +build linux
+
+package iocache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	"golang.org/x/sys/unix"
+)
+
+func Test_URing(t *testing.T) {
+	r, err := newURing(4)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer r.close()
+
+	f, err := ioutil.TempFile("", "uring")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	const pageSize = 8192
+	data := make([]byte, 3*pageSize)
+	for i := range data {
+		data[i] = byte(i / pageSize)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Read pages 2 and 1, then a page past the end of the file.
+	offsets := []int64{2 * pageSize, 1 * pageSize, 5 * pageSize}
+	bufs := make([][]byte, len(offsets))
+	iovecs := make([]unix.Iovec, len(offsets))
+	for i, off := range offsets {
+		bufs[i] = make([]byte, pageSize)
+		iovecs[i].Base = &bufs[i][0]
+		iovecs[i].SetLen(pageSize)
+		r.prepareReadv(uint32(i), int(f.Fd()), &iovecs[i], off, uint64(100+i))
+	}
+
+	submitted, err := r.enter(uint32(len(offsets)), uint32(len(offsets)))
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if diff := pretty.Compare(submitted, uint32(len(offsets))); diff != "" {
+		t.Fatalf("submitted diff: (-got +want)\n%s", diff)
+	}
+
+	results := make(map[uint64]int32)
+	var reaped uint32
+	for reaped < submitted {
+		reaped += r.reap(func(userData uint64, res int32) {
+			results[userData] = res
+		})
+		if reaped < submitted {
+			if _, err := r.enter(0, 1); err != nil {
+				t.Fatalf("bad: %v", err)
+			}
+		}
+	}
+
+	want := map[uint64]int32{100: pageSize, 101: pageSize, 102: 0}
+	if diff := pretty.Compare(results, want); diff != "" {
+		t.Fatalf("completions diff: (-got +want)\n%s", diff)
+	}
+
+	if bufs[0][0] != 2 || bufs[1][0] != 1 {
+		t.Fatalf("bad page contents: %d %d", bufs[0][0], bufs[1][0])
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+)
+
+// checkReplayLag queries a follower's replay lag and returns false when
+// prefaulting has been switched off because the follower has caught up.
+// Primaries are handled by predictDBWALFilenames().
+func (a *Agent) checkReplayLag() (prefault bool, err error) {
+	if !a.lagGate.enabled() {
+		return true, nil
+	}
+
+	dbState, err := a.dbState()
+	if err != nil {
+		return true, errors.Wrap(err, "unable to determine if database is primary or not")
+	}
+	if dbState != _DBStateFollower {
+		return true, nil
+	}
+
+	lag, err := a.queryLag(_QueryLagFollower)
+	if err != nil {
+		return true, errors.Wrap(err, "unable to query follower lag")
+	}
+
+	prefault, reason := a.lagGate.update(lag)
+	if reason != "" {
+		log.Info().
+			Bool("prefault", prefault).
+			Str("reason", reason).
+			Str("lag-bytes", lag.bytes.String()).
+			Dur("lag-time", lag.time).
+			Msg("replay lag crossed a threshold")
+	}
+
+	return prefault, nil
+}
+
+// _LagGate switches prefaulting on and off based on a follower's replay lag.
+// Separate start and stop thresholds provide hysteresis so that prefaulting
+// doesn't flap when the lag hovers around a single threshold.
+type _LagGate struct {
+	cfg    *config.Agent
+	active bool
+}
+
+func newLagGate(cfg *config.Agent) *_LagGate {
+	// Prefault until the first lag measurement shows the follower has caught
+	// up.
+	return &_LagGate{cfg: cfg, active: true}
+}
+
+// enabled returns true if at least one start threshold is configured.
+func (g *_LagGate) enabled() bool {
+	return g.cfg.LagStartBytes > 0 || g.cfg.LagStartTime > 0
+}
+
+// update evaluates lag against the thresholds.  active reports whether
+// prefaulting should run.  When the state changes, reason describes the
+// threshold that was crossed, otherwise reason is empty.
+func (g *_LagGate) update(lag _ReplayLag) (active bool, reason string) {
+	if !g.enabled() {
+		return true, ""
+	}
+
+	cfg := g.cfg
+	if !g.active {
+		switch {
+		case cfg.LagStartBytes > 0 && lag.bytes >= cfg.LagStartBytes:
+			reason = fmt.Sprintf("lag of %s reached the start threshold of %s", lag.bytes, cfg.LagStartBytes)
+		case cfg.LagStartTime > 0 && lag.time >= cfg.LagStartTime:
+			reason = fmt.Sprintf("lag of %s reached the start threshold of %s", lag.time, cfg.LagStartTime)
+		default:
+			return false, ""
+		}
+
+		g.active = true
+		return true, reason
+	}
+
+	// Only stop once every measure of lag in use is at or below its stop
+	// threshold.
+	if cfg.LagStartBytes > 0 && lag.bytes > cfg.LagStopBytes {
+		return true, ""
+	}
+	if cfg.LagStartTime > 0 && lag.time > cfg.LagStopTime {
+		return true, ""
+	}
+
+	switch {
+	case cfg.LagStartBytes > 0 && cfg.LagStartTime > 0:
+		reason = fmt.Sprintf("lag of %s and %s at or below the stop thresholds of %s and %s", lag.bytes, lag.time, cfg.LagStopBytes, cfg.LagStopTime)
+	case cfg.LagStartBytes > 0:
+		reason = fmt.Sprintf("lag of %s at or below the stop threshold of %s", lag.bytes, cfg.LagStopBytes)
+	default:
+		reason = fmt.Sprintf("lag of %s at or below the stop threshold of %s", lag.time, cfg.LagStopTime)
+	}
+
+	g.active = false
+	return false, reason
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_LagGate(t *testing.T) {
+	type _Step struct {
+		lag     _ReplayLag
+		active  bool
+		changed bool
+	}
+
+	tests := []struct {
+		cfg   config.Agent
+		steps []_Step
+	}{
+		{ // 0: disabled, always prefault
+			steps: []_Step{
+				{lag: _ReplayLag{}, active: true},
+			},
+		},
+		{ // 1: bytes hysteresis
+			cfg: config.Agent{LagStartBytes: 16 * units.MiB, LagStopBytes: 1 * units.MiB},
+			steps: []_Step{
+				{lag: _ReplayLag{bytes: 4 * units.MiB}, active: true},
+				{lag: _ReplayLag{bytes: 512 * units.KiB}, active: false, changed: true},
+				{lag: _ReplayLag{bytes: 8 * units.MiB}, active: false},
+				{lag: _ReplayLag{bytes: 16 * units.MiB}, active: true, changed: true},
+				{lag: _ReplayLag{bytes: 2 * units.MiB}, active: true},
+				{lag: _ReplayLag{bytes: 1 * units.MiB}, active: false, changed: true},
+			},
+		},
+		{ // 2: either measure starts prefaulting, both must fall to stop it
+			cfg: config.Agent{
+				LagStartBytes: 16 * units.MiB, LagStopBytes: 0,
+				LagStartTime: 10 * time.Second, LagStopTime: time.Second,
+			},
+			steps: []_Step{
+				{lag: _ReplayLag{bytes: 0, time: 5 * time.Second}, active: true},
+				{lag: _ReplayLag{bytes: 0, time: 0}, active: false, changed: true},
+				{lag: _ReplayLag{bytes: 0, time: 30 * time.Second}, active: true, changed: true},
+				{lag: _ReplayLag{bytes: 4 * units.MiB, time: 0}, active: true},
+				{lag: _ReplayLag{bytes: 0, time: 0}, active: false, changed: true},
+			},
+		},
+	}
+
+	for n, test := range tests {
+		g := newLagGate(&test.cfg)
+		for i, step := range test.steps {
+			active, reason := g.update(step.lag)
+			got := _Step{lag: step.lag, active: active, changed: reason != ""}
+			if diff := pretty.Compare(got, step); diff != "" {
+				t.Fatalf("%d.%d: step diff: (-got +want)\n%s", n, i, diff)
+			}
+		}
+	}
+}
@@ -24,19 +24,15 @@ import (
 // processes that decend from PostgreSQL to parse out the current WAL file
 // contained in the args.
 func (a *Agent) getWALFilesProcArgs() (walFiles pg.WALFiles, err error) {
-	parentPid, err := a.findPostgreSQLPostmasterPID()
+	walFile, err := a.findProcArgsWALFile()
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to find the PostgreSQL pid")
+		return nil, err
 	}
 
-	childPIDs, err := proc.FindChildPIDs(a.shutdownCtx, parentPid)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to find any PostgreSQL child processes")
-	}
-
-	walFile, err := proc.FindWALFileFromPIDArgs(a.shutdownCtx, childPIDs)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to find a WAL file from pids")
+	// The startup process is somewhere inside of walFile, so every record
+	// before the start of the segment has been replayed.
+	if _, walLSN, err := pg.ParseWalfile(walFile); err == nil {
+		a.setReplayLSN(walLSN)
 	}
 
 	walFiles, err = a.predictProcWALFilenames(walFile)
@@ -48,6 +44,27 @@ func (a *Agent) getWALFilesProcArgs() (walFiles pg.WALFiles, err error) {
 	return walFiles, nil
 }
 
+// findProcArgsWALFile returns the WAL file currently being recovered according
+// to the args of PostgreSQL's child processes.
+func (a *Agent) findProcArgsWALFile() (pg.WALFilename, error) {
+	parentPid, err := a.findPostgreSQLPostmasterPID()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find the PostgreSQL pid")
+	}
+
+	childPIDs, err := proc.FindChildPIDs(a.shutdownCtx, parentPid)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find any PostgreSQL child processes")
+	}
+
+	walFile, err := proc.FindWALFileFromPIDArgs(a.shutdownCtx, childPIDs)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find a WAL file from pids")
+	}
+
+	return walFile, nil
+}
+
 // predictProcWALFilenames guesses what the filenames are going to be in advance
 // of PostgreSQL naively processing a WAL file.  Use walFile as the seed
 // filename to indicate where we are in the WAL stream and forecast N WAL
@@ -63,9 +80,9 @@ func (a *Agent) predictProcWALFilenames(walFile pg.WALFilename) (pg.WALFiles, er
 		return nil, errors.Wrap(err, "unable to parse the WAL filename")
 	}
 
-	// Clamp the number of bytes we'll readahead in order to prevent reading into
-	// the future.
-	maxBytes := a.walCache.ReadaheadBytes()
+	// The lag is unknown without a database connection, so only the replay rate
+	// sizes the readahead.
+	maxBytes := a.readaheadBytes(unknownLagBytes)
 
-	return walLSN.Readahead(timelineID, maxBytes), nil
+	return a.readaheadWALFiles(timelineID, walLSN, maxBytes), nil
 }
@@ -0,0 +1,116 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+const (
+	// replayRateWeight is the weight given to the most recent sample when
+	// smoothing the replay rate.
+	replayRateWeight = 0.3
+
+	// unknownLagBytes is used when the receive-vs-replay lag is not known (e.g.
+	// when there is no connection to the database).
+	unknownLagBytes = units.Base2Bytes(math.MaxInt64)
+)
+
+// _ReadaheadController sizes the WAL readahead window so that prefaulting
+// stays leadTime ahead of replay.  The replay rate is measured from the
+// change in the replay LSN between polls.  The window widens as replay speeds
+// up and narrows as it slows down, but never exceeds maxBytes or drops below a
+// single WAL segment.
+type _ReadaheadController struct {
+	leadTime time.Duration
+	maxBytes units.Base2Bytes
+
+	lock       sync.Mutex
+	lastLSN    pg.LSN
+	lastSample time.Time
+	rate       float64 // bytes per second
+	haveRate   bool
+}
+
+func newReadaheadController(leadTime time.Duration, maxBytes units.Base2Bytes) *_ReadaheadController {
+	return &_ReadaheadController{
+		leadTime: leadTime,
+		maxBytes: maxBytes,
+	}
+}
+
+// observe records that replay had reached lsn at now.  An LSN behind the
+// previous sample (i.e. a timeline switch) restarts the measurement.
+func (c *_ReadaheadController) observe(lsn pg.LSN, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.lastSample.IsZero() || lsn < c.lastLSN {
+		c.lastLSN, c.lastSample = lsn, now
+		c.haveRate = false
+		return
+	}
+
+	elapsed := now.Sub(c.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	sample := float64(lsn-c.lastLSN) / elapsed
+	if c.haveRate {
+		c.rate = replayRateWeight*sample + (1-replayRateWeight)*c.rate
+	} else {
+		c.rate, c.haveRate = sample, true
+	}
+	c.lastLSN, c.lastSample = lsn, now
+}
+
+// window returns the number of bytes to read ahead of replay.  lagBytes is the
+// amount of WAL received but not yet replayed: reading further ahead than the
+// lag reads into the future.
+func (c *_ReadaheadController) window(lagBytes units.Base2Bytes) units.Base2Bytes {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	window := c.maxBytes
+	if c.leadTime > 0 && c.haveRate {
+		window = units.Base2Bytes(c.rate * c.leadTime.Seconds())
+		if window < pg.WALSegmentSize {
+			window = pg.WALSegmentSize
+		}
+		if window > c.maxBytes {
+			window = c.maxBytes
+		}
+	}
+
+	if window > lagBytes {
+		window = lagBytes
+	}
+
+	return window
+}
+
+// replayRate returns the smoothed replay rate in bytes per second.  ok is false
+// until two samples have been observed.
+func (c *_ReadaheadController) replayRate() (rate float64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.rate, c.haveRate
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func Test_ReadaheadController(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	lsn := pg.MustParseLSN("1/0")
+
+	c := newReadaheadController(5*time.Second, 256*units.MiB)
+
+	tests := []struct {
+		advance units.Base2Bytes
+		lag     units.Base2Bytes
+		want    units.Base2Bytes
+	}{
+		{ // 0: no rate yet, read ahead the max
+			lag:  unknownLagBytes,
+			want: 256 * units.MiB,
+		},
+		{ // 1: 10MiB/s * 5s
+			advance: 10 * units.MiB,
+			lag:     unknownLagBytes,
+			want:    50 * units.MiB,
+		},
+		{ // 2: replay slows down, 0.7*10MiB/s * 5s
+			lag:  unknownLagBytes,
+			want: 35 * units.MiB,
+		},
+		{ // 3: never read ahead further than what has been received
+			advance: 10 * units.MiB,
+			lag:     20 * units.MiB,
+			want:    20 * units.MiB,
+		},
+		{ // 4: replay speeds up, capped at the max
+			advance: 1 * units.GiB,
+			lag:     unknownLagBytes,
+			want:    256 * units.MiB,
+		},
+	}
+
+	for n, test := range tests {
+		lsn = lsn.AddBytes(test.advance)
+		c.observe(lsn, start.Add(time.Duration(n)*time.Second))
+
+		if diff := pretty.Compare(c.window(test.lag), test.want); diff != "" {
+			t.Fatalf("%d: window diff: (-got +want)\n%s", n, diff)
+		}
+	}
+
+	// Replay stalled: the window shrinks to a single WAL segment but no further.
+	for i := 0; i < 50; i++ {
+		c.observe(lsn, start.Add(time.Duration(len(tests)+i)*time.Second))
+	}
+	if diff := pretty.Compare(c.window(unknownLagBytes), pg.WALSegmentSize); diff != "" {
+		t.Fatalf("stalled window diff: (-got +want)\n%s", diff)
+	}
+
+	// A timeline switch restarts the measurement.
+	c.observe(pg.MustParseLSN("0/1000000"), start.Add(time.Hour))
+	if diff := pretty.Compare(c.window(unknownLagBytes), 256*units.MiB); diff != "" {
+		t.Fatalf("reset window diff: (-got +want)\n%s", diff)
+	}
+
+	// A zero lead time disables the controller.
+	c = newReadaheadController(0, 32*units.MiB)
+	c.observe(lsn, start)
+	c.observe(lsn, start.Add(time.Second))
+	if diff := pretty.Compare(c.window(unknownLagBytes), 32*units.MiB); diff != "" {
+		t.Fatalf("disabled window diff: (-got +want)\n%s", diff)
+	}
+}
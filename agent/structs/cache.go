@@ -13,16 +13,177 @@
 
 package structs
 
-import "github.com/bschofield/pg_prefaulter/pg"
+import (
+	"sync"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
 
 // IOCacheKey contains the forward lookup information for a given relation file.
 // IOCacheKey is a
 // [comparable](https://golang.org/ref/spec#Comparison_operators) struct
 // suitable for use as a lookup key.  These values are immutable and map 1:1
 // with the string inputs read from the pg_waldump(1) scanning utility.
+//
+// If SLRU is not pg.NoSLRU the key references page Block of the given SLRU
+// (e.g. pg_xact) and Tablespace, Database, Relation and Fork are zero.
 type IOCacheKey struct {
 	Tablespace pg.OID
 	Database   pg.OID
 	Relation   pg.OID
+	Fork       pg.ForkNumber
 	Block      pg.HeapBlockNumber
+	SLRU       pg.SLRU
+}
+
+// NewSLRUKey returns the IOCacheKey of an SLRU page.
+func NewSLRUKey(page pg.SLRUPage) IOCacheKey {
+	return IOCacheKey{
+		SLRU:  page.SLRU,
+		Block: pg.HeapBlockNumber(page.Page),
+	}
+}
+
+// SegmentNumber returns the number of the relation or SLRU segment containing
+// the referenced page.
+func (k IOCacheKey) SegmentNumber() pg.HeapSegmentNumber {
+	if k.SLRU != pg.NoSLRU {
+		return pg.HeapSegmentNumber(uint64(k.Block) / pg.SLRUPagesPerSegment)
+	}
+
+	return k.Block.SegmentNumber()
+}
+
+// SegmentPageNum returns the page number of the referenced page inside of its
+// segment.
+func (k IOCacheKey) SegmentPageNum() pg.HeapPageNumber {
+	if k.SLRU != pg.NoSLRU {
+		return pg.HeapPageNumber(uint64(k.Block) % pg.SLRUPagesPerSegment)
+	}
+
+	return pg.HeapSegmentPageNum(k.Block)
+}
+
+// IOCacheExtent is a run of NumPages heap pages of a single relation segment,
+// starting with the page referenced by Start.
+type IOCacheExtent struct {
+	Start    IOCacheKey
+	NumPages uint32
+}
+
+// RelationForkKey identifies a single fork of a relation.
+type RelationForkKey struct {
+	pg.RelFileNode
+	Fork pg.ForkNumber
+}
+
+// Invalidations maps relation forks to the first block of the fork that is no
+// longer valid.  Invalidations are built from the pg.RelationEvents found in
+// WAL and are used to forget cached state about relations that have been
+// created, truncated or dropped.
+type Invalidations map[RelationForkKey]pg.HeapBlockNumber
+
+// NewInvalidations returns the Invalidations for events.
+func NewInvalidations(events []pg.RelationEvent) Invalidations {
+	inv := make(Invalidations, len(events))
+	for _, ev := range events {
+		key := RelationForkKey{RelFileNode: ev.RelFileNode, Fork: ev.Fork}
+		if block, found := inv[key]; !found || ev.Block < block {
+			inv[key] = ev.Block
+		}
+	}
+
+	return inv
+}
+
+// Invalid returns true if the block referenced by ioCacheKey is invalid.  SLRU
+// pages are never invalid.
+func (inv Invalidations) Invalid(ioCacheKey IOCacheKey) bool {
+	if ioCacheKey.SLRU != pg.NoSLRU {
+		return false
+	}
+
+	block, found := inv[ioCacheKey.RelationForkKey()]
+
+	return found && ioCacheKey.Block >= block
+}
+
+// RelationForkKey returns the relation fork of the page referenced by k.
+func (k IOCacheKey) RelationForkKey() RelationForkKey {
+	return RelationForkKey{
+		RelFileNode: pg.RelFileNode{
+			Tablespace: k.Tablespace,
+			Database:   k.Database,
+			Relation:   k.Relation,
+		},
+		Fork: k.Fork,
+	}
+}
+
+// RelationKeyIndex indexes the keys of a cache by relation fork so that the
+// entries of invalidated relations can be found without visiting every entry
+// of the cache.  The index is maintained from the cache's added and evicted
+// callbacks.  RelationKeyIndex is safe for concurrent use.
+type RelationKeyIndex struct {
+	lock sync.Mutex
+	keys map[RelationForkKey]map[interface{}]struct{}
+}
+
+// NewRelationKeyIndex returns an empty RelationKeyIndex.
+func NewRelationKeyIndex() *RelationKeyIndex {
+	return &RelationKeyIndex{
+		keys: make(map[RelationForkKey]map[interface{}]struct{}),
+	}
+}
+
+// Add records that key belongs to fork.
+func (idx *RelationKeyIndex) Add(fork RelationForkKey, key interface{}) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	keys, found := idx.keys[fork]
+	if !found {
+		keys = make(map[interface{}]struct{})
+		idx.keys[fork] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// Remove forgets key.
+func (idx *RelationKeyIndex) Remove(fork RelationForkKey, key interface{}) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	keys, found := idx.keys[fork]
+	if !found {
+		return
+	}
+
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(idx.keys, fork)
+	}
+}
+
+// Keys returns the keys belonging to the relation forks of inv.
+func (idx *RelationKeyIndex) Keys(inv Invalidations) []interface{} {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	var keys []interface{}
+	for fork := range inv {
+		for key := range idx.keys[fork] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Purge forgets every key.
+func (idx *RelationKeyIndex) Purge() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.keys = make(map[RelationForkKey]map[interface{}]struct{})
 }
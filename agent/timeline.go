@@ -0,0 +1,134 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"path"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	log "github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// walDir returns the path of the WAL directory, or an empty string if the
+// version of PostgreSQL is not known yet.
+func (a *Agent) walDir() string {
+	if a.walTranslations.Directory == "" {
+		return ""
+	}
+
+	return path.Join(viper.GetString(config.KeyPGData), a.walTranslations.Directory)
+}
+
+// setTimelineID records timelineID as the timeline being replayed.  If the
+// timeline changed, the walCache is purged assuming we're going to need to
+// prefault in new heap data.  Switching to a timeline that descends from the
+// previous one (i.e. following a promoted primary) continues the same WAL
+// stream and keeps the caches.
+func (a *Agent) setTimelineID(timelineID pg.TimelineID) {
+	a.pgStateLock.Lock()
+	if a.lastTimelineID == timelineID {
+		a.pgStateLock.Unlock()
+		return
+	}
+
+	var purge bool
+	switch {
+	case a.lastTimelineID == 0:
+		a.lastReplayLSN = 0
+	case a.descendsFrom(timelineID, a.lastTimelineID):
+		log.Info().
+			Uint32("old-timeline-id", uint32(a.lastTimelineID)).
+			Uint32("timeline-id", uint32(timelineID)).
+			Msg("followed timeline switch")
+	default:
+		purge = true
+		a.lastReplayLSN = 0
+	}
+	a.lastTimelineID = timelineID
+	a.pgStateLock.Unlock()
+
+	// Purging stops the pg_waldump(1) stream, which may be waiting for room in
+	// the IOCache's queue.  pgStateLock is released first so that readers of the
+	// replay state aren't stalled behind it.
+	if purge {
+		a.walCache.Purge()
+	}
+}
+
+// descendsFrom returns true if the history of timelineID contains ancestorID.
+func (a *Agent) descendsFrom(timelineID, ancestorID pg.TimelineID) bool {
+	walDir := a.walDir()
+	if walDir == "" || timelineID <= ancestorID {
+		return false
+	}
+
+	history, err := pg.ReadTimelineHistory(walDir, timelineID)
+	if err != nil {
+		log.Debug().Err(err).Uint32("timeline-id", uint32(timelineID)).Msg("unable to read timeline history")
+		return false
+	}
+
+	return history.Contains(ancestorID)
+}
+
+// readaheadWALFiles returns the names of the WAL files within maxBytes of lsn.
+// When a newer timeline that descends from timelineID has been received, the
+// readahead crosses its switch points and names each segment with the
+// timeline PostgreSQL will read it from.
+func (a *Agent) readaheadWALFiles(timelineID pg.TimelineID, lsn pg.LSN, maxBytes units.Base2Bytes) pg.WALFiles {
+	return a.timelineHistory(timelineID).Readahead(lsn, maxBytes)
+}
+
+// timelineHistory returns the history of the newest timeline in the WAL
+// directory if it descends from timelineID, otherwise a history containing
+// only timelineID.
+func (a *Agent) timelineHistory(timelineID pg.TimelineID) pg.TimelineHistory {
+	single := pg.SingleTimelineHistory(timelineID)
+
+	walDir := a.walDir()
+	if walDir == "" {
+		return single
+	}
+
+	latest, err := pg.LatestTimeline(walDir)
+	if err != nil {
+		log.Debug().Err(err).Msg("unable to find the latest timeline")
+		return single
+	}
+
+	if latest <= timelineID {
+		return single
+	}
+
+	// History files never change once written, so only read the history again
+	// once a newer timeline appears.
+	if n := len(a.history); n == 0 || a.history[n-1].Timeline != latest {
+		history, err := pg.ReadTimelineHistory(walDir, latest)
+		if err != nil {
+			log.Debug().Err(err).Uint32("timeline-id", uint32(latest)).Msg("unable to read timeline history")
+			return single
+		}
+
+		a.history = history
+	}
+
+	if !a.history.Contains(timelineID) {
+		return single
+	}
+
+	return a.history
+}
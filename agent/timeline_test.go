@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/viper"
+)
+
+func Test_timelineHistory(t *testing.T) {
+	pgdata, err := ioutil.TempDir("", "pgdata")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(pgdata)
+
+	walDir := path.Join(pgdata, "pg_wal")
+	if err := os.Mkdir(walDir, 0700); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	viper.Set(config.KeyPGData, pgdata)
+	defer viper.Set(config.KeyPGData, nil)
+
+	a := &Agent{walTranslations: &pg.WALTranslations{Directory: "pg_wal"}}
+
+	_, lsn, err := pg.ParseWalfile("000000010000000000000002")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Without a newer timeline the readahead stays on the current timeline
+	want := pg.WALFiles{"000000010000000000000002", "000000010000000000000003"}
+	if diff := pretty.Compare(a.readaheadWALFiles(1, lsn, 2*pg.WALSegmentSize), want); diff != "" {
+		t.Fatalf("readahead diff: (-got +want)\n%s", diff)
+	}
+
+	// Timeline 2 was promoted from timeline 1 at 0/3000000
+	history := "1\t0/3000000\tno recovery target specified\n"
+	if err := ioutil.WriteFile(path.Join(walDir, "00000002.history"), []byte(history), 0600); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	want = pg.WALFiles{"000000010000000000000002", "000000020000000000000003"}
+	if diff := pretty.Compare(a.readaheadWALFiles(1, lsn, 2*pg.WALSegmentSize), want); diff != "" {
+		t.Fatalf("readahead across switch diff: (-got +want)\n%s", diff)
+	}
+
+	if !a.descendsFrom(2, 1) || a.descendsFrom(1, 2) {
+		t.Fatalf("bad descendsFrom()")
+	}
+
+	// Timeline 3 is a sibling of timeline 2 and is not followed from timeline 2
+	if err := ioutil.WriteFile(path.Join(walDir, "00000003.history"), []byte("1\t0/2800000\tbranch\n"), 0600); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	want = pg.WALFiles{"000000020000000000000003", "000000020000000000000004"}
+	_, lsn, _ = pg.ParseWalfile("000000020000000000000003")
+	if diff := pretty.Compare(a.readaheadWALFiles(2, lsn, 2*pg.WALSegmentSize), want); diff != "" {
+		t.Fatalf("readahead with a sibling timeline diff: (-got +want)\n%s", diff)
+	}
+
+	if a.descendsFrom(3, 2) {
+		t.Fatalf("timeline 3 does not descend from timeline 2")
+	}
+}
+
+func Test_crossesTimelineSwitch(t *testing.T) {
+	tests := []struct {
+		walFiles pg.WALFiles
+		want     bool
+	}{
+		{walFiles: pg.WALFiles{}},
+		{walFiles: pg.WALFiles{"000000020000000000000005"}},
+		{walFiles: pg.WALFiles{"000000020000000000000005", "000000020000000000000006"}},
+		{walFiles: pg.WALFiles{"000000010000000000000005", "000000020000000000000006"}, want: true},
+	}
+
+	for _, test := range tests {
+		if got := crossesTimelineSwitch(test.walFiles); got != test.want {
+			t.Errorf("%v: expected %t, got %t", test.walFiles, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+)
+
+// recoveryXLogFilename is the name of the file in the WAL directory that the
+// startup process restores segments from the archive into during archive
+// recovery (see PostgreSQL's RestoreArchivedFile()).
+const recoveryXLogFilename = "RECOVERYXLOG"
+
+// _WALSource is the location of a WAL segment.
+type _WALSource struct {
+	// path is the file holding the segment.  It is not necessarily named after
+	// the segment (see WALCache.walDumpFile()).
+	path string
+
+	// gzipped is set if path is gzip(1)ed.
+	gzipped bool
+
+	// archived is set if the segment was found outside of the WAL directory.
+	// Archived segments are always complete.
+	archived bool
+
+	// transient is set if path is overwritten once the segment has been
+	// replayed (i.e. RECOVERYXLOG).
+	transient bool
+}
+
+// open returns the decompressed contents of the segment.  The reader is an
+// *os.File unless the segment is gzipped.
+func (src *_WALSource) open() (io.ReadCloser, error) {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open %+q", src.path)
+	}
+
+	if !src.gzipped {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "unable to decompress %+q", src.path)
+	}
+
+	return &_GzipFile{Reader: gz, f: f}, nil
+}
+
+// _GzipFile is a gzip.Reader that closes its underlying file.
+type _GzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (gz *_GzipFile) Close() error {
+	gz.Reader.Close()
+	return gz.f.Close()
+}
+
+// locateWALFile finds walFile in the WAL directory or, during archive
+// recovery, in RECOVERYXLOG or the archive directory.
+func (wc *WALCache) locateWALFile(walFile pg.WALFilename) (*_WALSource, error) {
+	walDir := path.Join(wc.cfg.PGDataPath, wc.walTranslations.Directory)
+	walFileAbs := path.Join(walDir, string(walFile))
+	switch _, err := os.Stat(walFileAbs); {
+	case err == nil:
+		return &_WALSource{path: walFileAbs}, nil
+	case !os.IsNotExist(err):
+		return nil, errors.Wrapf(err, "unable to stat %+q", walFileAbs)
+	}
+
+	// The segment being replayed during archive recovery
+	recoveryXLog := path.Join(walDir, recoveryXLogFilename)
+	if isWALSegment(recoveryXLog, walFile) {
+		return &_WALSource{path: recoveryXLog, archived: true, transient: true}, nil
+	}
+
+	if wc.cfg.ArchiveDir != "" {
+		for _, candidate := range archiveCandidates(wc.cfg.ArchiveDir, walFile) {
+			gzipped, ok := archiveFormat(candidate)
+			if !ok {
+				log.Debug().Str("filename", candidate).Msg("unsupported WAL compression")
+				continue
+			}
+
+			return &_WALSource{path: candidate, gzipped: gzipped, archived: true}, nil
+		}
+	}
+
+	return nil, errors.Wrapf(os.ErrNotExist, "unable to find %+q", walFile)
+}
+
+// archiveCandidates returns the files in archiveDir that hold walFile, in
+// order of preference.  Segments are either stored under their own name
+// (optionally gzip(1)ed, e.g. a WAL-G or archive_command spool) or with a
+// checksum suffix in a directory named after the first 16 characters of the
+// segment's name (i.e. a pgBackRest repository).
+func archiveCandidates(archiveDir string, walFile pg.WALFilename) []string {
+	var candidates []string
+	for _, name := range []string{string(walFile), string(walFile) + ".gz"} {
+		candidate := path.Join(archiveDir, name)
+		if fi, err := os.Stat(candidate); err == nil && fi.Mode().IsRegular() {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	for _, dir := range []string{archiveDir, path.Join(archiveDir, string(walFile)[:16])} {
+		matches, err := filepath.Glob(path.Join(dir, string(walFile)+"-*"))
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, matches...)
+	}
+
+	return candidates
+}
+
+// archiveFormat returns true if candidate, as returned by archiveCandidates(),
+// is gzip(1)ed.  Segment names and checksums contain no dots, so any other
+// extension is a compression format that can't be decoded (e.g. pgBackRest's
+// .lz4, .zst or .bz2) and ok is false.
+func archiveFormat(candidate string) (gzipped, ok bool) {
+	switch filepath.Ext(candidate) {
+	case "":
+		return false, true
+	case ".gz":
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// isWALSegment returns true if filename holds the segment walFile.
+func isWALSegment(filename string, walFile pg.WALFilename) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	addr, err := pg.ReadWALSegmentAddress(f)
+	if err != nil {
+		log.Debug().Err(err).Str("filename", filename).Msg("unable to identify WAL segment")
+		return false
+	}
+
+	_, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return false
+	}
+
+	return addr == lsn-1
+}
+
+// walDumpFile returns a file named after walFile holding the segment in src.
+// pg_waldump(1) derives the segment's LSN from the filename, so segments that
+// are compressed or stored under another name are linked, copied or
+// decompressed into a spool directory.  Each segment is spooled once and kept
+// until it has been replayed (see pruneSpool()).
+func (wc *WALCache) walDumpFile(walFile pg.WALFilename, src *_WALSource) (string, error) {
+	if !src.gzipped && path.Base(src.path) == string(walFile) {
+		return src.path, nil
+	}
+
+	spoolDir, err := wc.spoolDir()
+	if err != nil {
+		return "", err
+	}
+
+	spooled := path.Join(spoolDir, string(walFile))
+	if _, err := os.Lstat(spooled); err == nil {
+		return spooled, nil
+	}
+
+	// Archived files are immutable and are linked to.  Spooled files are
+	// written under a temporary name and renamed into place so that a partial
+	// copy is never mistaken for the segment.
+	if !src.gzipped && !src.transient {
+		if err := os.Symlink(src.path, spooled); err != nil && !os.IsExist(err) {
+			return "", errors.Wrapf(err, "unable to link %+q", src.path)
+		}
+		return spooled, nil
+	}
+
+	r, err := src.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(spoolDir, string(walFile)+".")
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create a spool file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", errors.Wrapf(err, "unable to copy %+q", src.path)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", errors.Wrapf(err, "unable to copy %+q", src.path)
+	}
+
+	// RECOVERYXLOG may have been replaced by the next segment while copying.
+	if src.transient && !isWALSegment(tmp.Name(), walFile) {
+		return "", errors.Wrapf(os.ErrNotExist, "%+q no longer holds %+q", src.path, walFile)
+	}
+
+	if err := os.Rename(tmp.Name(), spooled); err != nil {
+		return "", errors.Wrapf(err, "unable to spool %+q", src.path)
+	}
+
+	return spooled, nil
+}
+
+// spoolDir returns the directory spooled segments are kept in, creating it if
+// necessary.
+func (wc *WALCache) spoolDir() (string, error) {
+	wc.spoolLock.Lock()
+	defer wc.spoolLock.Unlock()
+
+	if wc.spool == "" {
+		dir, err := ioutil.TempDir("", "pg_prefaulter")
+		if err != nil {
+			return "", errors.Wrap(err, "unable to create a spool directory")
+		}
+		wc.spool = dir
+	}
+
+	return wc.spool, nil
+}
+
+// pruneSpool removes the spooled segments that PostgreSQL has finished
+// replaying.
+func (wc *WALCache) pruneSpool(replayLSN pg.LSN) {
+	wc.spoolLock.Lock()
+	defer wc.spoolLock.Unlock()
+
+	if wc.spool == "" {
+		return
+	}
+
+	files, err := ioutil.ReadDir(wc.spool)
+	if err != nil {
+		return
+	}
+
+	for _, fi := range files {
+		// Partially written segments don't parse and are left in place.
+		end := segmentEnd(pg.WALFilename(fi.Name()))
+		if end != pg.InvalidLSN && end <= replayLSN {
+			os.Remove(path.Join(wc.spool, fi.Name()))
+		}
+	}
+}
+
+// purgeSpool removes every spooled segment.
+func (wc *WALCache) purgeSpool() {
+	wc.spoolLock.Lock()
+	defer wc.spoolLock.Unlock()
+
+	if wc.spool != "" {
+		os.RemoveAll(wc.spool)
+		wc.spool = ""
+	}
+}
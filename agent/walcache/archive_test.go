@@ -0,0 +1,259 @@
+package walcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/pkg/errors"
+)
+
+// fakeWALSegment returns the start of a segment beginning at lsn, enough for
+// pg.ReadWALSegmentAddress().
+func fakeWALSegment(lsn pg.LSN) []byte {
+	buf := make([]byte, 64)
+	binary.LittleEndian.PutUint16(buf[0:], 0xD10D)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(lsn))
+	return buf
+}
+
+func writeTestFile(t *testing.T, filename string, data []byte) {
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestLocateWALFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walcache")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pgData := path.Join(dir, "pgdata")
+	archiveDir := path.Join(dir, "archive")
+
+	const (
+		inWALDir       = pg.WALFilename("000000010000000000000001")
+		inRecovery     = pg.WALFilename("000000010000000000000002")
+		archived       = pg.WALFilename("000000010000000000000003")
+		archivedGzip   = pg.WALFilename("000000010000000000000004")
+		backRest       = pg.WALFilename("000000010000000000000005")
+		backRestGzip   = pg.WALFilename("000000010000000000000006")
+		backRestLZ4    = pg.WALFilename("000000010000000000000007")
+		missing        = pg.WALFilename("000000010000000000000008")
+		backRestSHA1   = "-0123456789abcdef0123456789abcdef01234567"
+		backRestSHA1v2 = "-89abcdef0123456789abcdef0123456789abcdef"
+	)
+
+	segment := func(walFile pg.WALFilename) []byte {
+		_, lsn, err := pg.ParseWalfile(walFile)
+		if err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+		return fakeWALSegment(lsn - 1)
+	}
+	backRestFile := func(walFile pg.WALFilename, suffix string) string {
+		return path.Join(archiveDir, string(walFile)[:16], string(walFile)+suffix)
+	}
+
+	writeTestFile(t, path.Join(pgData, "pg_wal", string(inWALDir)), segment(inWALDir))
+	writeTestFile(t, path.Join(pgData, "pg_wal", recoveryXLogFilename), segment(inRecovery))
+	writeTestFile(t, path.Join(archiveDir, string(archived)), segment(archived))
+	writeTestFile(t, path.Join(archiveDir, string(archivedGzip)+".gz"), gzipped(t, segment(archivedGzip)))
+	writeTestFile(t, backRestFile(backRest, backRestSHA1), segment(backRest))
+	writeTestFile(t, backRestFile(backRestGzip, backRestSHA1+".lz4"), []byte("not gzip"))
+	writeTestFile(t, backRestFile(backRestGzip, backRestSHA1v2+".gz"), gzipped(t, segment(backRestGzip)))
+	writeTestFile(t, backRestFile(backRestLZ4, backRestSHA1+".lz4"), []byte("not gzip"))
+
+	wc := &WALCache{
+		cfg: &config.WALCacheConfig{
+			PGDataPath: pgData,
+			ArchiveDir: archiveDir,
+		},
+		walTranslations: &pg.WALTranslations{Directory: "pg_wal"},
+	}
+	defer wc.purgeSpool()
+
+	type result struct {
+		Archived bool
+		Gzipped  bool
+		Spooled  bool
+		Contents []byte
+	}
+
+	tests := []struct {
+		walFile pg.WALFilename
+		path    string
+		want    result
+	}{
+		{
+			walFile: inWALDir,
+			path:    path.Join(pgData, "pg_wal", string(inWALDir)),
+			want:    result{Contents: segment(inWALDir)},
+		},
+		{
+			walFile: inRecovery,
+			path:    path.Join(pgData, "pg_wal", recoveryXLogFilename),
+			want:    result{Archived: true, Spooled: true, Contents: segment(inRecovery)},
+		},
+		{
+			walFile: archived,
+			path:    path.Join(archiveDir, string(archived)),
+			want:    result{Archived: true, Contents: segment(archived)},
+		},
+		{
+			walFile: archivedGzip,
+			path:    path.Join(archiveDir, string(archivedGzip)+".gz"),
+			want:    result{Archived: true, Gzipped: true, Spooled: true, Contents: segment(archivedGzip)},
+		},
+		{
+			walFile: backRest,
+			path:    backRestFile(backRest, backRestSHA1),
+			want:    result{Archived: true, Spooled: true, Contents: segment(backRest)},
+		},
+		{
+			// The .lz4 copy sorts first but can't be decoded.
+			walFile: backRestGzip,
+			path:    backRestFile(backRestGzip, backRestSHA1v2+".gz"),
+			want:    result{Archived: true, Gzipped: true, Spooled: true, Contents: segment(backRestGzip)},
+		},
+	}
+
+	for i, test := range tests {
+		src, err := wc.locateWALFile(test.walFile)
+		if err != nil {
+			t.Fatalf("%d: bad: %v", i, err)
+		}
+
+		if src.path != test.path {
+			t.Errorf("%d: path: got %q want %q", i, src.path, test.path)
+		}
+
+		r, err := src.open()
+		if err != nil {
+			t.Fatalf("%d: bad: %v", i, err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%d: bad: %v", i, err)
+		}
+
+		walDumpFile, err := wc.walDumpFile(test.walFile, src)
+		if err != nil {
+			t.Fatalf("%d: bad: %v", i, err)
+		}
+		if path.Base(walDumpFile) != string(test.walFile) {
+			t.Errorf("%d: filename: got %q want %q", i, path.Base(walDumpFile), test.walFile)
+		}
+		spooled, err := ioutil.ReadFile(walDumpFile)
+		if err != nil {
+			t.Fatalf("%d: bad: %v", i, err)
+		}
+		if !bytes.Equal(spooled, contents) {
+			t.Errorf("%d: %q does not hold %q", i, walDumpFile, test.walFile)
+		}
+
+		got := result{
+			Archived: src.archived,
+			Gzipped:  src.gzipped,
+			Spooled:  walDumpFile != src.path,
+			Contents: contents,
+		}
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Fatalf("%d: locateWALFile diff: (-got +want)\n%s", i, diff)
+		}
+	}
+
+	for _, walFile := range []pg.WALFilename{backRestLZ4, missing} {
+		if _, err := wc.locateWALFile(walFile); !os.IsNotExist(errors.Cause(err)) {
+			t.Fatalf("%s: want os.ErrNotExist, got %v", walFile, err)
+		}
+	}
+}
+
+func TestWALCache_walDumpFileSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walcache")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const (
+		first  = pg.WALFilename("000000010000000000000001")
+		second = pg.WALFilename("000000010000000000000002")
+	)
+
+	segment := func(walFile pg.WALFilename) []byte {
+		_, lsn, err := pg.ParseWalfile(walFile)
+		if err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+		return fakeWALSegment(lsn - 1)
+	}
+
+	recoveryXLog := path.Join(dir, recoveryXLogFilename)
+	wc := &WALCache{}
+	defer wc.purgeSpool()
+
+	// RECOVERYXLOG is spooled once and the copy outlives the next restore.
+	writeTestFile(t, recoveryXLog, segment(first))
+	src := &_WALSource{path: recoveryXLog, archived: true, transient: true}
+	spooled, err := wc.walDumpFile(first, src)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	writeTestFile(t, recoveryXLog, segment(second))
+	again, err := wc.walDumpFile(first, src)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if again != spooled {
+		t.Fatalf("bad: respooled %q as %q", spooled, again)
+	}
+	if !isWALSegment(again, first) {
+		t.Fatalf("bad: %q no longer holds %q", again, first)
+	}
+
+	// RECOVERYXLOG now holds second.
+	if _, err := wc.walDumpFile(second, src); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	wc.pruneSpool(segmentEnd(first))
+	if _, err := os.Stat(spooled); !os.IsNotExist(err) {
+		t.Fatalf("bad: %q not pruned: %v", spooled, err)
+	}
+	if _, err := os.Stat(path.Join(path.Dir(spooled), string(second))); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	wc.purgeSpool()
+	if _, err := os.Stat(path.Dir(spooled)); !os.IsNotExist(err) {
+		t.Fatalf("bad: spool directory not removed: %v", err)
+	}
+}
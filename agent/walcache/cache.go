@@ -22,9 +22,6 @@ import (
 	"math"
 	"os"
 	"os/exec"
-	"path"
-	"regexp"
-	"strconv"
 	"sync"
 	"sync/atomic"
 
@@ -39,19 +36,6 @@ import (
 	log "github.com/rs/zerolog/log"
 )
 
-// Input to parse: rel 1663/16394/1249 blk 29
-//                     ^^^^ ------------------- Tablespace ID
-//                          ^^^^^ ------------- Database ID
-//                                ^^^^ -------- Relation ID
-//                                         ^^ - Block Number
-var pgWalDumpRE = regexp.MustCompile(`rel ([\d]+)/([\d]+)/([\d]+) (?:fork [^\s]+ )?blk ([\d]+)`)
-
-// https://github.com/snaga/waldump
-//
-// [cur:CC/DFFF7C8, xid:448891062, rmid:11(Btree), len/tot_len:66/98, info:0, prev:C3/4FFF758] insert_leaf: s/d/r:1663/16385/16442 tid 1317010/91
-// [cur:C4/70, xid:450806558, rmid:10(Heap), len/tot_len:737/769, info:0, prev:C4/20] insert: s/d/r:1663/16385/16431 blk/off:32400985/3 header: t_infomask2 12 t_infomask 2051 t_hoff 32
-var waldumpRE = regexp.MustCompile(`s/d/r:([\d]+)/([\d]+)/([\d]+) (?:tid |blk/off:)([\d]+)`)
-
 // ConnContextAcquirer is an helper interface passed in by the agent and used to
 // defeat cyclic import restrictions.
 type ConnContextAcquirer interface {
@@ -81,7 +65,26 @@ type WALCache struct {
 	inFlightCond     *sync.Cond
 	inFlightWALFiles map[pg.WALFilename]struct{}
 
-	re *regexp.Regexp
+	// queue holds the WAL files waiting on a worker, lowest LSN first.
+	queue *lib.PriorityQueue
+
+	// tails tracks the segments that were still being written when they were
+	// last decoded.  See _WALTail.
+	tailLock sync.Mutex
+	tails    map[pg.WALFilename]_WALTail
+
+	// stream is the running pg_waldump(1) when WALCacheConfig.Stream is set.
+	// See StreamWAL().
+	streamLock sync.Mutex
+	stream     *_WALStream
+
+	// walDump holds the *_WalDump in use.  See SelectWalDump().
+	walDump atomic.Value
+
+	// spool is the directory holding copies of segments for pg_waldump(1).
+	// It is created on first use.  See walDumpFile().
+	spoolLock sync.Mutex
+	spool     string
 }
 
 var (
@@ -102,19 +105,34 @@ func New(pgConnCtxAcquirer ConnContextAcquirer, shutdownCtx context.Context,
 
 		inFlightWALFiles: make(map[pg.WALFilename]struct{}, walWorkers),
 		ioCache:          ioCache,
+		tails:            make(map[pg.WALFilename]_WALTail),
 	}
 	wc.inFlightCond = sync.NewCond(&wc.inFlightLock)
 
 	switch cfg.WALCacheConfig.Mode {
 	case config.WALModeXLog:
-		wc.re = waldumpRE
+		wc.walDump.Store(&_WalDump{
+			path:   cfg.WALCacheConfig.WalDumpPath,
+			parser: xlogWalDumpParser,
+		})
 	case config.WALModePG:
-		wc.re = pgWalDumpRE
+		// The output of pg_waldump(1) varies between major versions.  The
+		// pg_waldump(1) is selected once the cluster's version is known, see
+		// SelectWalDump().
+	case config.WALModeNative:
+		// The native decoder does not scan pg_waldump(1) output
 	default:
 		panic(fmt.Sprintf("unsupported WALConfig.mode: %v", cfg.WALCacheConfig.Mode))
 	}
 
-	walFilePrefaultWorkQueue := make(chan pg.WALFilename)
+	// WAL files are prefaulted in LSN order so that the segment PostgreSQL will
+	// replay next is never stuck behind a segment further in the future.
+	wc.queue = lib.NewPriorityQueue()
+	go func() {
+		<-wc.shutdownCtx.Done()
+		wc.queue.Close()
+	}()
+
 	for walWorker := 0; walWorker < walWorkers; walWorker++ {
 		wc.wg.Add(1)
 		go func(threadID int) {
@@ -123,35 +141,32 @@ func New(pgConnCtxAcquirer ConnContextAcquirer, shutdownCtx context.Context,
 			}()
 
 			for {
-				select {
-				case <-wc.shutdownCtx.Done():
+				walFileRaw, ok := wc.queue.Pop()
+				if !ok {
 					return
-				case walFile, ok := <-walFilePrefaultWorkQueue:
-					if !ok {
-						return
-					}
-
-					numConcurrentWALLock.Lock()
-					numConcurrentWALs++
-					numConcurrentWALLock.Unlock()
-
-					if err := wc.prefaultWALFile(walFile); err != nil {
-						// If we had a problem prefaulting in the WAL file, for whatever
-						// reason, attempt to remove it from the cache.
-						log.Warn().Err(err).Msg("prefault failed")
-						wc.c.Remove(walFile)
-					}
-
-					numConcurrentWALLock.Lock()
-					numConcurrentWALs--
-					numConcurrentWALLock.Unlock()
-
-					// Inserts into wc.inFlightWALFile happen in FaultWALFile()
-					wc.inFlightLock.Lock()
-					delete(wc.inFlightWALFiles, walFile)
-					wc.inFlightCond.Broadcast()
-					wc.inFlightLock.Unlock()
 				}
+				walFile := walFileRaw.(pg.WALFilename)
+
+				numConcurrentWALLock.Lock()
+				numConcurrentWALs++
+				numConcurrentWALLock.Unlock()
+
+				if err := wc.prefaultWALFile(walFile); err != nil {
+					// If we had a problem prefaulting in the WAL file, for whatever
+					// reason, attempt to remove it from the cache.
+					log.Warn().Err(err).Msg("prefault failed")
+					wc.c.Remove(walFile)
+				}
+
+				numConcurrentWALLock.Lock()
+				numConcurrentWALs--
+				numConcurrentWALLock.Unlock()
+
+				// Inserts into wc.inFlightWALFile happen in FaultWALFile()
+				wc.inFlightLock.Lock()
+				delete(wc.inFlightWALFiles, walFile)
+				wc.inFlightCond.Broadcast()
+				wc.inFlightLock.Unlock()
 			}
 		}(walWorker)
 	}
@@ -164,11 +179,7 @@ func New(pgConnCtxAcquirer ConnContextAcquirer, shutdownCtx context.Context,
 		LRU().
 		LoaderFunc(func(keyRaw interface{}) (interface{}, error) {
 			walFilename := keyRaw.(pg.WALFilename)
-
-			select {
-			case <-wc.shutdownCtx.Done():
-			case walFilePrefaultWorkQueue <- walFilename:
-			}
+			wc.queue.Push(walFilename, walFilePriority(walFilename))
 
 			return true, nil
 		}).
@@ -184,8 +195,10 @@ func (wc *WALCache) Get(k interface{}) (interface{}, error) {
 	return wc.c.Get(k)
 }
 
-// GetIFPresent forwards to gcache.Cache's GetIFPresent() if the given
-// WALFilename is not already in process.
+// FaultWALFile forwards to gcache.Cache's GetIFPresent() if the given
+// WALFilename is not already in process.  Segments that were still being
+// written when they were last decoded are queued again, regardless of the
+// cache, so that records appended since are prefaulted.
 func (wc *WALCache) FaultWALFile(walFilename pg.WALFilename) (bool, error) {
 	wc.inFlightLock.Lock()
 	if _, found := wc.inFlightWALFiles[walFilename]; found {
@@ -193,15 +206,27 @@ func (wc *WALCache) FaultWALFile(walFilename pg.WALFilename) (bool, error) {
 		return true, nil
 	}
 
-	// Removal of a walFile is handled in the
-	// walFilePrefaultWorkQueue.
+	// Removal of a walFile is handled by the WAL workers.
 	wc.inFlightWALFiles[walFilename] = struct{}{}
 	wc.inFlightLock.Unlock()
 
+	if _, tailing := wc.walTail(walFilename); tailing {
+		wc.queue.Push(walFilename, walFilePriority(walFilename))
+		return true, nil
+	}
+
 	_, err := wc.c.GetIFPresent(walFilename)
 	if err == gcache.KeyNotFoundError {
 		return true, nil
 	}
+
+	// The WAL file has already been prefaulted and no worker will clear its
+	// in-flight marker.
+	wc.inFlightLock.Lock()
+	delete(wc.inFlightWALFiles, walFilename)
+	wc.inFlightCond.Broadcast()
+	wc.inFlightLock.Unlock()
+
 	return false, err
 }
 
@@ -240,6 +265,9 @@ func (wc *WALCache) Purge() {
 	defer wc.purgeLock.Unlock()
 
 	wc.c.Purge()
+	wc.purgeWALTails()
+	wc.purgeSpool()
+	wc.StopStream()
 	wc.ioCache.Purge()
 }
 
@@ -249,31 +277,67 @@ func (wc *WALCache) ReadaheadBytes() units.Base2Bytes {
 }
 
 // Wait blocks until the WALCache finishes shutting down its workers (including
-// the workers of its IOCache).
+// the pg_waldump(1) stream and the workers of its IOCache).
 func (wc *WALCache) Wait() {
+	wc.StopStream()
 	wc.wg.Wait()
+	wc.purgeSpool()
 	wc.ioCache.Wait()
 }
 
 // prefaultWALFile shells out to pg_waldump(1) and reads its input.  The input
 // from pg_waldump(1) is then turned into IO requests that are picked up and
-// handled by the ioCache.
+// handled by the ioCache.  When configured to use the native WAL decoder,
+// prefaultWALFile hands off to prefaultWALFileNative() instead.
+//
+// pg_waldump(1) exits with an error at the end of the valid WAL of a segment
+// that is still being written.  Such a segment is tailed: the next call resumes
+// after the last record decoded with -s, once the segment has been modified.
 func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
+	if wc.cfg.Mode == config.WALModeNative {
+		return wc.prefaultWALFileNative(walFile)
+	}
 
 	log.Debug().Str("walfile", string(walFile)).Msg("prefaulting")
 
-	var blocksMatched, linesMatched, linesScanned, walFilesProcessed, waldumpBytes uint64
-	var ioCacheHit, ioCacheMiss uint64
+	walDump, err := wc.currentWalDump()
+	if err != nil {
+		return err
+	}
 
-	walFileAbs := path.Join(wc.cfg.PGDataPath, wc.walTranslations.Directory, string(walFile))
-	_, err = os.Stat(walFileAbs)
+	var walFilesProcessed uint64
+
+	src, err := wc.locateWALFile(walFile)
 	if err != nil {
 		log.Warn().Err(err).Str("walfile", string(walFile)).Msg("stat")
 		return errors.Wrap(err, "WAL file does not exist")
 	}
 
-	cmd := exec.CommandContext(wc.pgConnCtxAcquirer.AcquireConnContext(),
-		wc.cfg.WalDumpPath, "-f", walFileAbs)
+	fi, err := os.Stat(src.path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat %+q", src.path)
+	}
+
+	replayLSN := wc.ioCache.ReplayLSN()
+	wc.pruneWALTails(replayLSN)
+	wc.pruneSpool(replayLSN)
+	tail, tailing := wc.walTail(walFile)
+	if tailing && !tail.changed(fi) {
+		return nil
+	}
+
+	walDumpFile, err := wc.walDumpFile(walFile, src)
+	if err != nil {
+		return errors.Wrapf(err, "unable to prepare %+q for pg_waldump(1)", walFile)
+	}
+
+	args := []string{walDumpFile}
+	if tailing {
+		args = []string{"-s", tail.next.String(), walDumpFile}
+	}
+
+	ctx := wc.pgConnCtxAcquirer.AcquireConnContext()
+	cmd := exec.CommandContext(ctx, walDump.path, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 
@@ -286,6 +350,8 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 		return errors.Wrapf(err, "unable to read from pg_waldump(1): %q", errbuf.String())
 	}
 
+	var stats _WalDumpStats
+	var lastLSN pg.LSN
 	scanner := bufio.NewScanner(dumpOutReader)
 	var cmdWG sync.WaitGroup
 	cmdWG.Add(1)
@@ -293,93 +359,13 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 		defer cmdWG.Done()
 
 		for scanner.Scan() {
-			line := scanner.Bytes()
-			atomic.AddUint64(&waldumpBytes, uint64(len(line)))
-			atomic.AddUint64(&linesScanned, 1)
-			submatches := wc.re.FindAllSubmatch(line, -1)
-			if submatches == nil {
-				continue
-			}
-
-			atomic.AddUint64(&linesMatched, 1)
-
-			for _, matches := range submatches {
-				atomic.AddUint64(&blocksMatched, 1)
-				tablespace, err := strconv.ParseUint(string(matches[1]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[1])).Msg("unable to convert tablespace")
-					continue
-				}
-
-				database, err := strconv.ParseUint(string(matches[2]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[2])).Msg("unable to convert database")
-					continue
-				}
-
-				// NOTE(seanc@): PostgreSQL uses database ID 0 for some system catalog
-				// activity, notably CREATE DATABASE.
-				//
-				// rmgr: XLOG        len (rec/tot):     30/    30, tx:          0, lsn: 0/03000060, prev 0/03000028, desc: NEXTOID 24576
-				// rmgr: Heap        len (rec/tot):     54/  1222, tx:        995, lsn: 0/03000080, prev 0/03000060, desc: INSERT off 4, blkref #0: rel 1664/0/1262 blk 0 FPW
-				// rmgr: Btree       len (rec/tot):     53/   197, tx:        995, lsn: 0/03000548, prev 0/03000080, desc: INSERT_LEAF off 4, blkref #0: rel 1664/0/2671 blk 1 FPW
-				// rmgr: Btree       len (rec/tot):     53/   173, tx:        995, lsn: 0/03000610, prev 0/03000548, desc: INSERT_LEAF off 4, blkref #0: rel 1664/0/2672 blk 1 FPW
-				// rmgr: Standby     len (rec/tot):     54/    54, tx:          0, lsn: 0/030006C0, prev 0/03000610, desc: RUNNING_XACTS nextXid 996 latestCompletedXid 994 oldestRunningXid 995; 1 xacts: 995
-				// rmgr: XLOG        len (rec/tot):    106/   106, tx:          0, lsn: 0/030006F8, prev 0/030006C0, desc: CHECKPOINT_ONLINE redo 0/30006C0; tli 1; prev tli 1; fpw true; xid 0:996; oid 24576; multi 1; offset 0; oldest xid 988 in DB 1; oldest multi 1 in DB 1; oldest/newest commit timestamp xid: 0/0; oldest running xid 995; online
-				// rmgr: Database    len (rec/tot):     42/    42, tx:        995, lsn: 0/03000768, prev 0/030006F8, desc: CREATE copy dir 1/1663 to 16384/1663
-				// rmgr: Standby     len (rec/tot):     54/    54, tx:          0, lsn: 0/03000798, prev 0/03000768, desc: RUNNING_XACTS nextXid 996 latestCompletedXid 994 oldestRunningXid 995; 1 xacts: 995
-				// rmgr: XLOG        len (rec/tot):    106/   106, tx:          0, lsn: 0/030007D0, prev 0/03000798, desc: CHECKPOINT_ONLINE redo 0/3000798; tli 1; prev tli 1; fpw true; xid 0:996; oid 24576; multi 1; offset 0; oldest xid 988 in DB 1; oldest multi 1 in DB 1; oldest/newest commit timestamp xid: 0/0; oldest running xid 995; online
-				// rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync
-				// rmgr: Storage     len (rec/tot):     42/    42, tx:          0, lsn: 0/03000888, prev 0/03000840, desc: CREATE base/16384/16385
-				if database == 0 {
-					log.Info().Str("input", string(line)).Msg("database 0")
-					continue
-				}
-
-				relation, err := strconv.ParseUint(string(matches[3]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[3])).Msg("unable to convert relation")
-					continue
-				}
-
-				block, err := strconv.ParseUint(string(matches[4]), 10, 64)
-				if err != nil {
-					log.Error().Err(err).Str("input", string(matches[4])).Msg("unable to convert block")
-					continue
-				}
-
-				// Send all IOs through the non-blocking cache interface.  Leave it up to
-				// the ARC cache to deal with the influx of go routines which will get
-				// scheduled and rate limited behind the ioCache.  If this ends up
-				// becoming a problem we could throttle the requests into the cache, but I
-				// really hope that's not something we need to do.
-				//
-				// Worst case is we flood the ioCache with requests and then block on the
-				// next WALfile.  Because the max number of pages per WAL file is finite
-				// (16MiB/8KiB == ~2K), at most we should have 2K threads running *
-				// KeyWALReadahead.  That's very survivable for now but can be optimized
-				// if necessary.
-				ioCacheKey := structs.IOCacheKey{
-					Tablespace: pg.OID(tablespace),
-					Database:   pg.OID(database),
-					Relation:   pg.OID(relation),
-					Block:      pg.HeapBlockNumber(block),
-				}
-				_, err = wc.ioCache.GetIFPresent(ioCacheKey)
-				switch {
-				case err == nil:
-					atomic.AddUint64(&ioCacheHit, 1)
-				case err == gcache.KeyNotFoundError:
-					// cache miss, an IO has been scheduled in the background.
-					atomic.AddUint64(&ioCacheMiss, 1)
-				case err != nil:
-					log.Debug().Err(err).Msg("iocache prefaultWALFile()")
-				}
+			if lsn, ok := wc.prefaultWalDumpLine(walDump, scanner.Bytes(), &stats); ok {
+				lastLSN = lsn
 			}
 		}
 
 		// Declare victory if we fault at least one block
-		if atomic.LoadUint64(&ioCacheMiss)+atomic.LoadUint64(&ioCacheHit) > 0 {
+		if atomic.LoadUint64(&stats.ioCacheMiss)+atomic.LoadUint64(&stats.ioCacheHit) > 0 {
 			atomic.AddUint64(&walFilesProcessed, uint64(1))
 		}
 	}()
@@ -401,28 +387,117 @@ func (wc *WALCache) prefaultWALFile(walFile pg.WALFilename) (err error) {
 	// of Wait is deferred until after the logging.
 	waitErr := cmd.Wait()
 
+	// Archived segments are complete and are never tailed.  pg_waldump(1)
+	// finds the first record after tail.next on its own, so decoding resumes
+	// one byte past the last record decoded.
+	incomplete := waitErr != nil && !src.archived && ctx.Err() == nil
+	if incomplete {
+		next := tail.next
+		if lastLSN != 0 {
+			next = lastLSN + 1
+		}
+		wc.setWALTail(walFile, _WALTail{next: next, modTime: fi.ModTime()})
+	} else {
+		wc.clearWALTail(walFile)
+	}
+
 	// For whatever reason pg_waldump(1) had stderr output.  It's
 	// entirely plausible, even likely, that pg_waldump(1) threw some
 	// output to stderr and yet the prefaulter still produced useful
-	// results.
+	// results.  Reaching the end of a segment that is still being written is
+	// expected.
 	if len(errbuf.String()) > 0 {
-		log.Warn().Err(waitErr).
-			Str("pg_waldump-path", wc.cfg.WalDumpPath).
-			Str("walfile", walFileAbs).
+		event := log.Warn()
+		if incomplete {
+			event = log.Debug()
+		}
+		event.Err(waitErr).
+			Str("pg_waldump-path", walDump.path).
+			Str("walfile", walDumpFile).
 			Str("stderr", errbuf.String()).
-			Uint64("blocks-matched", atomic.LoadUint64(&blocksMatched)).
 			Uint64("wal-files-processed", atomic.LoadUint64(&walFilesProcessed)).
-			Uint64("iocache-hit", atomic.LoadUint64(&ioCacheHit)).
-			Uint64("iocache-miss", atomic.LoadUint64(&ioCacheMiss)).
-			Uint64("lines-matched", atomic.LoadUint64(&linesMatched)).
-			Uint64("lines-scanned", atomic.LoadUint64(&linesScanned)).
-			Uint64("pg_waldump-bytes", atomic.LoadUint64(&waldumpBytes)).
+			Dict("stats", stats.dict()).
 			Msg("pg_waldump(1) stderr")
 	}
 
-	if waitErr == nil {
+	log.Debug().
+		Str("walfile", string(walFile)).
+		Dict("stats", stats.dict()).
+		Msg("prefaulted WAL file")
+
+	if waitErr == nil || incomplete {
 		return nil
 	}
 
-	return errors.Wrapf(waitErr, "pg_waldump(1) returned uncleanly when reading %+q or running %+q: %+q", walFileAbs, wc.cfg.WalDumpPath, errbuf.String())
+	return errors.Wrapf(waitErr, "pg_waldump(1) returned uncleanly when reading %+q or running %+q: %+q", walDumpFile, walDump.path, errbuf.String())
+}
+
+// prefaultBlock sends an IO request for a single block through the
+// non-blocking ioCache interface.  lsn is the LSN of the WAL record referencing
+// the block and determines the priority of the IO.  prefaultBlock returns true
+// when the block was found in the ioCache.
+func (wc *WALCache) prefaultBlock(ioCacheKey structs.IOCacheKey, lsn pg.LSN) (hit bool) {
+	// Send all IOs through the non-blocking cache interface.  The ioCache queues
+	// the IO and its workers issue queued IOs in LSN order, so the pages needed
+	// soonest by the startup process are read first.
+	return wc.ioCache.Prefault(ioCacheKey, lsn)
+}
+
+// prefaultImplicitRead is prefaultBlock() for a block read implicitly when
+// replaying the record at lsn.
+func (wc *WALCache) prefaultImplicitRead(ioCacheKey structs.IOCacheKey, lsn pg.LSN) (hit bool) {
+	implicitReads.Add(1)
+	return wc.prefaultBlock(ioCacheKey, lsn)
+}
+
+// prefaultSLRUPage is prefaultBlock() for a page of an SLRU (e.g. pg_xact).
+func (wc *WALCache) prefaultSLRUPage(page pg.SLRUPage, lsn pg.LSN) (hit bool) {
+	slruPages.Add(page.SLRU.String(), 1)
+	return wc.prefaultBlock(structs.NewSLRUKey(page), lsn)
+}
+
+// invalidateRelations forgets the cached pages and file handles of relations
+// that have been created, truncated or dropped.
+func (wc *WALCache) invalidateRelations(lsn pg.LSN, events []pg.RelationEvent) {
+	for _, ev := range events {
+		relationEvents.Add(ev.Kind.String(), 1)
+		log.Debug().
+			Str("lsn", lsn.String()).
+			Str("event", ev.Kind.String()).
+			Str("relation", ev.RelFileNode.String()).
+			Str("fork", ev.Fork.String()).
+			Uint64("block", uint64(ev.Block)).
+			Msg("relation changed")
+	}
+
+	wc.ioCache.Invalidate(events)
+}
+
+// prefaultDatabase prefaults every relation file of the template database
+// copied by a Database CREATE record at lsn.
+func (wc *WALCache) prefaultDatabase(lsn pg.LSN, dbCopy pg.DatabaseCopy) {
+	pages, err := wc.ioCache.PrefaultDatabase(dbCopy.SrcTablespace, dbCopy.SrcDatabase, lsn)
+	if err != nil {
+		log.Warn().Err(err).Str("lsn", lsn.String()).Str("database", dbCopy.String()).
+			Msg("unable to prefault template database")
+		return
+	}
+
+	databaseCopyPages.Add(int64(pages))
+	log.Info().
+		Str("lsn", lsn.String()).
+		Str("database", dbCopy.String()).
+		Uint64("pages", pages).
+		Msg("prefaulting template database")
+}
+
+// walFilePriority returns the scheduling priority of a WAL file: the LSN at
+// the start of the segment.
+func walFilePriority(walFile pg.WALFilename) uint64 {
+	_, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return math.MaxUint64
+	}
+
+	return uint64(lsn)
 }
@@ -27,6 +27,7 @@ func TestPGWalDumpRE(t *testing.T) {
 		tablespaceID []string
 		databaseID   []string
 		relationID   []string
+		fork         []string
 		blockNumber  []string
 	}{
 		{
@@ -35,6 +36,7 @@ func TestPGWalDumpRE(t *testing.T) {
 			tablespaceID: []string{"1663"},
 			databaseID:   []string{"16398"},
 			relationID:   []string{"16399"},
+			fork:         []string{""},
 			blockNumber:  []string{"4408314"},
 		},
 		{
@@ -43,6 +45,7 @@ func TestPGWalDumpRE(t *testing.T) {
 			tablespaceID: []string{"1663", "1663"},
 			databaseID:   []string{"16400", "16400"},
 			relationID:   []string{"2619", "2619"},
+			fork:         []string{"vm", ""},
 			blockNumber:  []string{"0", "10"},
 		},
 		{
@@ -51,6 +54,7 @@ func TestPGWalDumpRE(t *testing.T) {
 			tablespaceID: []string{"1663", "1663", "1663"},
 			databaseID:   []string{"16400", "16400", "16400"},
 			relationID:   []string{"16434", "16434", "16434"},
+			fork:         []string{"", "", ""},
 			blockNumber:  []string{"9578854", "19938685", "3875203"},
 		},
 	}
@@ -68,23 +72,27 @@ func TestPGWalDumpRE(t *testing.T) {
 		}
 
 		for j, submatch := range submatches {
-			if len(submatch) != 5 {
+			if len(submatch) != 7 {
 				t.Fatalf("%d failed length test: %d", j, len(submatch))
 			}
 
-			if diff := pretty.Compare(string(submatch[1]), test.tablespaceID[j]); diff != "" {
+			if diff := pretty.Compare(string(submatch[pgWalDumpRE.SubexpIndex("tablespace")]), test.tablespaceID[j]); diff != "" {
 				t.Fatalf("tablespace ID diff: (-got +want)\n%s", diff)
 			}
 
-			if diff := pretty.Compare(string(submatch[2]), test.databaseID[j]); diff != "" {
+			if diff := pretty.Compare(string(submatch[pgWalDumpRE.SubexpIndex("database")]), test.databaseID[j]); diff != "" {
 				t.Fatalf("database ID diff: (-got +want)\n%s", diff)
 			}
 
-			if diff := pretty.Compare(string(submatch[3]), test.relationID[j]); diff != "" {
+			if diff := pretty.Compare(string(submatch[pgWalDumpRE.SubexpIndex("relation")]), test.relationID[j]); diff != "" {
 				t.Fatalf("relation ID diff: (-got +want)\n%s", diff)
 			}
 
-			if diff := pretty.Compare(string(submatch[4]), test.blockNumber[j]); diff != "" {
+			if diff := pretty.Compare(string(submatch[pgWalDumpRE.SubexpIndex("fork")]), test.fork[j]); diff != "" {
+				t.Fatalf("fork diff: (-got +want)\n%s", diff)
+			}
+
+			if diff := pretty.Compare(string(submatch[pgWalDumpRE.SubexpIndex("block")]), test.blockNumber[j]); diff != "" {
 				t.Fatalf("block number diff: (-got +want)\n%s", diff)
 			}
 		}
@@ -0,0 +1,229 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"encoding/binary"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	log "github.com/rs/zerolog/log"
+)
+
+// _ImplicitReadRule predicts blocks that are read when a record is replayed
+// but that are not referenced by the record's block references.  Rules are
+// specific to a resource manager and to a range of PostgreSQL major versions.
+type _ImplicitReadRule struct {
+	name string
+
+	// rmgr and rmgrName identify the resource manager of the record when it is
+	// decoded with pg.WALReader and in the output of pg_waldump(1).
+	rmgr     pg.RmgrID
+	rmgrName string
+
+	// minMajor and maxMajor bound the major versions the rule applies to.
+	// maxMajor is exclusive and zero means the rule applies to every release
+	// from minMajor onward.
+	minMajor uint64
+	maxMajor uint64
+
+	// descRE matches the description of the record printed by pg_waldump(1)
+	// and captures the rule's arguments.  A nil descRE matches every record of
+	// the resource manager.
+	descRE *regexp.Regexp
+
+	// decode returns the rule's arguments from a decoded record.  ok is false if
+	// the rule does not apply to the record.  A nil decode matches every record
+	// of the resource manager.
+	decode func(rec *pg.WALRecord) (args []uint64, ok bool)
+
+	// reads expands the blocks referenced by the record into the blocks read
+	// implicitly.
+	reads func(blocks []structs.IOCacheKey, args []uint64) []structs.IOCacheKey
+}
+
+// implicitReadRules is the table of rules applied to every record.
+//
+// The metapage reads made by the GIN, SP-GiST and hash redo routines are not
+// covered yet.  They need pg_waldump(1) output captured from each supported
+// release to match against and are left to a follow-up.
+var implicitReadRules = []_ImplicitReadRule{
+	{
+		// Before PostgreSQL 13, a hot standby replaying a Btree VACUUM record
+		// pins every page between the last page vacuumed and the page referenced
+		// by the record so that no index scan is left holding a pin on them.
+		// InvalidBlockNumber means no pin scan is required (9.6+).  See
+		// btree_xlog_vacuum().
+		name:     "btree-vacuum-pin-scan",
+		rmgr:     pg.RmgrBtree,
+		rmgrName: "Btree",
+		maxMajor: 130000,
+		descRE:   regexp.MustCompile(`desc: VACUUM lastBlockVacuumed ([\d]+)`),
+		decode: func(rec *pg.WALRecord) ([]uint64, bool) {
+			if rec.RmgrInfo() != xlogBtreeVacuum || len(rec.MainData) < 4 {
+				return nil, false
+			}
+			return []uint64{uint64(binary.LittleEndian.Uint32(rec.MainData))}, true
+		},
+		reads: btreePinScanReads,
+	},
+}
+
+const (
+	// xlogBtreeVacuum is XLOG_BTREE_VACUUM.
+	xlogBtreeVacuum = 0xC0
+
+	// maxBtreePinScanReads caps the number of blocks predicted for a single
+	// pin scan.  The gap between two vacuumed pages can span most of a large
+	// index, and only the start of the scan is worth prefaulting ahead of
+	// replay.
+	maxBtreePinScanReads = 256
+)
+
+// btreePinScanReads returns the blocks between the last block vacuumed
+// (args[0]) and the block vacuumed by the record, up to maxBtreePinScanReads
+// blocks from the start of the scan.
+func btreePinScanReads(blocks []structs.IOCacheKey, args []uint64) []structs.IOCacheKey {
+	if len(blocks) == 0 || len(args) == 0 || args[0] >= math.MaxUint32 {
+		return nil
+	}
+
+	start := pg.HeapBlockNumber(args[0] + 1)
+	end := blocks[0].Block
+	if end <= start {
+		return nil
+	}
+	if end-start > maxBtreePinScanReads {
+		end = start + maxBtreePinScanReads
+	}
+
+	reads := make([]structs.IOCacheKey, 0, end-start)
+	for block := start; block < end; block++ {
+		key := blocks[0]
+		key.Block = block
+		reads = append(reads, key)
+	}
+
+	return reads
+}
+
+// applies returns true if the rule applies to the given major version.
+func (rule *_ImplicitReadRule) applies(major uint64) bool {
+	return major >= rule.minMajor && (rule.maxMajor == 0 || major < rule.maxMajor)
+}
+
+// expand returns the implicit reads of the rule, less the blocks the record
+// references itself.
+func (rule *_ImplicitReadRule) expand(blocks []structs.IOCacheKey, args []uint64) []structs.IOCacheKey {
+	implicit := rule.reads(blocks, args)
+	if len(implicit) == 0 {
+		return nil
+	}
+
+	referenced := make(map[structs.IOCacheKey]struct{}, len(blocks))
+	for _, key := range blocks {
+		referenced[key] = struct{}{}
+	}
+
+	var reads []structs.IOCacheKey
+	for _, read := range implicit {
+		if _, found := referenced[read]; !found {
+			reads = append(reads, read)
+		}
+	}
+
+	return reads
+}
+
+// pgWalDumpRmgrRE matches the resource manager of a record printed by
+// pg_waldump(1).
+var pgWalDumpRmgrRE = regexp.MustCompile(`^rmgr: ([^\s]+) `)
+
+// walDumpImplicitReads returns the blocks read implicitly when replaying the
+// record printed by pg_waldump(1) from the given major version.  blocks are the
+// blocks referenced by the record.
+func walDumpImplicitReads(major uint64, line []byte, blocks []structs.IOCacheKey) []structs.IOCacheKey {
+	matches := pgWalDumpRmgrRE.FindSubmatch(line)
+	if matches == nil {
+		return nil
+	}
+
+	var reads []structs.IOCacheKey
+	for i := range implicitReadRules {
+		rule := &implicitReadRules[i]
+		if rule.rmgrName != string(matches[1]) || !rule.applies(major) {
+			continue
+		}
+
+		var args []uint64
+		if rule.descRE != nil {
+			descMatches := rule.descRE.FindSubmatch(line)
+			if descMatches == nil {
+				continue
+			}
+
+			var err error
+			if args, err = parseImplicitReadArgs(descMatches[1:]); err != nil {
+				log.Debug().Err(err).Str("rule", rule.name).Str("input", string(line)).Msg("unable to parse record")
+				continue
+			}
+		}
+
+		reads = append(reads, rule.expand(blocks, args)...)
+	}
+
+	return reads
+}
+
+// parseImplicitReadArgs converts the submatches of a rule's descRE into the
+// rule's arguments.
+func parseImplicitReadArgs(submatches [][]byte) ([]uint64, error) {
+	args := make([]uint64, 0, len(submatches))
+	for _, submatch := range submatches {
+		arg, err := strconv.ParseUint(string(submatch), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// nativeImplicitReads is walDumpImplicitReads() for a record decoded by
+// pg.WALReader from the given major version.
+func nativeImplicitReads(major uint64, rec *pg.WALRecord, blocks []structs.IOCacheKey) []structs.IOCacheKey {
+	var reads []structs.IOCacheKey
+	for i := range implicitReadRules {
+		rule := &implicitReadRules[i]
+		if rule.rmgr != rec.Rmgr || !rule.applies(major) {
+			continue
+		}
+
+		var args []uint64
+		if rule.decode != nil {
+			var ok bool
+			if args, ok = rule.decode(rec); !ok {
+				continue
+			}
+		}
+
+		reads = append(reads, rule.expand(blocks, args)...)
+	}
+
+	return reads
+}
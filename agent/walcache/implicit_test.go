@@ -0,0 +1,86 @@
+package walcache
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestNativeImplicitReads(t *testing.T) {
+	index := structs.IOCacheKey{Tablespace: 1663, Database: 16384, Relation: 16395}
+	block := func(block pg.HeapBlockNumber) structs.IOCacheKey {
+		key := index
+		key.Block = block
+		return key
+	}
+	blockRange := func(start, end pg.HeapBlockNumber) []structs.IOCacheKey {
+		var keys []structs.IOCacheKey
+		for b := start; b < end; b++ {
+			keys = append(keys, block(b))
+		}
+		return keys
+	}
+	lastBlockVacuumed := func(block uint32) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, block)
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		major  uint64
+		rec    pg.WALRecord
+		blocks []structs.IOCacheKey
+		want   []structs.IOCacheKey
+	}{
+		{
+			name:   "btree vacuum pin scan",
+			major:  90600,
+			rec:    pg.WALRecord{Rmgr: pg.RmgrBtree, Info: 0xC0, MainData: lastBlockVacuumed(3)},
+			blocks: []structs.IOCacheKey{block(7)},
+			want:   []structs.IOCacheKey{block(4), block(5), block(6)},
+		},
+		{
+			name:   "btree vacuum pin scan capped",
+			major:  90600,
+			rec:    pg.WALRecord{Rmgr: pg.RmgrBtree, Info: 0xC0, MainData: lastBlockVacuumed(0)},
+			blocks: []structs.IOCacheKey{block(1 << 20)},
+			want:   blockRange(1, 1+maxBtreePinScanReads),
+		},
+		{
+			name:   "btree vacuum pin scan less referenced blocks",
+			major:  90600,
+			rec:    pg.WALRecord{Rmgr: pg.RmgrBtree, Info: 0xC0, MainData: lastBlockVacuumed(3)},
+			blocks: []structs.IOCacheKey{block(7), block(5)},
+			want:   []structs.IOCacheKey{block(4), block(6)},
+		},
+		{
+			name:   "btree vacuum without pin scan",
+			major:  120000,
+			rec:    pg.WALRecord{Rmgr: pg.RmgrBtree, Info: 0xC0, MainData: lastBlockVacuumed(0xFFFFFFFF)},
+			blocks: []structs.IOCacheKey{block(7)},
+		},
+		{
+			name:   "btree vacuum on 13",
+			major:  130000,
+			rec:    pg.WALRecord{Rmgr: pg.RmgrBtree, Info: 0xC0, MainData: lastBlockVacuumed(3)},
+			blocks: []structs.IOCacheKey{block(7)},
+		},
+		{
+			name:   "btree insert",
+			major:  90600,
+			rec:    pg.WALRecord{Rmgr: pg.RmgrBtree, Info: 0x00, MainData: lastBlockVacuumed(3)},
+			blocks: []structs.IOCacheKey{block(7)},
+		},
+	}
+
+	for _, test := range tests {
+		got := nativeImplicitReads(test.major, &test.rec, test.blocks)
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("%s: implicit reads diff: (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"io"
+	"os"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+)
+
+// prefaultWALFileNative decodes walFile using pg.WALReader and turns the block
+// references into IO requests that are picked up and handled by the ioCache.
+// Unlike prefaultWALFile(), no pg_waldump(1) process is forked.
+//
+// If decoding stops before the end of the segment, the segment is assumed to
+// still be written and is tailed: the next call resumes decoding after the
+// last record decoded, once the segment has been modified.
+func (wc *WALCache) prefaultWALFileNative(walFile pg.WALFilename) error {
+	src, err := wc.locateWALFile(walFile)
+	if err != nil {
+		log.Warn().Err(err).Str("walfile", string(walFile)).Msg("open")
+		return errors.Wrap(err, "WAL file does not exist")
+	}
+
+	walFileAbs := src.path
+	r, err := src.open()
+	if err != nil {
+		log.Warn().Err(err).Str("walfile", string(walFile)).Msg("open")
+		return errors.Wrap(err, "WAL file does not exist")
+	}
+	defer r.Close()
+
+	fi, err := os.Stat(walFileAbs)
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat %+q", walFileAbs)
+	}
+
+	wc.pruneWALTails(wc.ioCache.ReplayLSN())
+	tail, tailing := wc.walTail(walFile)
+	if tailing && !tail.changed(fi) {
+		return nil
+	}
+
+	log.Debug().Str("walfile", string(walFile)).Str("start", tail.next.String()).Msg("prefaulting")
+
+	// Compressed segments can't be seeked, but they are archived and are
+	// always decoded from the start.
+	var wr *pg.WALReader
+	if f, ok := r.(*os.File); ok {
+		wr, err = pg.NewWALReaderAt(f, walFile, tail.next)
+	} else {
+		wr, err = pg.NewWALReader(r, walFile)
+	}
+	switch {
+	case err == io.EOF:
+		// Nothing new has been written at tail.next yet.
+		return nil
+	case err != nil:
+		return errors.Wrapf(err, "unable to decode %+q", walFileAbs)
+	}
+	next := wr.Position()
+
+	var blocksMatched, recordsDecoded, ioCacheHit, ioCacheMiss, fpwSkipped, relEvents, slruPageCount, implicitReadCount uint64
+	ctx := wc.pgConnCtxAcquirer.AcquireConnContext()
+
+RECORDS:
+	for done := false; !done && !lib.IsShuttingDown(ctx); {
+		rec, err := wr.Next()
+		switch {
+		case err == nil:
+		case err == io.EOF:
+			break RECORDS
+		case err == pg.ErrWALRecordSpansSegment:
+			// Finish the last record using the next segment, if it exists.  The
+			// remainder of the next segment is decoded on its own.
+			rec, err = wc.continueWALFile(wr, walFile)
+			if err != nil {
+				log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to finish last WAL record")
+				break RECORDS
+			}
+			done = true
+			next = segmentEnd(walFile)
+		case errors.Cause(err) == pg.ErrWALInvalidRecord:
+			// PostgreSQL treats an invalid record as the end of WAL.  This is
+			// expected when decoding the segment currently being written.
+			log.Debug().Err(err).Str("walfile", string(walFile)).Msg("end of valid WAL")
+			break RECORDS
+		default:
+			return errors.Wrapf(err, "unable to decode %+q", walFileAbs)
+		}
+
+		if !done {
+			next = wr.Position()
+		}
+		recordsDecoded++
+		keys := make([]structs.IOCacheKey, 0, len(rec.Blocks))
+		for _, blk := range rec.Blocks {
+			blocksMatched++
+
+			ioCacheKey := structs.IOCacheKey{
+				Tablespace: blk.Tablespace,
+				Database:   blk.Database,
+				Relation:   blk.Relation,
+				Fork:       blk.Fork,
+				Block:      blk.Block,
+			}
+			keys = append(keys, ioCacheKey)
+
+			// Redo restores or initializes the page without reading it
+			if !blk.NeedsRead() {
+				fpwSkipped++
+				fpwSkippedBlocks.Add(1)
+				continue
+			}
+
+			// NOTE(seanc@): PostgreSQL uses database ID 0 for some system catalog
+			// activity, notably CREATE DATABASE.  See _WalDumpParser.parse().
+			if blk.Database == 0 && blk.Tablespace != pg.GlobalTablespaceOID {
+				continue
+			}
+
+			if wc.prefaultBlock(ioCacheKey, rec.LSN) {
+				ioCacheHit++
+			} else {
+				ioCacheMiss++
+			}
+		}
+
+		for _, ioCacheKey := range nativeImplicitReads(wr.Major(), rec, keys) {
+			implicitReadCount++
+			if wc.prefaultImplicitRead(ioCacheKey, rec.LSN) {
+				ioCacheHit++
+			} else {
+				ioCacheMiss++
+			}
+		}
+
+		switch events, err := rec.RelationEvents(); {
+		case err != nil:
+			log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to decode relation events")
+		case len(events) > 0:
+			relEvents += uint64(len(events))
+			wc.invalidateRelations(rec.LSN, events)
+		}
+
+		switch dbCopy, ok, err := rec.DatabaseCopy(); {
+		case err != nil:
+			log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to decode database copy")
+		case ok:
+			wc.prefaultDatabase(rec.LSN, dbCopy)
+		}
+
+		pages, err := rec.SLRUPages()
+		if err != nil {
+			log.Debug().Err(err).Str("walfile", string(walFile)).Msg("unable to decode SLRU pages")
+		}
+		for _, page := range pages {
+			slruPageCount++
+			if wc.prefaultSLRUPage(page, rec.LSN) {
+				ioCacheHit++
+			} else {
+				ioCacheMiss++
+			}
+		}
+	}
+
+	// Archived segments are complete and are never tailed.
+	if next < segmentEnd(walFile) && !src.archived {
+		wc.setWALTail(walFile, _WALTail{next: next, modTime: fi.ModTime()})
+	} else {
+		wc.clearWALTail(walFile)
+	}
+
+	log.Debug().
+		Str("walfile", string(walFile)).
+		Str("next", next.String()).
+		Uint64("pg-major", wr.Major()).
+		Uint64("records-decoded", recordsDecoded).
+		Uint64("blocks-matched", blocksMatched).
+		Uint64("fpw-skipped", fpwSkipped).
+		Uint64("iocache-hit", ioCacheHit).
+		Uint64("iocache-miss", ioCacheMiss).
+		Uint64("relation-events", relEvents).
+		Uint64("slru-pages", slruPageCount).
+		Uint64("implicit-reads", implicitReadCount).
+		Msg("decoded WAL file")
+
+	return nil
+}
+
+// continueWALFile opens the WAL segment following walFile in order to finish
+// decoding a record that spans both segments.
+func (wc *WALCache) continueWALFile(wr *pg.WALReader, walFile pg.WALFilename) (*pg.WALRecord, error) {
+	timelineID, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse WAL filename")
+	}
+
+	nextWALFile := lsn.AddBytes(pg.WALSegmentSize).WALFilename(timelineID)
+	src, err := wc.locateWALFile(nextWALFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to find next WAL file %+q", nextWALFile)
+	}
+
+	r, err := src.open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open next WAL file %+q", nextWALFile)
+	}
+	defer r.Close()
+
+	return wr.Continue(r)
+}
+
+// segmentEnd returns the LSN immediately following walFile.
+func segmentEnd(walFile pg.WALFilename) pg.LSN {
+	_, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		return pg.InvalidLSN
+	}
+
+	return (lsn - 1).AddBytes(pg.WALSegmentSize)
+}
@@ -0,0 +1,568 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+)
+
+// Input to parse: rel 1663/16394/1249 fork vm blk 29
+//                     ^^^^ ---------------------------- Tablespace ID
+//                          ^^^^^ ---------------------- Database ID
+//                                ^^^^ ----------------- Relation ID
+//                                          ^^ --------- Fork name (optional)
+//                                                  ^^ - Block Number
+//
+// A trailing " FPW" means the record carries a full-page image of the block
+// (see fpwIdx).
+var pgWalDumpRE = regexp.MustCompile(`rel (?P<tablespace>[\d]+)/(?P<database>[\d]+)/(?P<relation>[\d]+) (?:fork (?P<fork>[^\s]+) )?blk (?P<block>[\d]+)(?P<fpw> FPW(?: for WAL verification)?)?`)
+
+// pgWalDumpLSNRE extracts the LSN of the record from a line of pg_waldump(1)
+// output (e.g. "lsn: 0/03000080").
+var pgWalDumpLSNRE = regexp.MustCompile(`lsn: ([0-9A-F]+/[0-9A-F]+)`)
+
+// https://github.com/snaga/waldump
+//
+// [cur:CC/DFFF7C8, xid:448891062, rmid:11(Btree), len/tot_len:66/98, info:0, prev:C3/4FFF758] insert_leaf: s/d/r:1663/16385/16442 tid 1317010/91
+// [cur:C4/70, xid:450806558, rmid:10(Heap), len/tot_len:737/769, info:0, prev:C4/20] insert: s/d/r:1663/16385/16431 blk/off:32400985/3 header: t_infomask2 12 t_infomask 2051 t_hoff 32
+var waldumpRE = regexp.MustCompile(`s/d/r:(?P<tablespace>[\d]+)/(?P<database>[\d]+)/(?P<relation>[\d]+) (?:tid |blk/off:)(?P<block>[\d]+)`)
+
+// waldumpLSNRE extracts the LSN of the record from a line of waldump output
+// (e.g. "[cur:C4/70,").
+var waldumpLSNRE = regexp.MustCompile(`\[cur:([0-9A-F]+/[0-9A-F]+)`)
+
+// Input to parse: rel 1663/16394/1249, fork 2, blk 29
+//                     ^^^^ ---------------------------- Tablespace ID
+//                          ^^^^^ ---------------------- Database ID
+//                                ^^^^ ----------------- Relation ID
+//                                           ^ --------- Fork number (optional)
+//                                                  ^^ - Block Number
+//
+// pg_waldump(1) from PostgreSQL 16 separates the fields of a block reference
+// with commas and prints the fork number instead of its name.
+var pg16WalDumpRE = regexp.MustCompile(`rel (?P<tablespace>[\d]+)/(?P<database>[\d]+)/(?P<relation>[\d]+)(?:, fork (?P<fork>[\d]+))?, blk (?P<block>[\d]+)(?P<fpw> FPW(?: for WAL verification)?)?`)
+
+// pgWalDumpStorageRE matches the Storage records that create or truncate a
+// relation fork.  PostgreSQL 9.5 does not log which forks are truncated.
+//
+// rmgr: Storage     len (rec/tot):     42/    42, tx:          0, lsn: 0/03000888, prev 0/03000840, desc: CREATE base/16384/16385
+// rmgr: Storage     len (rec/tot):     46/    46, tx:          0, lsn: 0/030008B8, prev 0/03000888, desc: TRUNCATE base/16384/16385 to 10 blocks flags 7
+var pgWalDumpStorageRE = regexp.MustCompile(`^rmgr: Storage .*desc: (?:CREATE (?P<create>[^\s]+)|TRUNCATE (?P<truncate>[^\s]+) to (?P<blocks>[\d]+) blocks(?: flags (?P<flags>[\d]+))?)`)
+
+// pgWalDumpXactRelsRE matches the relations dropped by a Transaction commit or
+// abort record.  PREPARE records list the relations as "rels(commit):" and
+// "rels(abort):" and are not matched.
+//
+// rmgr: Transaction len (rec/tot):    133/   133, tx:        743, lsn: 0/03004168, prev 0/03004120, desc: COMMIT 2024-05-14 09:12:45.106102 UTC; rels: base/13580/16384 base/13580/16387; inval msgs: catcache 51 relcache 16384
+var pgWalDumpXactRelsRE = regexp.MustCompile(`^rmgr: Transaction .*desc: (?:COMMIT|ABORT).*?; rels:(?P<rels>(?: [^\s;]+)+)`)
+
+// pgWalDumpDatabaseRE matches the Database records of databases created by
+// copying the template's directory.  Before 15 the record is named CREATE and
+// prints the database before the tablespace.
+//
+// rmgr: Database    len (rec/tot):     42/    42, tx:        995, lsn: 0/03000768, prev 0/030006F8, desc: CREATE copy dir 1/1663 to 16384/1663
+var pgWalDumpDatabaseRE = regexp.MustCompile(`^rmgr: Database .*desc: CREATE copy dir (?P<srcdb>[\d]+)/(?P<srcspc>[\d]+) to (?P<db>[\d]+)/(?P<spc>[\d]+)`)
+
+// pgWalDumpDatabaseFileCopyRE matches the same records since 15, where the
+// record is named CREATE_FILE_COPY and prints the tablespace before the
+// database.  Databases created with STRATEGY WAL_LOG (CREATE_WAL_LOG) are
+// replayed from the WAL and are not matched.
+//
+// rmgr: Database    len (rec/tot):     42/    42, tx:        995, lsn: 0/03000768, prev 0/030006F8, desc: CREATE_FILE_COPY copy dir 1663/1 to 1663/16384
+var pgWalDumpDatabaseFileCopyRE = regexp.MustCompile(`^rmgr: Database .*desc: CREATE_FILE_COPY copy dir (?P<srcspc>[\d]+)/(?P<srcdb>[\d]+) to (?P<spc>[\d]+)/(?P<db>[\d]+)`)
+
+// pgWalDumpXactRE matches the transaction and subtransactions whose commit
+// status is set by a Transaction COMMIT or ABORT record.  The XID of a prepared
+// transaction is printed in front of the commit timestamp, e.g.:
+//
+// rmgr: Transaction len (rec/tot):     46/    46, tx:          0, lsn: 0/030004D8, prev 0/030004A0, desc: COMMIT_PREPARED 1001: 2017-09-30 17:23:38.416563 UTC; subxacts: 1002 1003
+var pgWalDumpXactRE = regexp.MustCompile(`^rmgr: Transaction .*tx: +(?P<xid>[\d]+),.*desc: (?:COMMIT|ABORT)(?:_PREPARED)? (?:(?P<twophase>[\d]+): )?(?:.*?; subxacts:(?P<subxacts>(?: [\d]+)+))?`)
+
+// pgWalDumpXactAssignmentRE matches the subtransactions assigned to a top-level
+// transaction by a Transaction ASSIGNMENT record.
+var pgWalDumpXactAssignmentRE = regexp.MustCompile(`^rmgr: Transaction .*desc: ASSIGNMENT xtop [\d]+: subxacts:(?P<subxacts>(?: [\d]+)+)`)
+
+// pgWalDumpMultiXactRE matches a MultiXact CREATE_ID record.
+var pgWalDumpMultiXactRE = regexp.MustCompile(`^rmgr: MultiXact .*desc: CREATE_ID (?P<multi>[\d]+) offset (?P<offset>[\d]+) nmembers (?P<nmembers>[\d]+)`)
+
+// pgWalDumpHeapLockRE matches the locker of a Heap LOCK or Heap2 LOCK_UPDATED
+// record.  The locker is a MultiXactId if the record's infobits include
+// IS_MULTI.  pg_waldump(1) 16+ separates the fields with colons and commas.
+var pgWalDumpHeapLockRE = regexp.MustCompile(`^rmgr: Heap2? .*desc: LOCK(?:_UPDATED)? .*?(?:xid|xmax):? (?P<xmax>[\d]+)`)
+
+// pgWalDumpVersionRE extracts the version from the output of
+// `pg_waldump --version` (e.g. "pg_waldump (PostgreSQL) 13.4").
+var pgWalDumpVersionRE = regexp.MustCompile(`\(PostgreSQL\) ([0-9][^\s]*)`)
+
+// _WalDumpParser extracts the LSN and block references from a line of output
+// of a particular flavor of pg_waldump(1).
+type _WalDumpParser struct {
+	name  string
+	re    *regexp.Regexp
+	lsnRE *regexp.Regexp
+
+	// Submatch indexes of the named capture groups in re.  The fork is
+	// optional and not reported by all variants of pg_waldump(1).
+	tablespaceIdx int
+	databaseIdx   int
+	relationIdx   int
+	forkIdx       int
+	blockIdx      int
+
+	// fpwIdx is the index of the optional full-page image annotation of a
+	// block reference, or -1 if the format doesn't report them.  pg_waldump(1)
+	// 15+ prints "FPW for WAL verification" for images that redo does not
+	// apply.  Earlier releases print "FPW" for both, but images only taken
+	// for wal_consistency_checking are rare outside of development.
+	fpwIdx int
+
+	// storageRecords is set if the format reports the creation, truncation and
+	// dropping of relations (see pg.RelationEvent) and the creation of
+	// databases (see pg.DatabaseCopy).
+	storageRecords bool
+
+	// transactionRecords is set if the format reports the transactions,
+	// subtransactions and multixacts of Transaction, MultiXact and heap lock
+	// records (see pg.SLRUPage).
+	transactionRecords bool
+}
+
+func newWalDumpParser(name string, re, lsnRE *regexp.Regexp) *_WalDumpParser {
+	return &_WalDumpParser{
+		name:  name,
+		re:    re,
+		lsnRE: lsnRE,
+
+		tablespaceIdx: re.SubexpIndex("tablespace"),
+		databaseIdx:   re.SubexpIndex("database"),
+		relationIdx:   re.SubexpIndex("relation"),
+		forkIdx:       re.SubexpIndex("fork"),
+		blockIdx:      re.SubexpIndex("block"),
+		fpwIdx:        re.SubexpIndex("fpw"),
+	}
+}
+
+// withStorageRecords enables parsing the Storage, Transaction and Database
+// records printed by pg_waldump(1).
+func (p *_WalDumpParser) withStorageRecords() *_WalDumpParser {
+	p.storageRecords = true
+	return p
+}
+
+// withTransactionRecords marks the format as reporting the transactions,
+// subtransactions and multixacts used to prefault SLRU pages.
+func (p *_WalDumpParser) withTransactionRecords() *_WalDumpParser {
+	p.transactionRecords = true
+	return p
+}
+
+var (
+	// pgWalDumpParser handles pg_xlogdump(1) from 9.5 and 9.6 and pg_waldump(1)
+	// from 10 through 15.
+	pgWalDumpParser = newWalDumpParser("pg", pgWalDumpRE, pgWalDumpLSNRE).withStorageRecords().withTransactionRecords()
+
+	// pg16WalDumpParser handles pg_waldump(1) from 16 onward.
+	pg16WalDumpParser = newWalDumpParser("pg16", pg16WalDumpRE, pgWalDumpLSNRE).withStorageRecords().withTransactionRecords()
+
+	// xlogWalDumpParser handles https://github.com/snaga/waldump.
+	xlogWalDumpParser = newWalDumpParser("xlog", waldumpRE, waldumpLSNRE)
+)
+
+// walDumpParsers is the registry of parsers for the output of pg_waldump(1),
+// keyed by the major version of pg_waldump(1) (see pg.ParseMajorVersion()).
+var walDumpParsers = map[uint64]*_WalDumpParser{
+	90500:  pgWalDumpParser,
+	90600:  pgWalDumpParser,
+	100000: pgWalDumpParser,
+	110000: pgWalDumpParser,
+	120000: pgWalDumpParser,
+	130000: pgWalDumpParser,
+	140000: pgWalDumpParser,
+	150000: pgWalDumpParser,
+	160000: pg16WalDumpParser,
+	170000: pg16WalDumpParser,
+}
+
+// lookupWalDumpParser returns the parser for the output of pg_waldump(1) from
+// the given major version.  A release newer than any in walDumpParsers uses
+// the parser of the newest known release and exact is false.
+func lookupWalDumpParser(major uint64) (parser *_WalDumpParser, exact bool, err error) {
+	if parser, found := walDumpParsers[major]; found {
+		return parser, true, nil
+	}
+
+	majors := make([]uint64, 0, len(walDumpParsers))
+	for known := range walDumpParsers {
+		majors = append(majors, known)
+	}
+	sort.Slice(majors, func(i, j int) bool { return majors[i] < majors[j] })
+
+	if newest := majors[len(majors)-1]; major > newest {
+		return walDumpParsers[newest], false, nil
+	}
+
+	return nil, false, fmt.Errorf("unsupported pg_waldump(1) version: %s", pg.MajorVersionString(major))
+}
+
+// walDumpVersion runs `pg_waldump --version` and returns the major version of
+// pg_waldump(1) at walDumpPath.
+func walDumpVersion(ctx context.Context, walDumpPath string) (uint64, error) {
+	out, err := exec.CommandContext(ctx, walDumpPath, "--version").Output()
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to run %q --version", walDumpPath)
+	}
+
+	matches := pgWalDumpVersionRE.FindSubmatch(bytes.TrimSpace(out))
+	if matches == nil {
+		return 0, fmt.Errorf("unable to find the version of %q in %q", walDumpPath, out)
+	}
+
+	major, err := pg.ParseMajorVersion(string(matches[1]))
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to parse the version of %q", walDumpPath)
+	}
+
+	return major, nil
+}
+
+// _WalDumpRecord is a single WAL record as parsed from pg_waldump(1).
+type _WalDumpRecord struct {
+	// lsn is the LSN of the record, or math.MaxUint64 if it could not be parsed.
+	lsn    pg.LSN
+	hasLSN bool
+
+	// blocks are the blocks referenced by the record.
+	blocks []_WalDumpBlock
+
+	// events are the changes to relation files logged by the record.
+	events []pg.RelationEvent
+
+	// dbCopy is set if the record creates a database by copying its template
+	// (see hasDBCopy).
+	dbCopy    pg.DatabaseCopy
+	hasDBCopy bool
+
+	// slruPages are the SLRU pages read when the record is replayed.
+	slruPages []pg.SLRUPage
+}
+
+// _WalDumpBlock is a block reference of a _WalDumpRecord.
+type _WalDumpBlock struct {
+	key structs.IOCacheKey
+
+	// fpw is set if redo restores the block from a full-page image contained
+	// in the record.  The block does not need to be read.
+	fpw bool
+}
+
+// parse parses a single line of pg_waldump(1) output.  matched is false if the
+// line did not contain any block references, relation events or database
+// copies.
+func (p *_WalDumpParser) parse(line []byte) (rec _WalDumpRecord, matched bool) {
+	// Records without a parsable LSN are scheduled behind everything else.
+	rec.lsn = pg.LSN(math.MaxUint64)
+	if lsnMatches := p.lsnRE.FindSubmatch(line); lsnMatches != nil {
+		lsn, err := pg.ParseLSN(string(lsnMatches[1]))
+		if err != nil {
+			log.Debug().Err(err).Str("input", string(lsnMatches[1])).Msg("unable to convert LSN")
+		} else {
+			rec.lsn, rec.hasLSN = lsn, true
+		}
+	}
+
+	if p.storageRecords {
+		rec.events = parseRelationEvents(line)
+		rec.dbCopy, rec.hasDBCopy = parseDatabaseCopy(line)
+	}
+
+	if p.transactionRecords {
+		rec.slruPages = parseSLRUPages(line)
+	}
+
+	submatches := p.re.FindAllSubmatch(line, -1)
+	if submatches == nil {
+		return rec, len(rec.events) > 0 || rec.hasDBCopy || len(rec.slruPages) > 0
+	}
+
+	rec.blocks = make([]_WalDumpBlock, 0, len(submatches))
+	for _, matches := range submatches {
+		tablespace, err := strconv.ParseUint(string(matches[p.tablespaceIdx]), 10, 64)
+		if err != nil {
+			log.Error().Err(err).Str("input", string(matches[p.tablespaceIdx])).Msg("unable to convert tablespace")
+			continue
+		}
+
+		database, err := strconv.ParseUint(string(matches[p.databaseIdx]), 10, 64)
+		if err != nil {
+			log.Error().Err(err).Str("input", string(matches[p.databaseIdx])).Msg("unable to convert database")
+			continue
+		}
+
+		// NOTE(seanc@): PostgreSQL uses database ID 0 for some system catalog
+		// activity, notably CREATE DATABASE.  Shared catalogs live in the
+		// pg_global tablespace and are prefaulted from PGDATA/global.  The
+		// template copied by CREATE DATABASE is prefaulted from its Database
+		// record (see parseDatabaseCopy()).
+		//
+		// rmgr: XLOG        len (rec/tot):     30/    30, tx:          0, lsn: 0/03000060, prev 0/03000028, desc: NEXTOID 24576
+		// rmgr: Heap        len (rec/tot):     54/  1222, tx:        995, lsn: 0/03000080, prev 0/03000060, desc: INSERT off 4, blkref #0: rel 1664/0/1262 blk 0 FPW
+		// rmgr: Btree       len (rec/tot):     53/   197, tx:        995, lsn: 0/03000548, prev 0/03000080, desc: INSERT_LEAF off 4, blkref #0: rel 1664/0/2671 blk 1 FPW
+		// rmgr: Btree       len (rec/tot):     53/   173, tx:        995, lsn: 0/03000610, prev 0/03000548, desc: INSERT_LEAF off 4, blkref #0: rel 1664/0/2672 blk 1 FPW
+		// rmgr: Standby     len (rec/tot):     54/    54, tx:          0, lsn: 0/030006C0, prev 0/03000610, desc: RUNNING_XACTS nextXid 996 latestCompletedXid 994 oldestRunningXid 995; 1 xacts: 995
+		// rmgr: XLOG        len (rec/tot):    106/   106, tx:          0, lsn: 0/030006F8, prev 0/030006C0, desc: CHECKPOINT_ONLINE redo 0/30006C0; tli 1; prev tli 1; fpw true; xid 0:996; oid 24576; multi 1; offset 0; oldest xid 988 in DB 1; oldest multi 1 in DB 1; oldest/newest commit timestamp xid: 0/0; oldest running xid 995; online
+		// rmgr: Database    len (rec/tot):     42/    42, tx:        995, lsn: 0/03000768, prev 0/030006F8, desc: CREATE copy dir 1/1663 to 16384/1663
+		// rmgr: Standby     len (rec/tot):     54/    54, tx:          0, lsn: 0/03000798, prev 0/03000768, desc: RUNNING_XACTS nextXid 996 latestCompletedXid 994 oldestRunningXid 995; 1 xacts: 995
+		// rmgr: XLOG        len (rec/tot):    106/   106, tx:          0, lsn: 0/030007D0, prev 0/03000798, desc: CHECKPOINT_ONLINE redo 0/3000798; tli 1; prev tli 1; fpw true; xid 0:996; oid 24576; multi 1; offset 0; oldest xid 988 in DB 1; oldest multi 1 in DB 1; oldest/newest commit timestamp xid: 0/0; oldest running xid 995; online
+		// rmgr: Transaction len (rec/tot):     66/    66, tx:        995, lsn: 0/03000840, prev 0/030007D0, desc: COMMIT 2017-09-30 17:23:38.416563 UTC; inval msgs: catcache 21; sync
+		// rmgr: Storage     len (rec/tot):     42/    42, tx:          0, lsn: 0/03000888, prev 0/03000840, desc: CREATE base/16384/16385
+		if database == 0 && pg.OID(tablespace) != pg.GlobalTablespaceOID {
+			continue
+		}
+
+		relation, err := strconv.ParseUint(string(matches[p.relationIdx]), 10, 64)
+		if err != nil {
+			log.Error().Err(err).Str("input", string(matches[p.relationIdx])).Msg("unable to convert relation")
+			continue
+		}
+
+		fork := pg.MainForkNum
+		if p.forkIdx > 0 && len(matches[p.forkIdx]) > 0 {
+			fork, err = pg.ParseForkName(string(matches[p.forkIdx]))
+			if err != nil {
+				log.Error().Err(err).Str("input", string(matches[p.forkIdx])).Msg("unable to convert fork")
+				continue
+			}
+		}
+
+		block, err := strconv.ParseUint(string(matches[p.blockIdx]), 10, 64)
+		if err != nil {
+			log.Error().Err(err).Str("input", string(matches[p.blockIdx])).Msg("unable to convert block")
+			continue
+		}
+
+		rec.blocks = append(rec.blocks, _WalDumpBlock{
+			key: structs.IOCacheKey{
+				Tablespace: pg.OID(tablespace),
+				Database:   pg.OID(database),
+				Relation:   pg.OID(relation),
+				Fork:       fork,
+				Block:      pg.HeapBlockNumber(block),
+			},
+			fpw: p.fpwIdx > 0 && string(matches[p.fpwIdx]) == " FPW",
+		})
+	}
+
+	return rec, true
+}
+
+// parseRelationEvents returns the relation events of a Storage or Transaction
+// record printed by pg_waldump(1).
+func parseRelationEvents(line []byte) []pg.RelationEvent {
+	if matches := pgWalDumpStorageRE.FindSubmatch(line); matches != nil {
+		if create := matches[pgWalDumpStorageRE.SubexpIndex("create")]; len(create) > 0 {
+			rnode, fork, err := pg.ParseRelationPath(string(create))
+			if err != nil {
+				log.Debug().Err(err).Str("input", string(line)).Msg("unable to parse created relation")
+				return nil
+			}
+
+			return []pg.RelationEvent{{Kind: pg.RelationCreate, RelFileNode: rnode, Fork: fork}}
+		}
+
+		rnode, _, err := pg.ParseRelationPath(string(matches[pgWalDumpStorageRE.SubexpIndex("truncate")]))
+		if err != nil {
+			log.Debug().Err(err).Str("input", string(line)).Msg("unable to parse truncated relation")
+			return nil
+		}
+
+		blocks, err := strconv.ParseUint(string(matches[pgWalDumpStorageRE.SubexpIndex("blocks")]), 10, 32)
+		if err != nil {
+			log.Debug().Err(err).Str("input", string(line)).Msg("unable to convert truncated blocks")
+			return nil
+		}
+
+		// PostgreSQL 9.5 always truncates every fork.
+		flags := uint64(math.MaxUint32)
+		if flagsMatch := matches[pgWalDumpStorageRE.SubexpIndex("flags")]; len(flagsMatch) > 0 {
+			if flags, err = strconv.ParseUint(string(flagsMatch), 10, 32); err != nil {
+				log.Debug().Err(err).Str("input", string(line)).Msg("unable to convert truncate flags")
+				return nil
+			}
+		}
+
+		return pg.SMGRTruncateEvents(rnode, pg.HeapBlockNumber(blocks), uint32(flags))
+	}
+
+	matches := pgWalDumpXactRelsRE.FindSubmatch(line)
+	if matches == nil {
+		return nil
+	}
+
+	var events []pg.RelationEvent
+	for _, relPath := range bytes.Fields(matches[pgWalDumpXactRelsRE.SubexpIndex("rels")]) {
+		rnode, _, err := pg.ParseRelationPath(string(relPath))
+		if err != nil {
+			log.Debug().Err(err).Str("input", string(relPath)).Msg("unable to parse dropped relation")
+			continue
+		}
+		events = append(events, pg.DropEvents(rnode)...)
+	}
+
+	return events
+}
+
+// parseDatabaseCopy returns the database copied by a Database CREATE record
+// printed by pg_waldump(1).
+func parseDatabaseCopy(line []byte) (dbCopy pg.DatabaseCopy, ok bool) {
+	re := pgWalDumpDatabaseFileCopyRE
+	matches := re.FindSubmatch(line)
+	if matches == nil {
+		re = pgWalDumpDatabaseRE
+		if matches = re.FindSubmatch(line); matches == nil {
+			return pg.DatabaseCopy{}, false
+		}
+	}
+
+	oids := make(map[string]pg.OID, 4)
+	for _, name := range []string{"srcdb", "srcspc", "db", "spc"} {
+		oid, err := strconv.ParseUint(string(matches[re.SubexpIndex(name)]), 10, 32)
+		if err != nil {
+			log.Debug().Err(err).Str("input", string(line)).Msg("unable to parse database copy")
+			return pg.DatabaseCopy{}, false
+		}
+		oids[name] = pg.OID(oid)
+	}
+
+	return pg.DatabaseCopy{
+		SrcTablespace: oids["srcspc"],
+		SrcDatabase:   oids["srcdb"],
+		Tablespace:    oids["spc"],
+		Database:      oids["db"],
+	}, true
+}
+
+// parseSLRUPages returns the SLRU pages read when a Transaction, MultiXact or
+// heap lock record printed by pg_waldump(1) is replayed.  See
+// pg.WALRecord.SLRUPages().
+func parseSLRUPages(line []byte) []pg.SLRUPage {
+	var pages []pg.SLRUPage
+	add := func(page pg.SLRUPage) {
+		if len(pages) == 0 || pages[len(pages)-1] != page {
+			pages = append(pages, page)
+		}
+	}
+	parseUint32 := func(b []byte) (uint32, bool) {
+		v, err := strconv.ParseUint(string(b), 10, 32)
+		if err != nil {
+			log.Debug().Err(err).Str("input", string(line)).Msg("unable to parse transaction record")
+			return 0, false
+		}
+		return uint32(v), true
+	}
+	parseXIDs := func(b []byte, page func(pg.TransactionID) pg.SLRUPage) bool {
+		for _, field := range bytes.Fields(b) {
+			xid, ok := parseUint32(field)
+			if !ok {
+				return false
+			}
+			add(page(pg.TransactionID(xid)))
+		}
+		return true
+	}
+
+	switch {
+	case bytes.HasPrefix(line, []byte("rmgr: Transaction ")):
+		if matches := pgWalDumpXactAssignmentRE.FindSubmatch(line); matches != nil {
+			if !parseXIDs(matches[pgWalDumpXactAssignmentRE.SubexpIndex("subxacts")], pg.SubtransPage) {
+				return nil
+			}
+			return pages
+		}
+
+		matches := pgWalDumpXactRE.FindSubmatch(line)
+		if matches == nil {
+			return nil
+		}
+
+		// A prepared transaction is committed or aborted on behalf of the
+		// transaction that prepared it.
+		xidMatch := matches[pgWalDumpXactRE.SubexpIndex("xid")]
+		if twophase := matches[pgWalDumpXactRE.SubexpIndex("twophase")]; len(twophase) > 0 {
+			xidMatch = twophase
+		}
+
+		xid, ok := parseUint32(xidMatch)
+		if !ok {
+			return nil
+		}
+		if pg.TransactionID(xid) != pg.InvalidTransactionID {
+			add(pg.XactPage(pg.TransactionID(xid)))
+		}
+		if !parseXIDs(matches[pgWalDumpXactRE.SubexpIndex("subxacts")], pg.XactPage) {
+			return nil
+		}
+	case bytes.HasPrefix(line, []byte("rmgr: MultiXact ")):
+		matches := pgWalDumpMultiXactRE.FindSubmatch(line)
+		if matches == nil {
+			return nil
+		}
+
+		multi, ok := parseUint32(matches[pgWalDumpMultiXactRE.SubexpIndex("multi")])
+		if !ok {
+			return nil
+		}
+		offset, ok := parseUint32(matches[pgWalDumpMultiXactRE.SubexpIndex("offset")])
+		if !ok {
+			return nil
+		}
+		nmembers, ok := parseUint32(matches[pgWalDumpMultiXactRE.SubexpIndex("nmembers")])
+		if !ok {
+			return nil
+		}
+
+		add(pg.MultiXactOffsetPage(pg.MultiXactID(multi)))
+		for _, page := range pg.MultiXactMemberPages(pg.MultiXactOffset(offset), nmembers) {
+			add(page)
+		}
+	case bytes.HasPrefix(line, []byte("rmgr: Heap")):
+		matches := pgWalDumpHeapLockRE.FindSubmatch(line)
+		if matches == nil {
+			return nil
+		}
+
+		xmax, ok := parseUint32(matches[pgWalDumpHeapLockRE.SubexpIndex("xmax")])
+		switch {
+		case !ok:
+			return nil
+		case bytes.Contains(line, []byte("IS_MULTI")):
+			add(pg.MultiXactOffsetPage(pg.MultiXactID(xmax)))
+		case pg.TransactionID(xmax) != pg.InvalidTransactionID:
+			add(pg.XactPage(pg.TransactionID(xmax)))
+		}
+	}
+
+	return pages
+}
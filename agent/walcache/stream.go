@@ -0,0 +1,189 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+)
+
+// _WALStream is a single long-lived pg_waldump(1) decoding the WAL between the
+// replay LSN and the end of the readahead window.
+type _WALStream struct {
+	// lastLSN is the LSN of the last record decoded.  Accessed atomically.
+	lastLSN uint64
+
+	timelineID pg.TimelineID
+	start      pg.LSN
+	end        pg.LSN
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// complete is set before done is closed if pg_waldump(1) decoded the
+	// entire range.
+	complete bool
+}
+
+// running returns true until pg_waldump(1) exits.
+func (s *_WALStream) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop terminates pg_waldump(1) and waits for the stream to finish.
+func (s *_WALStream) stop() {
+	s.cancel()
+	<-s.done
+}
+
+// Streaming returns true if WAL is prefaulted by a single pg_waldump(1) over
+// the readahead window (see StreamWAL()) instead of once per WAL file.
+func (wc *WALCache) Streaming() bool {
+	return wc.cfg.Stream
+}
+
+// StreamWAL prefaults the blocks referenced by the WAL between start and end on
+// timelineID using a single pg_waldump(1).  StreamWAL is called as the
+// readahead window advances: a running pg_waldump(1) that already covers end
+// is left alone, otherwise it is restarted from the last record it decoded
+// (or start, whichever is later) through the new end.
+func (wc *WALCache) StreamWAL(timelineID pg.TimelineID, start, end pg.LSN) error {
+	wc.streamLock.Lock()
+	defer wc.streamLock.Unlock()
+
+	if s := wc.stream; s != nil {
+		if s.timelineID == timelineID {
+			if end <= s.end && (s.running() || s.complete) {
+				return nil
+			}
+
+			if lastLSN := pg.LSN(atomic.LoadUint64(&s.lastLSN)); lastLSN != 0 && lastLSN+1 > start {
+				start = lastLSN + 1
+			}
+		}
+
+		s.stop()
+		wc.stream = nil
+	}
+
+	if start >= end {
+		return nil
+	}
+
+	walDump, err := wc.currentWalDump()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(wc.pgConnCtxAcquirer.AcquireConnContext())
+	s := &_WALStream{
+		timelineID: timelineID,
+		start:      start,
+		end:        end,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+
+	walDir := path.Join(wc.cfg.PGDataPath, wc.walTranslations.Directory)
+	cmd := exec.CommandContext(ctx, walDump.path,
+		"-p", walDir,
+		"-t", strconv.FormatUint(uint64(timelineID), 10),
+		"-s", start.String(),
+		"-e", end.String())
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+
+	dumpOutReader, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return errors.Wrapf(err, "unable to open stdout for pg_waldump(1)")
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return errors.Wrapf(err, "unable to start pg_waldump(1): %q", errbuf.String())
+	}
+
+	log.Debug().
+		Uint32("timeline-id", uint32(timelineID)).
+		Str("start", start.String()).
+		Str("end", end.String()).
+		Msg("streaming WAL")
+
+	// The goroutine is tracked by s.done rather than wc.wg, which Wait() may
+	// already be waiting on.  Wait() stops the stream.
+	wc.stream = s
+	go func() {
+		defer close(s.done)
+		defer cancel()
+
+		var stats _WalDumpStats
+		scanner := bufio.NewScanner(dumpOutReader)
+		for scanner.Scan() {
+			if lsn, ok := wc.prefaultWalDumpLine(walDump, scanner.Bytes(), &stats); ok {
+				atomic.StoreUint64(&s.lastLSN, uint64(lsn))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Warn().Err(err).Str("stderr", errbuf.String()).Msg("scanning output")
+		}
+
+		waitErr := cmd.Wait()
+		s.complete = waitErr == nil
+
+		// pg_waldump(1) exits with an error when it reaches the end of the WAL
+		// received so far, which is expected while streaming.  Only complain if
+		// not a single record was decoded.
+		event := log.Debug()
+		if waitErr != nil && ctx.Err() == nil && atomic.LoadUint64(&s.lastLSN) == 0 {
+			event = log.Warn()
+		}
+		event.Err(waitErr).
+			Str("pg_waldump-path", walDump.path).
+			Str("start", start.String()).
+			Str("end", end.String()).
+			Str("last-lsn", pg.LSN(atomic.LoadUint64(&s.lastLSN)).String()).
+			Str("stderr", errbuf.String()).
+			Dict("stats", stats.dict()).
+			Msg("pg_waldump(1) stream exited")
+	}()
+
+	return nil
+}
+
+// StopStream terminates the running pg_waldump(1) stream, if any, and waits
+// for it to exit.  It is called when there is no longer any WAL to read ahead
+// of PostgreSQL and on shutdown.
+func (wc *WALCache) StopStream() {
+	wc.streamLock.Lock()
+	defer wc.streamLock.Unlock()
+
+	if wc.stream != nil {
+		wc.stream.stop()
+		wc.stream = nil
+	}
+}
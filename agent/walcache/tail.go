@@ -0,0 +1,87 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"os"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+)
+
+// _WALTail records how far a WAL segment that is still being written (i.e. by
+// the walreceiver) has been decoded.
+type _WALTail struct {
+	// next is the LSN decoding resumes from.
+	next pg.LSN
+
+	// modTime is the segment's mtime when it was last decoded.  The segment is
+	// only decoded again once it has been written to.
+	modTime time.Time
+}
+
+// changed returns true if the segment described by fi may have been written
+// to since it was last decoded.
+func (t _WALTail) changed(fi os.FileInfo) bool {
+	return !fi.ModTime().Equal(t.modTime)
+}
+
+// walTail returns the tail of walFile.  ok is false if walFile is not being
+// tailed.
+func (wc *WALCache) walTail(walFile pg.WALFilename) (tail _WALTail, ok bool) {
+	wc.tailLock.Lock()
+	defer wc.tailLock.Unlock()
+
+	tail, ok = wc.tails[walFile]
+	return tail, ok
+}
+
+// setWALTail marks walFile as in progress.  FaultWALFile() decodes walFiles
+// with a tail again from tail.next, even though they are in the cache.
+func (wc *WALCache) setWALTail(walFile pg.WALFilename, tail _WALTail) {
+	wc.tailLock.Lock()
+	defer wc.tailLock.Unlock()
+
+	wc.tails[walFile] = tail
+}
+
+// clearWALTail marks walFile as completely decoded.
+func (wc *WALCache) clearWALTail(walFile pg.WALFilename) {
+	wc.tailLock.Lock()
+	defer wc.tailLock.Unlock()
+
+	delete(wc.tails, walFile)
+}
+
+// pruneWALTails stops tailing segments that PostgreSQL has finished replaying
+// (e.g. a segment ending with an XLOG SWITCH record, which is never filled).
+func (wc *WALCache) pruneWALTails(replayLSN pg.LSN) {
+	wc.tailLock.Lock()
+	defer wc.tailLock.Unlock()
+
+	for walFile := range wc.tails {
+		_, lsn, err := pg.ParseWalfile(walFile)
+		if err != nil || (lsn-1).AddBytes(pg.WALSegmentSize) <= replayLSN {
+			delete(wc.tails, walFile)
+		}
+	}
+}
+
+// purgeWALTails forgets every tail.
+func (wc *WALCache) purgeWALTails() {
+	wc.tailLock.Lock()
+	defer wc.tailLock.Unlock()
+
+	wc.tails = make(map[pg.WALFilename]_WALTail)
+}
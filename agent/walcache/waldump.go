@@ -0,0 +1,144 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"expvar"
+	"sync/atomic"
+
+	"github.com/bschofield/pg_prefaulter/agent/structs"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/rs/zerolog"
+)
+
+// fpwSkippedBlocks counts the block references that were not prefaulted
+// because redo restores them from a full-page image.
+var fpwSkippedBlocks = expvar.NewInt("walcache-fpw-skipped")
+
+// relationEvents counts the relation creates, truncates and drops found in
+// WAL, keyed by pg.RelationEventKind.
+var relationEvents = expvar.NewMap("walcache-relation-events")
+
+// databaseCopyPages counts the pages of template databases queued for
+// prefaulting when replaying CREATE DATABASE.
+var databaseCopyPages = expvar.NewInt("walcache-database-copy-pages")
+
+// implicitReads counts the blocks prefaulted because replay reads them
+// without the record referencing them (see implicitReadRules).
+var implicitReads = expvar.NewInt("walcache-implicit-reads")
+
+// slruPages counts the SLRU pages prefaulted for transaction, multixact and
+// heap lock records, keyed by pg.SLRU.
+var slruPages = expvar.NewMap("walcache-slru-pages")
+
+// _WalDumpStats counts the work done while parsing the output of
+// pg_waldump(1).  All fields are updated atomically.
+type _WalDumpStats struct {
+	blocksMatched uint64
+	linesMatched  uint64
+	linesScanned  uint64
+	waldumpBytes  uint64
+	ioCacheHit    uint64
+	ioCacheMiss   uint64
+	fpwSkipped    uint64
+	relEvents     uint64
+	slruPages     uint64
+	implicitReads uint64
+}
+
+// dict returns the stats as a zerolog dictionary suitable for logging.
+func (s *_WalDumpStats) dict() *zerolog.Event {
+	return zerolog.Dict().
+		Uint64("blocks-matched", atomic.LoadUint64(&s.blocksMatched)).
+		Uint64("fpw-skipped", atomic.LoadUint64(&s.fpwSkipped)).
+		Uint64("implicit-reads", atomic.LoadUint64(&s.implicitReads)).
+		Uint64("iocache-hit", atomic.LoadUint64(&s.ioCacheHit)).
+		Uint64("iocache-miss", atomic.LoadUint64(&s.ioCacheMiss)).
+		Uint64("lines-matched", atomic.LoadUint64(&s.linesMatched)).
+		Uint64("lines-scanned", atomic.LoadUint64(&s.linesScanned)).
+		Uint64("pg_waldump-bytes", atomic.LoadUint64(&s.waldumpBytes)).
+		Uint64("relation-events", atomic.LoadUint64(&s.relEvents)).
+		Uint64("slru-pages", atomic.LoadUint64(&s.slruPages))
+}
+
+// prefaultWalDumpLine parses a single line of output of walDump and prefaults
+// every block referenced by it, along with the blocks replay reads implicitly
+// (see implicitReadRules).  Relations created, truncated or dropped by the
+// record are invalidated, the template of a database created by the record is
+// prefaulted, as are the SLRU pages read when the record is replayed.
+// prefaultWalDumpLine returns the LSN of the record and true if the line
+// contained a parsable LSN.
+func (wc *WALCache) prefaultWalDumpLine(walDump *_WalDump, line []byte, stats *_WalDumpStats) (pg.LSN, bool) {
+	atomic.AddUint64(&stats.waldumpBytes, uint64(len(line)))
+	atomic.AddUint64(&stats.linesScanned, 1)
+
+	rec, matched := walDump.parser.parse(line)
+	if !matched {
+		return rec.lsn, rec.hasLSN
+	}
+
+	atomic.AddUint64(&stats.linesMatched, 1)
+	atomic.AddUint64(&stats.blocksMatched, uint64(len(rec.blocks)))
+
+	for _, blk := range rec.blocks {
+		// Redo overwrites the page with the full-page image without reading it
+		if blk.fpw {
+			atomic.AddUint64(&stats.fpwSkipped, 1)
+			fpwSkippedBlocks.Add(1)
+			continue
+		}
+
+		if wc.prefaultBlock(blk.key, rec.lsn) {
+			atomic.AddUint64(&stats.ioCacheHit, 1)
+		} else {
+			atomic.AddUint64(&stats.ioCacheMiss, 1)
+		}
+	}
+
+	if len(rec.blocks) > 0 {
+		keys := make([]structs.IOCacheKey, len(rec.blocks))
+		for i, blk := range rec.blocks {
+			keys[i] = blk.key
+		}
+
+		for _, key := range walDumpImplicitReads(walDump.major, line, keys) {
+			atomic.AddUint64(&stats.implicitReads, 1)
+			if wc.prefaultImplicitRead(key, rec.lsn) {
+				atomic.AddUint64(&stats.ioCacheHit, 1)
+			} else {
+				atomic.AddUint64(&stats.ioCacheMiss, 1)
+			}
+		}
+	}
+
+	if len(rec.events) > 0 {
+		atomic.AddUint64(&stats.relEvents, uint64(len(rec.events)))
+		wc.invalidateRelations(rec.lsn, rec.events)
+	}
+
+	if rec.hasDBCopy {
+		wc.prefaultDatabase(rec.lsn, rec.dbCopy)
+	}
+
+	for _, page := range rec.slruPages {
+		atomic.AddUint64(&stats.slruPages, 1)
+		if wc.prefaultSLRUPage(page, rec.lsn) {
+			atomic.AddUint64(&stats.ioCacheHit, 1)
+		} else {
+			atomic.AddUint64(&stats.ioCacheMiss, 1)
+		}
+	}
+
+	return rec.lsn, rec.hasLSN
+}
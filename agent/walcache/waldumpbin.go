@@ -0,0 +1,144 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package walcache
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+)
+
+// _WalDump is the pg_waldump(1) used to decode WAL and the parser for its
+// output.
+type _WalDump struct {
+	path   string
+	major  uint64
+	parser *_WalDumpParser
+}
+
+// SelectWalDump selects the pg_waldump(1) matching pgMajor, the major version
+// of the cluster (see pg.ParseMajorVersion()).  SelectWalDump must be called
+// before WAL is prefaulted and again whenever the major version of the cluster
+// changes.  A pg_waldump(1) from a different major version is refused.
+// SelectWalDump is a no-op unless WAL is decoded with WALModePG.
+func (wc *WALCache) SelectWalDump(pgMajor uint64) error {
+	if wc.cfg.Mode != config.WALModePG {
+		return nil
+	}
+
+	walDumpPath, major, err := resolveWalDump(wc.shutdownCtx, wc.cfg.WalDumpPath, wc.cfg.WalDumpSearchPath, pgMajor)
+	if err != nil {
+		return err
+	}
+
+	parser, exact, err := lookupWalDumpParser(major)
+	if err != nil {
+		return err
+	}
+
+	event := log.Info()
+	if !exact {
+		event = log.Warn()
+	}
+	event.Str("pg_waldump-path", walDumpPath).
+		Str("pg_waldump-version", pg.MajorVersionString(major)).
+		Str("parser", parser.name).
+		Bool("supported", exact).
+		Msg("selected pg_waldump(1)")
+
+	wc.walDump.Store(&_WalDump{
+		path:   walDumpPath,
+		major:  major,
+		parser: parser,
+	})
+
+	return nil
+}
+
+// currentWalDump returns the selected pg_waldump(1).
+func (wc *WALCache) currentWalDump() (*_WalDump, error) {
+	walDump, _ := wc.walDump.Load().(*_WalDump)
+	if walDump == nil {
+		return nil, errors.New("no pg_waldump(1) has been selected")
+	}
+
+	return walDump, nil
+}
+
+// walDumpCandidates expands the {major} placeholder of every template in
+// searchPath for pgMajor.  pg_waldump(1) was named pg_xlogdump(1) prior to
+// PostgreSQL 10 and is renamed accordingly.
+func walDumpCandidates(searchPath []string, pgMajor uint64) []string {
+	version := pg.MajorVersionString(pgMajor)
+
+	candidates := make([]string, 0, len(searchPath))
+	for _, template := range searchPath {
+		candidate := strings.Replace(template, "{major}", version, -1)
+		if pgMajor < 100000 && path.Base(candidate) == "pg_waldump" {
+			candidate = path.Join(path.Dir(candidate), "pg_xlogdump")
+		}
+
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates
+}
+
+// resolveWalDump returns the path and major version of the pg_waldump(1)
+// matching pgMajor.  If explicitPath is set it is the only candidate,
+// otherwise the first match in searchPath is used.  Candidates without a
+// directory are looked up in $PATH.
+func resolveWalDump(ctx context.Context, explicitPath string, searchPath []string, pgMajor uint64) (string, uint64, error) {
+	version := pg.MajorVersionString(pgMajor)
+
+	candidates := []string{explicitPath}
+	if explicitPath == "" {
+		candidates = walDumpCandidates(searchPath, pgMajor)
+	}
+
+	var mismatched []string
+	for _, candidate := range candidates {
+		walDumpPath, err := exec.LookPath(candidate)
+		if err != nil {
+			log.Debug().Err(err).Str("pg_waldump-path", candidate).Msg("skipping pg_waldump(1) candidate")
+			continue
+		}
+
+		major, err := walDumpVersion(ctx, walDumpPath)
+		if err != nil {
+			log.Debug().Err(err).Str("pg_waldump-path", walDumpPath).Msg("skipping pg_waldump(1) candidate")
+			continue
+		}
+
+		if major != pgMajor {
+			mismatched = append(mismatched, fmt.Sprintf("%s (%s)", walDumpPath, pg.MajorVersionString(major)))
+			continue
+		}
+
+		return walDumpPath, major, nil
+	}
+
+	if len(mismatched) > 0 {
+		return "", 0, fmt.Errorf("pg_waldump(1) does not match PostgreSQL %s: %s", version, strings.Join(mismatched, ", "))
+	}
+
+	return "", 0, fmt.Errorf("unable to find pg_waldump(1) for PostgreSQL %s in %q", version, candidates)
+}
@@ -0,0 +1,64 @@
+package walcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestResolveWalDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg_waldump")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFakeWalDump(t, path.Join(dir, "9.6", "bin", "pg_xlogdump"), "pg_xlogdump", "9.6.24")
+	writeFakeWalDump(t, path.Join(dir, "13", "bin", "pg_waldump"), "pg_waldump", "13.14")
+	writeFakeWalDump(t, path.Join(dir, "local", "pg_waldump"), "pg_waldump", "16.2")
+
+	searchPath := []string{
+		path.Join(dir, "{major}", "bin", "pg_waldump"),
+		path.Join(dir, "local", "pg_waldump"),
+	}
+
+	tests := []struct {
+		explicit string
+		pgMajor  uint64
+		path     string
+		fail     bool
+	}{
+		{pgMajor: 90600, path: path.Join(dir, "9.6", "bin", "pg_xlogdump")},
+		{pgMajor: 130000, path: path.Join(dir, "13", "bin", "pg_waldump")},
+		{pgMajor: 160000, path: path.Join(dir, "local", "pg_waldump")},
+		{pgMajor: 150000, fail: true},
+		{explicit: path.Join(dir, "local", "pg_waldump"), pgMajor: 160000, path: path.Join(dir, "local", "pg_waldump")},
+		{explicit: path.Join(dir, "local", "pg_waldump"), pgMajor: 130000, fail: true},
+		{explicit: path.Join(dir, "missing"), pgMajor: 130000, fail: true},
+	}
+
+	for n, test := range tests {
+		walDumpPath, major, err := resolveWalDump(context.Background(), test.explicit, searchPath, test.pgMajor)
+		if test.fail {
+			if err == nil {
+				t.Fatalf("%d: expected an error, got %q", n, walDumpPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(walDumpPath, test.path); diff != "" {
+			t.Errorf("%d: path diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(major, test.pgMajor); diff != "" {
+			t.Errorf("%d: major diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
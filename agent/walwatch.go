@@ -0,0 +1,156 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/bschofield/pg_prefaulter/config"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// walFilenameRE matches the name of a WAL segment (i.e. not a .history,
+// .partial, or .backup file).
+var walFilenameRE = regexp.MustCompile(`^[0-9A-F]{24}$`)
+
+// _WALWatcher watches the WAL directory and signals when a WAL segment is
+// created or renamed into place (i.e. received or recycled).
+type _WALWatcher struct {
+	watcher *fsnotify.Watcher
+	dir     string
+
+	// newSegment is signaled, without blocking, for every new segment.  Its
+	// buffer of one coalesces bursts of events into a single wakeup.
+	newSegment chan struct{}
+}
+
+// newWALWatcher starts watching dir.  The watcher is closed when ctx is
+// cancelled.
+func newWALWatcher(ctx context.Context, dir string) (*_WALWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create a WAL directory watcher")
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, errors.Wrapf(err, "unable to watch %+q", dir)
+	}
+
+	w := &_WALWatcher{
+		watcher:    watcher,
+		dir:        dir,
+		newSegment: make(chan struct{}, 1),
+	}
+
+	go w.run(ctx)
+
+	return w, nil
+}
+
+func (w *_WALWatcher) run(ctx context.Context) {
+	defer w.watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			// A segment renamed into place is reported as a Create of its new name.
+			if ev.Op&fsnotify.Create == 0 || !walFilenameRE.MatchString(path.Base(ev.Name)) {
+				continue
+			}
+
+			log.Debug().Str("walfile", path.Base(ev.Name)).Msg("new WAL segment")
+
+			select {
+			case w.newSegment <- struct{}{}:
+			default:
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			// Events may have been dropped (e.g. the inotify queue overflowed).  Wake
+			// up the agent so that it rescans.
+			log.Warn().Err(err).Str("dir", w.dir).Msg("WAL directory watcher")
+
+			select {
+			case w.newSegment <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// waitForWAL blocks until it is time to look for WAL files again.  When the
+// WAL directory is watched, waitForWAL returns as soon as a new segment
+// appears, or after the watch timeout as a safety net.  Otherwise, or if the
+// watch could not be set up, waitForWAL sleeps for the poll interval.
+func (a *Agent) waitForWAL() {
+	d := viper.GetDuration(config.KeyPGPollInterval)
+
+	var newSegment <-chan struct{}
+	if w := a.ensureWALWatcher(); w != nil {
+		newSegment = w.newSegment
+		d = a.cfg.WALWatchTimeout
+	}
+
+	select {
+	case <-a.shutdownCtx.Done():
+	case <-newSegment:
+	case <-time.After(d):
+	}
+}
+
+// ensureWALWatcher lazily starts watching the WAL directory once it is known.
+// nil is returned if watching is disabled, the WAL directory is not yet known,
+// or the watch failed, in which case the agent falls back to polling.
+func (a *Agent) ensureWALWatcher() *_WALWatcher {
+	if !a.cfg.WALWatch || a.walWatchFailed {
+		return nil
+	}
+
+	if a.walWatcher != nil {
+		return a.walWatcher
+	}
+
+	if a.walTranslations.Directory == "" {
+		return nil
+	}
+
+	dir := path.Join(viper.GetString(config.KeyPGData), a.walTranslations.Directory)
+	w, err := newWALWatcher(a.shutdownCtx, dir)
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to watch the WAL directory, falling back to polling")
+		a.walWatchFailed = true
+		return nil
+	}
+
+	log.Info().Str("dir", dir).Msg("watching WAL directory")
+	a.walWatcher = w
+
+	return w
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_WALWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg_wal")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := newWALWatcher(ctx, dir)
+	if err != nil {
+		t.Skipf("unable to watch %q: %v", dir, err)
+	}
+
+	// Files other than WAL segments are ignored.
+	if err := ioutil.WriteFile(path.Join(dir, "00000002.history"), nil, 0600); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	select {
+	case <-w.newSegment:
+		t.Fatalf("unexpected wakeup for a history file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A recycled segment is renamed into place.
+	tmp := path.Join(dir, "xlogtemp.1234")
+	if err := ioutil.WriteFile(tmp, nil, 0600); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := os.Rename(tmp, path.Join(dir, "000000010000000000000003")); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	select {
+	case <-w.newSegment:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a new segment")
+	}
+}
@@ -45,30 +45,64 @@ var runCmd = &cobra.Command{
 		}
 
 		{
-			validArgs := []string{"pg", "xlog"}
+			validArgs := []string{"pg", "xlog", "native"}
 			if err := config.ValidStringArg(config.KeyXLogMode, validArgs); err != nil {
 				return errors.Wrapf(err, "%q validation", config.KeyXLogMode)
 			}
 		}
 
 		{
+			validArgs := []string{"threads", "io_uring"}
+			if err := config.ValidStringArg(config.KeyIOEngine, validArgs); err != nil {
+				return errors.Wrapf(err, "%q validation", config.KeyIOEngine)
+			}
+		}
+
+		{
+			validArgs := []string{"auto", "pread", "fadvise", "readahead", "mmap"}
+			if err := config.ValidStringArg(config.KeyPrefetchBackend, validArgs); err != nil {
+				return errors.Wrapf(err, "%q validation", config.KeyPrefetchBackend)
+			}
+		}
+
+		if viper.GetString(config.KeyXLogMode) == "xlog" && viper.GetString(config.KeyXLogPath) == "" {
+			viper.Set(config.KeyXLogPath, config.DefaultXLogWalDumpPath)
+		}
+
+		// The native WAL decoder does not need pg_waldump(1).  Without an explicit
+		// path, pg_waldump(1) is found in the search path once the version of the
+		// cluster is known.
+		if viper.GetString(config.KeyXLogMode) != "native" && viper.GetString(config.KeyXLogPath) != "" {
 			_, err := os.Stat(viper.GetString(config.KeyXLogPath))
 			if err != nil {
 				return errors.Wrapf(err, "failed to stat %s (%q)", config.KeyXLogPath, viper.GetString(config.KeyXLogPath))
 			}
 		}
 
+		if archiveDir := viper.GetString(config.KeyWALArchiveDir); archiveDir != "" {
+			if _, err := os.Stat(archiveDir); err != nil {
+				return errors.Wrapf(err, "failed to stat %s (%q)", config.KeyWALArchiveDir, archiveDir)
+			}
+		}
+
 		defer func() {
 			// FIXME(seanc@): Iterate over known viper keys and automatically log
 			// values.
 			log.Debug().
+				Bool(config.KeyPGConnectionless, viper.GetBool(config.KeyPGConnectionless)).
 				Str(config.KeyPGData, viper.GetString(config.KeyPGData)).
 				Str(config.KeyPGHost, viper.GetString(config.KeyPGHost)).
 				Uint(config.KeyPGPort, uint(viper.GetInt(config.KeyPGPort))).
 				Str(config.KeyPGUser, viper.GetString(config.KeyPGUser)).
+				Str(config.KeyIOEngine, viper.GetString(config.KeyIOEngine)).
+				Str(config.KeyPrefetchBackend, viper.GetString(config.KeyPrefetchBackend)).
 				Str(config.KeyXLogMode, viper.GetString(config.KeyXLogMode)).
 				Str(config.KeyXLogPath, viper.GetString(config.KeyXLogPath)).
+				Strs(config.KeyXLogSearchPath, viper.GetStringSlice(config.KeyXLogSearchPath)).
+				Bool(config.KeyXLogStream, viper.GetBool(config.KeyXLogStream)).
 				Dur(config.KeyPGPollInterval, viper.GetDuration(config.KeyPGPollInterval)).
+				Dur(config.KeyWALLeadTime, viper.GetDuration(config.KeyWALLeadTime)).
+				Str(config.KeyWALArchiveDir, viper.GetString(config.KeyWALArchiveDir)).
 				Msg("flags")
 		}()
 
@@ -114,6 +148,71 @@ func init() {
 		viper.SetDefault(key, defaultValue)
 	}
 
+	{
+		const (
+			key          = config.KeyLagStartBytes
+			longName     = "lag-start-bytes"
+			defaultValue = "0B"
+			description  = "Start prefaulting once replay lags this many bytes behind receive (0B ignores lag bytes)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyLagStopBytes
+			longName     = "lag-stop-bytes"
+			defaultValue = "0B"
+			description  = "Stop prefaulting once replay lags at most this many bytes behind receive"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyLagStartTime
+			longName     = "lag-start-time"
+			defaultValue = "0s"
+			description  = "Start prefaulting once the last replayed transaction is this old (0s ignores lag time)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyLagStopTime
+			longName     = "lag-stop-time"
+			defaultValue = "0s"
+			description  = "Stop prefaulting once the last replayed transaction is at most this old"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyPGConnectionless
+			longName     = "connectionless"
+			defaultValue = false
+			description  = "Never connect to the database, use pg_control and process args to find WAL files"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
 	{
 		const (
 			key          = config.KeyPGPollInterval
@@ -128,6 +227,45 @@ func init() {
 		viper.SetDefault(key, defaultValue)
 	}
 
+	{
+		const (
+			key          = config.KeyPrefetchBackend
+			longName     = "prefetch-backend"
+			defaultValue = "auto"
+			description  = `Method used to prefetch pages: "auto", "pread", "fadvise", "readahead", "mmap"`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyResidencyCheck
+			longName     = "residency-check"
+			defaultValue = false
+			description  = "Skip IOs for pages already resident in the page cache (mincore(2))"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyRevalidate
+			longName     = "residency-revalidate-interval"
+			defaultValue = "5m"
+			description  = "Interval after which a prefaulted page's residency is checked again"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
 	{
 		const (
 			key          = config.KeyRetryDBInit
@@ -140,6 +278,19 @@ func init() {
 		viper.SetDefault(key, defaultValue)
 	}
 
+	{
+		const (
+			key          = config.KeyWALArchiveDir
+			longName     = "wal-archive-dir"
+			defaultValue = ""
+			description  = "Directory of archived WAL segments (optionally gzip(1)ed) used to prefault segments not yet restored into the WAL directory"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
 	{
 		const (
 			key          = config.KeyWALReadahead
@@ -154,6 +305,123 @@ func init() {
 		viper.SetDefault(key, defaultValue)
 	}
 
+	{
+		const (
+			key          = config.KeyWALWatch
+			longName     = "wal-watch"
+			defaultValue = true
+			description  = "Watch the WAL directory with inotify(7) and prefault new segments immediately (polls if unavailable)"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALWatchWait
+			longName     = "wal-watch-timeout"
+			defaultValue = "10s"
+			description  = "Longest time to wait for a new WAL segment before polling anyway when watching the WAL directory"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyWALLeadTime
+			longName     = "wal-readahead-lead-time"
+			defaultValue = "5s"
+			description  = "Size the WAL readahead to stay this far ahead of replay, up to wal-readahead-bytes (0 always reads ahead wal-readahead-bytes)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOCoalesceSpan
+			longName     = "io-coalesce-max-span"
+			defaultValue = "128KiB"
+			description  = "Largest IO issued when merging nearby pages of a relation segment (a single page disables merging)"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOCoalesceGap
+			longName     = "io-coalesce-max-gap"
+			defaultValue = "16KiB"
+			description  = "Largest run of unrequested pages read in order to merge two IOs"
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOEngine
+			longName     = "io-engine"
+			defaultValue = "threads"
+			description  = `Engine used to perform IOs: "threads", "io_uring"`
+		)
+
+		runCmd.Flags().String(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOMaxQueued
+			longName     = "io-max-queued-pages"
+			defaultValue = 65536
+			description  = "Number of requested pages that may wait for IO before WAL decoding is throttled (0 is unbounded)"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOURingDepth
+			longName     = "io-uring-queue-depth"
+			defaultValue = 128
+			description  = "Number of IOs in flight per io_uring"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
+	{
+		const (
+			key          = config.KeyIOURingRings
+			longName     = "io-uring-rings"
+			defaultValue = 1
+			description  = "Number of io_urings to submit IOs through"
+		)
+
+		runCmd.Flags().Uint(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
 	{
 		const (
 			key          = config.KeyNumIOThreads
@@ -173,11 +441,11 @@ func init() {
 			key       = config.KeyXLogPath
 			longName  = "waldump-bin"
 			shortName = "x"
-			// TODO(seanc@): This could/should probably be a build-time constant that
-			// is platform specific.  Similarly, there should probably be a path that
-			// is independent of the binary name.
-			defaultValue = "/usr/local/bin/pg_waldump"
-			description  = "Path to pg_waldump(1)"
+			// An empty path selects the pg_waldump(1) matching the cluster's major
+			// version from the search path, or config.DefaultXLogWalDumpPath in
+			// xlog mode.
+			defaultValue = ""
+			description  = "Path to pg_waldump(1) (default: search --waldump-search-path for the cluster's major version, or " + config.DefaultXLogWalDumpPath + " in xlog-mode \"xlog\")"
 		)
 
 		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
@@ -185,16 +453,51 @@ func init() {
 		viper.SetDefault(key, defaultValue)
 	}
 
+	{
+		const (
+			key         = config.KeyXLogSearchPath
+			longName    = "waldump-search-path"
+			description = "Paths searched for the pg_waldump(1) matching the cluster's major version ({major} is replaced with the version, pg_waldump is renamed pg_xlogdump before 10)"
+		)
+
+		// TODO(seanc@): This could/should probably be a build-time constant that
+		// is platform specific.
+		defaultValue := []string{
+			"/usr/lib/postgresql/{major}/bin/pg_waldump",
+			"/usr/pgsql-{major}/bin/pg_waldump",
+			"/usr/local/pgsql/bin/pg_waldump",
+			"/usr/local/bin/pg_waldump",
+			"pg_waldump",
+		}
+
+		runCmd.Flags().StringSlice(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
+
 	{
 		const (
 			key          = config.KeyXLogMode
 			longName     = "xlog-mode"
 			shortName    = "X"
 			defaultValue = "pg"
-			description  = `pg_waldump(1) variant: "xlog" or "pg"`
+			description  = `WAL decoder: pg_waldump(1) variant "xlog" or "pg", or the built-in "native" decoder`
 		)
 		runCmd.Flags().StringP(longName, shortName, defaultValue, description)
 		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
 		viper.SetDefault(key, defaultValue)
 	}
+
+	{
+		const (
+			key          = config.KeyXLogStream
+			longName     = "xlog-stream"
+			defaultValue = false
+			description  = "Run a single pg_waldump(1) from the replay LSN across the readahead window instead of one per WAL file (xlog-mode \"pg\" only)"
+		)
+
+		runCmd.Flags().Bool(longName, defaultValue, description)
+		viper.BindPFlag(key, runCmd.Flags().Lookup(longName))
+		viper.SetDefault(key, defaultValue)
+	}
 }
@@ -43,23 +43,110 @@ type Config struct {
 }
 
 type Agent struct {
+	Connectionless    bool
 	PostgreSQLPIDPath string
 	LogFormat         LogFormat
 	RetryInit         bool
 	UseColors         bool
+
+	// Prefaulting starts when a follower's replay lag reaches LagStartBytes or
+	// LagStartTime and stops once the lag is at or below both LagStopBytes and
+	// LagStopTime.  A zero start threshold ignores that measure of lag.  If both
+	// start thresholds are zero, prefaulting is always on.
+	LagStartBytes units.Base2Bytes
+	LagStopBytes  units.Base2Bytes
+	LagStartTime  time.Duration
+	LagStopTime   time.Duration
+
+	// WALWatch watches the WAL directory for new segments instead of polling
+	// every poll interval.  WALWatchTimeout is the longest the agent waits for a
+	// new segment before polling anyway.
+	WALWatch        bool
+	WALWatchTimeout time.Duration
+}
+
+type PrefetchBackend int
+
+const (
+	PrefetchBackendAuto PrefetchBackend = iota
+	PrefetchBackendPread
+	PrefetchBackendFadvise
+	PrefetchBackendReadahead
+	PrefetchBackendMmap
+)
+
+func (b PrefetchBackend) String() string {
+	switch b {
+	case PrefetchBackendAuto:
+		return "auto"
+	case PrefetchBackendPread:
+		return "pread"
+	case PrefetchBackendFadvise:
+		return "fadvise"
+	case PrefetchBackendReadahead:
+		return "readahead"
+	case PrefetchBackendMmap:
+		return "mmap"
+	default:
+		panic(fmt.Sprintf("unknown prefetch backend: %d", b))
+	}
 }
 
 type FHCacheConfig struct {
-	MaxOpenFiles uint
-	Size         uint
-	TTL          time.Duration
-	PGDataPath   string
+	MaxOpenFiles    uint
+	Size            uint
+	TTL             time.Duration
+	PGDataPath      string
+	PrefetchBackend PrefetchBackend
+
+	// ResidencyCheck enables mmap(2)'ing relation segments in order to check
+	// whether pages are resident using mincore(2) before issuing IO.
+	ResidencyCheck bool
+}
+
+type IOEngine int
+
+const (
+	IOEngineThreads IOEngine = iota
+	IOEngineURing
+)
+
+func (e IOEngine) String() string {
+	switch e {
+	case IOEngineThreads:
+		return "threads"
+	case IOEngineURing:
+		return "io_uring"
+	default:
+		panic(fmt.Sprintf("unknown IO engine: %d", e))
+	}
 }
 
 type IOCacheConfig struct {
+	Engine           IOEngine
 	MaxConcurrentIOs uint
 	Size             uint
 	TTL              time.Duration
+
+	// MaxQueuedPages is the number of requested pages that may be waiting for
+	// IO before Prefault() blocks.  Zero is unbounded.
+	MaxQueuedPages uint
+
+	// URingQueueDepth is the number of IOs in flight per io_uring and URingRings
+	// is the number of io_urings (each serviced by its own goroutine).
+	URingQueueDepth uint
+	URingRings      uint
+
+	// CoalesceMaxSpan is the largest single IO issued when merging nearby pages
+	// of a relation segment and CoalesceMaxGap is the largest run of unrequested
+	// pages that will be read in order to merge two IOs.
+	CoalesceMaxSpan units.Base2Bytes
+	CoalesceMaxGap  units.Base2Bytes
+
+	// RevalidateInterval is how long a prefaulted page is cached before its
+	// residency is checked again.  Only used when
+	// FHCacheConfig.ResidencyCheck is set.
+	RevalidateInterval time.Duration
 }
 
 type WALMode int
@@ -68,6 +155,7 @@ const (
 	WALModeDefault WALMode = iota
 	WALModePG
 	WALModeXLog
+	WALModeNative
 )
 
 type WALCacheConfig struct {
@@ -75,6 +163,27 @@ type WALCacheConfig struct {
 	ReadaheadBytes units.Base2Bytes
 	PGDataPath     string
 	WalDumpPath    string
+
+	// WalDumpSearchPath is searched for the pg_waldump(1) matching the major
+	// version of the cluster when WalDumpPath is not set.  "{major}" in each
+	// entry is replaced with the major version (e.g. "9.6" or "13").
+	WalDumpSearchPath []string
+
+	// ReadaheadLeadTime is how far ahead of replay, in time, the readahead
+	// window is sized to stay.  ReadaheadBytes caps the window.  Zero disables
+	// the controller and always reads ahead ReadaheadBytes.
+	ReadaheadLeadTime time.Duration
+
+	// Stream runs a single pg_waldump(1) across the readahead window, starting
+	// at the replay LSN, instead of one pg_waldump(1) per WAL segment.  Only
+	// supported with WALModePG.
+	Stream bool
+
+	// ArchiveDir is a local directory of archived WAL segments (e.g. a
+	// pgBackRest or WAL-G spool).  Segments missing from the WAL directory
+	// during archive recovery are prefaulted from ArchiveDir.  Empty disables
+	// the archive.
+	ArchiveDir string
 }
 
 func NewDefault() (cfg *Config, err error) {
@@ -100,6 +209,7 @@ func NewDefault() (cfg *Config, err error) {
 	agentConfig := Agent{}
 	{
 		const postmasterPIDFilename = "postmaster.pid"
+		agentConfig.Connectionless = viper.GetBool(KeyPGConnectionless)
 		agentConfig.PostgreSQLPIDPath = path.Join(viper.GetString(KeyPGData), postmasterPIDFilename)
 		agentConfig.UseColors = viper.GetBool(KeyAgentUseColor)
 		agentConfig.RetryInit = viper.GetBool(KeyRetryDBInit)
@@ -107,6 +217,29 @@ func NewDefault() (cfg *Config, err error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to parse the log format")
 		}
+
+		for _, lagBytes := range []struct {
+			key string
+			val *units.Base2Bytes
+		}{
+			{KeyLagStartBytes, &agentConfig.LagStartBytes},
+			{KeyLagStopBytes, &agentConfig.LagStopBytes},
+		} {
+			if *lagBytes.val, err = units.ParseBase2Bytes(viper.GetString(lagBytes.key)); err != nil {
+				return nil, errors.Wrapf(err, "unable to parse %s", lagBytes.key)
+			}
+		}
+		agentConfig.WALWatch = viper.GetBool(KeyWALWatch)
+		agentConfig.WALWatchTimeout = viper.GetDuration(KeyWALWatchWait)
+		agentConfig.LagStartTime = viper.GetDuration(KeyLagStartTime)
+		agentConfig.LagStopTime = viper.GetDuration(KeyLagStopTime)
+
+		switch {
+		case agentConfig.LagStartBytes > 0 && agentConfig.LagStopBytes > agentConfig.LagStartBytes:
+			return nil, fmt.Errorf("%s (%s) must not exceed %s (%s)", KeyLagStopBytes, agentConfig.LagStopBytes, KeyLagStartBytes, agentConfig.LagStartBytes)
+		case agentConfig.LagStartTime > 0 && agentConfig.LagStopTime > agentConfig.LagStartTime:
+			return nil, fmt.Errorf("%s (%s) must not exceed %s (%s)", KeyLagStopTime, agentConfig.LagStopTime, KeyLagStartTime, agentConfig.LagStartTime)
+		}
 	}
 
 	fhConfig := FHCacheConfig{}
@@ -141,6 +274,23 @@ func NewDefault() (cfg *Config, err error) {
 		}
 
 		fhConfig.TTL = defaultTTL
+
+		switch backend := viper.GetString(KeyPrefetchBackend); backend {
+		case "auto":
+			fhConfig.PrefetchBackend = PrefetchBackendAuto
+		case "pread":
+			fhConfig.PrefetchBackend = PrefetchBackendPread
+		case "fadvise":
+			fhConfig.PrefetchBackend = PrefetchBackendFadvise
+		case "readahead":
+			fhConfig.PrefetchBackend = PrefetchBackendReadahead
+		case "mmap":
+			fhConfig.PrefetchBackend = PrefetchBackendMmap
+		default:
+			panic(fmt.Sprintf("unsupported %q backend: %q", KeyPrefetchBackend, backend))
+		}
+
+		fhConfig.ResidencyCheck = viper.GetBool(KeyResidencyCheck)
 	}
 
 	ioConfig := IOCacheConfig{}
@@ -160,8 +310,10 @@ func NewDefault() (cfg *Config, err error) {
 			// will only be a visible problem with SSDs. ¯\_(ツ)_/¯
 			defaultMaxConcurrentIOs = uint((driveOpsPerSec * numVDevs * drivesPerVDev * headsPerDrive) * efficiency)
 
-			// ioCacheSize is set to cache all operations for ~100 WAL files
-			ioCacheSize uint = 100 * uint(pg.WALSegmentSize/pg.WALPageSize)
+			// ioCacheSize is set to cache all operations for ~100 WAL files.  The
+			// cluster's geometry has not been detected yet, so size the cache
+			// using PostgreSQL's defaults.
+			ioCacheSize uint = 100 * uint(pg.DefaultWALSegmentSize/pg.DefaultWALPageSize)
 		)
 
 		if !viper.IsSet(KeyNumIOThreads) || viper.GetInt(KeyNumIOThreads) == 0 {
@@ -172,6 +324,42 @@ func NewDefault() (cfg *Config, err error) {
 
 		ioConfig.Size = ioCacheSize
 		ioConfig.TTL = defaultTTL
+
+		switch engine := viper.GetString(KeyIOEngine); engine {
+		case "threads":
+			ioConfig.Engine = IOEngineThreads
+		case "io_uring":
+			ioConfig.Engine = IOEngineURing
+		default:
+			panic(fmt.Sprintf("unsupported %q engine: %q", KeyIOEngine, engine))
+		}
+
+		ioConfig.URingQueueDepth = uint(viper.GetInt(KeyIOURingDepth))
+		ioConfig.URingRings = uint(viper.GetInt(KeyIOURingRings))
+		if ioConfig.URingQueueDepth == 0 || ioConfig.URingRings == 0 {
+			return nil, fmt.Errorf("%s and %s must be greater than zero", KeyIOURingDepth, KeyIOURingRings)
+		}
+
+		ioConfig.MaxQueuedPages = uint(viper.GetInt(KeyIOMaxQueued))
+		ioConfig.RevalidateInterval = viper.GetDuration(KeyRevalidate)
+
+		switch maxSpan, err := units.ParseBase2Bytes(viper.GetString(KeyIOCoalesceSpan)); {
+		case err != nil:
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyIOCoalesceSpan)
+		case maxSpan < 0:
+			return nil, fmt.Errorf("%s can not be a negative value (%d)", KeyIOCoalesceSpan, maxSpan)
+		default:
+			ioConfig.CoalesceMaxSpan = maxSpan
+		}
+
+		switch maxGap, err := units.ParseBase2Bytes(viper.GetString(KeyIOCoalesceGap)); {
+		case err != nil:
+			return nil, errors.Wrapf(err, "unable to parse %s", KeyIOCoalesceGap)
+		case maxGap < 0:
+			return nil, fmt.Errorf("%s can not be a negative value (%d)", KeyIOCoalesceGap, maxGap)
+		default:
+			ioConfig.CoalesceMaxGap = maxGap
+		}
 	}
 
 	walConfig := WALCacheConfig{}
@@ -181,6 +369,8 @@ func NewDefault() (cfg *Config, err error) {
 			walConfig.Mode = WALModeXLog
 		case "pg":
 			walConfig.Mode = WALModePG
+		case "native":
+			walConfig.Mode = WALModeNative
 		default:
 			panic(fmt.Sprintf("unsupported %q mode: %q", KeyXLogMode, mode))
 		}
@@ -196,7 +386,20 @@ func NewDefault() (cfg *Config, err error) {
 			walConfig.ReadaheadBytes = readAheadBytes
 		}
 
+		if walConfig.ReadaheadLeadTime = viper.GetDuration(KeyWALLeadTime); walConfig.ReadaheadLeadTime < 0 {
+			return nil, fmt.Errorf("%s can not be negative (%s)", KeyWALLeadTime, walConfig.ReadaheadLeadTime)
+		}
+
 		walConfig.WalDumpPath = viper.GetString(KeyXLogPath)
+		walConfig.WalDumpSearchPath = viper.GetStringSlice(KeyXLogSearchPath)
+		walConfig.ArchiveDir = viper.GetString(KeyWALArchiveDir)
+		if walConfig.Mode == WALModeXLog && walConfig.WalDumpPath == "" {
+			return nil, fmt.Errorf("%s is required when %s is %q", KeyXLogPath, KeyXLogMode, "xlog")
+		}
+
+		if walConfig.Stream = viper.GetBool(KeyXLogStream); walConfig.Stream && walConfig.Mode != WALModePG {
+			return nil, fmt.Errorf("%s requires %s to be %q", KeyXLogStream, KeyXLogMode, "pg")
+		}
 	}
 
 	return &Config{
@@ -11,30 +11,56 @@ import (
 const (
 	KeyLogLevel = "log.level"
 
-	KeyAgentLogFormat = "run.log-format"
-	KeyNumIOThreads   = "run.num-io-threads"
-	KeyPProfEnable    = "run.pprof.enable"
-	KeyPProfPort      = "run.pprof.port"
-	KeyRetryDBInit    = "run.retry-db-init"
-	KeyAgentUseColor  = "run.use-color"
+	KeyAgentLogFormat  = "run.log-format"
+	KeyIOCoalesceGap   = "run.io-coalesce.max-gap"
+	KeyIOCoalesceSpan  = "run.io-coalesce.max-span"
+	KeyIOEngine        = "run.io-engine"
+	KeyIOMaxQueued     = "run.io-max-queued-pages"
+	KeyIOURingDepth    = "run.io-uring.queue-depth"
+	KeyIOURingRings    = "run.io-uring.rings"
+	KeyNumIOThreads    = "run.num-io-threads"
+	KeyPProfEnable     = "run.pprof.enable"
+	KeyPProfPort       = "run.pprof.port"
+	KeyPrefetchBackend = "run.prefetch-backend"
+	KeyResidencyCheck  = "run.residency.check"
+	KeyRevalidate      = "run.residency.revalidate-interval"
+	KeyRetryDBInit     = "run.retry-db-init"
+	KeyAgentUseColor   = "run.use-color"
 
-	KeyPGData         = "postgresql.pgdata"
-	KeyPGDatabase     = "postgresql.database"
-	KeyPGHost         = "postgresql.host"
-	KeyPGMode         = "postgresql.mode"
-	KeyPGPassword     = "postgresql.password"
-	KeyPGPollInterval = "postgresql.poll-interval"
-	KeyPGPort         = "postgresql.port"
-	KeyPGUser         = "postgresql.user"
+	KeyLagStartBytes = "postgresql.lag.start-bytes"
+	KeyLagStartTime  = "postgresql.lag.start-time"
+	KeyLagStopBytes  = "postgresql.lag.stop-bytes"
+	KeyLagStopTime   = "postgresql.lag.stop-time"
 
-	KeyWALReadahead = "postgresql.wal.readahead-bytes"
-	KeyWALThreads   = "postgresql.wal.threads"
+	KeyPGConnectionless = "postgresql.connectionless"
+	KeyPGData           = "postgresql.pgdata"
+	KeyPGDatabase       = "postgresql.database"
+	KeyPGHost           = "postgresql.host"
+	KeyPGMode           = "postgresql.mode"
+	KeyPGPassword       = "postgresql.password"
+	KeyPGPollInterval   = "postgresql.poll-interval"
+	KeyPGPort           = "postgresql.port"
+	KeyPGUser           = "postgresql.user"
 
-	KeyXLogMode = "postgresql.xlog.mode"
-	KeyXLogPath = "postgresql.xlog.pg_waldump-path"
+	KeyWALArchiveDir = "postgresql.wal.archive-dir"
+	KeyWALLeadTime   = "postgresql.wal.readahead-lead-time"
+	KeyWALReadahead  = "postgresql.wal.readahead-bytes"
+	KeyWALThreads    = "postgresql.wal.threads"
+	KeyWALWatch      = "postgresql.wal.watch"
+	KeyWALWatchWait  = "postgresql.wal.watch-timeout"
+
+	KeyXLogMode       = "postgresql.xlog.mode"
+	KeyXLogPath       = "postgresql.xlog.pg_waldump-path"
+	KeyXLogSearchPath = "postgresql.xlog.pg_waldump-search-path"
+	KeyXLogStream     = "postgresql.xlog.stream"
 )
 
 const (
+	// DefaultXLogWalDumpPath is the waldump(1) used in xlog mode when
+	// KeyXLogPath is not set.  Unlike pg_waldump(1), waldump(1) is not
+	// versioned and is not searched for.
+	DefaultXLogWalDumpPath = "/usr/local/bin/pg_waldump"
+
 	// Use a log format that resembles time.RFC3339Nano but includes all trailing
 	// zeros so that we get fixed-width logging.
 	LogTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
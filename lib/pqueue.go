@@ -0,0 +1,165 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// PriorityQueue is a blocking queue that returns the item with the lowest
+// priority value first.  Items with equal priorities are returned in the order
+// they were pushed.  PriorityQueue is safe for concurrent use.
+type PriorityQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	h      _PQHeap
+	seq    uint64
+	closed bool
+}
+
+type _PQItem struct {
+	value    interface{}
+	priority uint64
+	seq      uint64
+}
+
+type _PQHeap []_PQItem
+
+func (h _PQHeap) Len() int { return len(h) }
+func (h _PQHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h _PQHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *_PQHeap) Push(x interface{}) { *h = append(*h, x.(_PQItem)) }
+func (h *_PQHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = _PQItem{}
+	*h = old[:len(old)-1]
+	return item
+}
+
+// NewPriorityQueue creates a new, empty PriorityQueue.
+func NewPriorityQueue() *PriorityQueue {
+	q := &PriorityQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Push adds value to the queue.  Values pushed after Close() are discarded.
+func (q *PriorityQueue) Push(value interface{}, priority uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.seq++
+	heap.Push(&q.h, _PQItem{value: value, priority: priority, seq: q.seq})
+	q.cond.Signal()
+}
+
+// Pop blocks until an item is available and returns the item with the lowest
+// priority value.  ok is false once the queue has been closed.
+func (q *PriorityQueue) Pop() (value interface{}, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.h) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return nil, false
+	}
+
+	return heap.Pop(&q.h).(_PQItem).value, true
+}
+
+// TryPop is a non-blocking Pop().  ok is false if the queue is empty or
+// closed.
+func (q *PriorityQueue) TryPop() (value interface{}, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.h) == 0 || q.closed {
+		return nil, false
+	}
+
+	return heap.Pop(&q.h).(_PQItem).value, true
+}
+
+// Len returns the number of items in the queue.
+func (q *PriorityQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.h)
+}
+
+// Purge removes all items from the queue and returns them.
+func (q *PriorityQueue) Purge() []interface{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	values := make([]interface{}, 0, len(q.h))
+	for _, item := range q.h {
+		values = append(values, item.value)
+	}
+	q.h = nil
+
+	return values
+}
+
+// Filter calls fn with every queued value.  Values for which fn returns false
+// are removed, otherwise the value is replaced by the value returned by fn
+// and keeps its priority.  Filter returns the number of values removed.
+func (q *PriorityQueue) Filter(fn func(value interface{}) (interface{}, bool)) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	h := q.h[:0]
+	for _, item := range q.h {
+		value, keep := fn(item.value)
+		if !keep {
+			continue
+		}
+		item.value = value
+		h = append(h, item)
+	}
+	removed := len(q.h) - len(h)
+	for i := len(h); i < len(q.h); i++ {
+		q.h[i] = _PQItem{}
+	}
+	q.h = h
+	heap.Init(&q.h)
+
+	return removed
+}
+
+// Close wakes all blocked callers of Pop() and causes all subsequent calls to
+// Pop() and TryPop() to fail.
+func (q *PriorityQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.h = nil
+	q.cond.Broadcast()
+}
@@ -0,0 +1,71 @@
+package lib_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/lib"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	q := lib.NewPriorityQueue()
+	q.Push("c", 30)
+	q.Push("a", 10)
+	q.Push("b1", 20)
+	q.Push("b2", 20)
+
+	got := []string{}
+	for q.Len() > 0 {
+		v, ok := q.Pop()
+		if !ok {
+			t.Fatalf("unexpected closed queue")
+		}
+		got = append(got, v.(string))
+	}
+
+	if diff := pretty.Compare(got, []string{"a", "b1", "b2", "c"}); diff != "" {
+		t.Fatalf("order diff: (-got +want)\n%s", diff)
+	}
+
+	if _, ok := q.TryPop(); ok {
+		t.Fatalf("expected an empty queue")
+	}
+
+	q.Push("d", 40)
+	if diff := pretty.Compare(q.Purge(), []interface{}{"d"}); diff != "" {
+		t.Fatalf("purge diff: (-got +want)\n%s", diff)
+	}
+
+	q.Push(1, 10)
+	q.Push(2, 20)
+	q.Push(3, 30)
+	q.Push(4, 40)
+	removed := q.Filter(func(v interface{}) (interface{}, bool) {
+		n := v.(int)
+		return n * 10, n%2 == 0
+	})
+	if removed != 2 {
+		t.Fatalf("expected 2 values removed, got %d", removed)
+	}
+	if diff := pretty.Compare(q.Purge(), []interface{}{20, 40}); diff != "" {
+		t.Fatalf("filter diff: (-got +want)\n%s", diff)
+	}
+
+	// Close() wakes blocked callers.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, ok := q.Pop(); ok {
+			t.Errorf("expected Pop() to fail after Close()")
+		}
+	}()
+	q.Close()
+	wg.Wait()
+
+	q.Push("e", 50)
+	if _, ok := q.TryPop(); ok {
+		t.Fatalf("expected Push() to be discarded after Close()")
+	}
+}
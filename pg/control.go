@@ -0,0 +1,208 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"path"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ControlFilePath is the path of pg_control relative to PGDATA.
+	ControlFilePath = "global/pg_control"
+
+	// controlFloatFormat is FLOATFORMAT_VALUE, stored in pg_control to detect
+	// incompatible floating point formats.
+	controlFloatFormat = 1234567.0
+
+	// controlMaxSearch bounds the search for fields whose offset varies between
+	// major versions.  sizeof(ControlFileData) is well under 512 bytes.
+	controlMaxSearch = 512
+)
+
+// DBState is the state of the cluster as recorded in pg_control.
+type DBState uint32
+
+// DBState values as defined in PostgreSQL's src/include/catalog/pg_control.h.
+const (
+	DBStateStartup DBState = iota
+	DBStateShutdowned
+	DBStateShutdownedInRecovery
+	DBStateShutdowning
+	DBStateInCrashRecovery
+	DBStateInArchiveRecovery
+	DBStateInProduction
+)
+
+// String returns the state as printed by pg_controldata(1).
+func (s DBState) String() string {
+	switch s {
+	case DBStateStartup:
+		return "starting up"
+	case DBStateShutdowned:
+		return "shut down"
+	case DBStateShutdownedInRecovery:
+		return "shut down in recovery"
+	case DBStateShutdowning:
+		return "shutting down"
+	case DBStateInCrashRecovery:
+		return "in crash recovery"
+	case DBStateInArchiveRecovery:
+		return "in archive recovery"
+	case DBStateInProduction:
+		return "in production"
+	default:
+		return fmt.Sprintf("unrecognized status code (%d)", uint32(s))
+	}
+}
+
+// InRecovery returns true if WAL is being replayed in the given state.
+func (s DBState) InRecovery() bool {
+	switch s {
+	case DBStateStartup, DBStateInCrashRecovery, DBStateInArchiveRecovery:
+		return true
+	default:
+		return false
+	}
+}
+
+// ControlFile contains the values read from PostgreSQL's global/pg_control
+// file (i.e. ControlFileData in src/include/catalog/pg_control.h).
+type ControlFile struct {
+	SystemIdentifier uint64
+	ControlVersion   uint32
+	CatalogVersion   uint32
+	State            DBState
+	Geometry         Geometry
+
+	// Redo and RedoTimelineID are the REDO location of the latest checkpoint
+	// (or restartpoint on a follower) and the timeline it was taken on.
+	Redo           LSN
+	RedoTimelineID TimelineID
+
+	// MinRecoveryPoint is the LSN that recovery must reach before the cluster
+	// is consistent.  On a follower it advances as buffers are flushed during
+	// replay.  MinRecoveryPoint is 0 when not in archive recovery.
+	MinRecoveryPoint           LSN
+	MinRecoveryPointTimelineID TimelineID
+}
+
+// ReadControlFile reads and parses global/pg_control in pgdataPath.
+func ReadControlFile(pgdataPath string) (*ControlFile, error) {
+	buf, err := ioutil.ReadFile(path.Join(pgdataPath, ControlFilePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read pg_control")
+	}
+
+	return ParseControlFile(buf)
+}
+
+// ParseControlFile parses the contents of a pg_control file.
+//
+// The layout of ControlFileData changes between major versions.  The leading
+// fields are stable, however the size fields follow a variable number of
+// checkpoint and configuration fields.  Rather than encoding every layout,
+// the size fields are located using the floatFormat sentinel that immediately
+// precedes them, and the file is validated using the CRC that follows them.
+// The checkpoint and recovery fields are read from offsets derived from
+// pg_control_version.
+func ParseControlFile(buf []byte) (*ControlFile, error) {
+	const fixedHdrSize = 24
+	if len(buf) < fixedHdrSize {
+		return nil, errors.Errorf("pg_control too short: %d bytes", len(buf))
+	}
+
+	cf := &ControlFile{
+		SystemIdentifier: binary.LittleEndian.Uint64(buf[0:]),
+		ControlVersion:   binary.LittleEndian.Uint32(buf[8:]),
+		CatalogVersion:   binary.LittleEndian.Uint32(buf[12:]),
+		State:            DBState(binary.LittleEndian.Uint32(buf[16:])),
+	}
+
+	// uint64 system_identifier; uint32 pg_control_version; uint32
+	// catalog_version_no; DBState state; pg_time_t time; XLogRecPtr checkPoint;
+	// [XLogRecPtr prevCheckPoint, < PG11]; CheckPoint checkPointCopy;
+	// XLogRecPtr unloggedLSN; XLogRecPtr minRecoveryPoint; TimeLineID
+	// minRecoveryPointTLI;
+	checkPointCopyOff := 40
+	if cf.ControlVersion < 1100 {
+		checkPointCopyOff += 8
+	}
+
+	// CheckPoint grew when nextXid became a FullTransactionId in PG12.
+	checkPointSize := 88
+	if cf.ControlVersion < 1201 {
+		checkPointSize = 80
+	}
+
+	minRecoveryPointOff := checkPointCopyOff + checkPointSize + 8
+	if len(buf) < minRecoveryPointOff+12 {
+		return nil, errors.Errorf("pg_control too short: %d bytes", len(buf))
+	}
+
+	cf.Redo = LSN(binary.LittleEndian.Uint64(buf[checkPointCopyOff:]))
+	cf.RedoTimelineID = TimelineID(binary.LittleEndian.Uint32(buf[checkPointCopyOff+8:]))
+	cf.MinRecoveryPoint = LSN(binary.LittleEndian.Uint64(buf[minRecoveryPointOff:]))
+	cf.MinRecoveryPointTimelineID = TimelineID(binary.LittleEndian.Uint32(buf[minRecoveryPointOff+8:]))
+
+	// double floatFormat; uint32 blcksz; uint32 relseg_size; uint32
+	// xlog_blcksz; uint32 xlog_seg_size;
+	const sizesLen = 8 + 4*4
+	floatOff := -1
+	for off := alignUp(minRecoveryPointOff + 12); off+sizesLen <= len(buf) && off < controlMaxSearch; off += 8 {
+		if math.Float64frombits(binary.LittleEndian.Uint64(buf[off:])) == controlFloatFormat {
+			floatOff = off
+			break
+		}
+	}
+	if floatOff < 0 {
+		return nil, errors.New("unable to find floatFormat in pg_control (incompatible byte order?)")
+	}
+
+	sizes := buf[floatOff+8:]
+	blckSize := binary.LittleEndian.Uint32(sizes[0:])
+	relSegSize := binary.LittleEndian.Uint32(sizes[4:])
+	cf.Geometry = Geometry{
+		HeapPageSize:       units.Base2Bytes(blckSize),
+		HeapMaxSegmentSize: units.Base2Bytes(uint64(relSegSize) * uint64(blckSize)),
+		WALPageSize:        units.Base2Bytes(binary.LittleEndian.Uint32(sizes[8:])),
+		WALSegmentSize:     units.Base2Bytes(binary.LittleEndian.Uint32(sizes[12:])),
+	}
+
+	// The CRC is the last member of ControlFileData and covers every byte
+	// preceding it.
+	crcFound := false
+	for off := floatOff + sizesLen; off+4 <= len(buf) && off < controlMaxSearch; off += 4 {
+		if crc32.Checksum(buf[:off], crc32cTable) == binary.LittleEndian.Uint32(buf[off:]) {
+			crcFound = true
+			break
+		}
+	}
+	if !crcFound {
+		return nil, errors.New("incorrect checksum in pg_control")
+	}
+
+	if err := cf.Geometry.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid geometry in pg_control")
+	}
+
+	return cf, nil
+}
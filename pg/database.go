@@ -0,0 +1,67 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// xlogDBaseCreate is the info of a Database CREATE record
+// (XLOG_DBASE_CREATE, renamed XLOG_DBASE_CREATE_FILE_COPY in 15).  See
+// PostgreSQL's src/include/commands/dbcommands_xlog.h.
+const (
+	xlogDBaseCreate         = 0x00
+	sizeOfDBaseCreateRecord = 16
+)
+
+// DatabaseCopy is a Database CREATE record.  When a database is created by
+// copying the files of its template (the only strategy before PostgreSQL 15
+// and STRATEGY FILE_COPY since), the startup process copies every file in the
+// template's directory in SrcTablespace to the new database's directory in
+// Tablespace.  One record is logged per tablespace.
+type DatabaseCopy struct {
+	SrcTablespace OID
+	SrcDatabase   OID
+	Tablespace    OID
+	Database      OID
+}
+
+// String returns the DatabaseCopy in the format used by pg_waldump(1) (e.g.
+// "copy dir 1/1663 to 16384/1663").
+func (dbCopy DatabaseCopy) String() string {
+	return fmt.Sprintf("copy dir %d/%d to %d/%d", dbCopy.SrcDatabase, dbCopy.SrcTablespace, dbCopy.Database, dbCopy.Tablespace)
+}
+
+// DatabaseCopy decodes a Database CREATE record.  ok is false if rec is not a
+// Database CREATE record.
+func (rec *WALRecord) DatabaseCopy() (dbCopy DatabaseCopy, ok bool, err error) {
+	if rec.Rmgr != RmgrDatabase || rec.RmgrInfo() != xlogDBaseCreate {
+		return DatabaseCopy{}, false, nil
+	}
+
+	data := rec.MainData
+	if len(data) < sizeOfDBaseCreateRecord {
+		return DatabaseCopy{}, false, errors.Errorf("short Database CREATE record at %s", rec.LSN)
+	}
+
+	return DatabaseCopy{
+		Database:      OID(binary.LittleEndian.Uint32(data[0:])),
+		Tablespace:    OID(binary.LittleEndian.Uint32(data[4:])),
+		SrcDatabase:   OID(binary.LittleEndian.Uint32(data[8:])),
+		SrcTablespace: OID(binary.LittleEndian.Uint32(data[12:])),
+	}, true, nil
+}
@@ -0,0 +1,73 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestWALRecord_DatabaseCopy(t *testing.T) {
+	tests := []struct {
+		name string
+		rec  pg.WALRecord
+		want pg.DatabaseCopy
+		ok   bool
+		fail bool
+	}{
+		{
+			name: "create",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrDatabase, Info: 0x00, MainData: le(16384, 1663, 1, 1663)},
+			want: pg.DatabaseCopy{SrcTablespace: 1663, SrcDatabase: 1, Tablespace: 1663, Database: 16384},
+			ok:   true,
+		},
+		{
+			// XLOG_DBASE_DROP before 15, XLOG_DBASE_CREATE_WAL_LOG since
+			name: "not a copy",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrDatabase, Info: 0x10, MainData: le(16384, 1663)},
+		},
+		{
+			name: "storage",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrStorage, Info: 0x00, MainData: le(16384, 1663, 1, 1663)},
+		},
+		{
+			name: "short",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrDatabase, Info: 0x00, MainData: le(16384, 1663)},
+			fail: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, ok, err := test.rec.DatabaseCopy()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: bad: %v", test.name, err)
+		}
+
+		if diff := pretty.Compare([]interface{}{got, ok}, []interface{}{test.want, test.ok}); diff != "" {
+			t.Errorf("%s: DatabaseCopy diff: (-got +want)\n%s", test.name, diff)
+		}
+	}
+
+	if got, want := (pg.DatabaseCopy{SrcTablespace: 1663, SrcDatabase: 1, Tablespace: 1663, Database: 16384}).String(), "copy dir 1/1663 to 16384/1663"; got != want {
+		t.Errorf("String: got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/units"
+)
+
+const (
+	// PostgreSQL's compile-time defaults for BLCKSZ, RELSEG_SIZE * BLCKSZ,
+	// XLOG_BLCKSZ, and the default WAL segment size.
+	DefaultHeapPageSize       = 8 * units.KiB
+	DefaultHeapMaxSegmentSize = 1 * units.GiB
+	DefaultWALPageSize        = 8 * units.KiB
+	DefaultWALSegmentSize     = 16 * units.MiB
+)
+
+// Geometry describes the page and segment sizes of a PostgreSQL cluster.  All
+// of these values are fixed when the cluster is compiled or initialized and
+// are recorded in global/pg_control.
+type Geometry struct {
+	HeapPageSize       units.Base2Bytes
+	HeapMaxSegmentSize units.Base2Bytes
+	WALPageSize        units.Base2Bytes
+	WALSegmentSize     units.Base2Bytes
+}
+
+// DefaultGeometry returns the geometry of a cluster built and initialized with
+// PostgreSQL's defaults.
+func DefaultGeometry() Geometry {
+	return Geometry{
+		HeapPageSize:       DefaultHeapPageSize,
+		HeapMaxSegmentSize: DefaultHeapMaxSegmentSize,
+		WALPageSize:        DefaultWALPageSize,
+		WALSegmentSize:     DefaultWALSegmentSize,
+	}
+}
+
+// CurrentGeometry returns the geometry currently in use by the pg package.
+func CurrentGeometry() Geometry {
+	return Geometry{
+		HeapPageSize:       HeapPageSize,
+		HeapMaxSegmentSize: HeapMaxSegmentSize,
+		WALPageSize:        WALPageSize,
+		WALSegmentSize:     WALSegmentSize,
+	}
+}
+
+// Validate returns an error if the geometry is not one PostgreSQL could have
+// been built or initialized with.
+func (g Geometry) Validate() error {
+	isPow2 := func(v units.Base2Bytes) bool {
+		return v > 0 && v&(v-1) == 0
+	}
+
+	switch {
+	case !isPow2(g.HeapPageSize) || g.HeapPageSize < 1*units.KiB || g.HeapPageSize > 32*units.KiB:
+		return fmt.Errorf("invalid heap page size: %d", g.HeapPageSize)
+	case g.HeapMaxSegmentSize < g.HeapPageSize || g.HeapMaxSegmentSize%g.HeapPageSize != 0:
+		return fmt.Errorf("invalid heap segment size: %d", g.HeapMaxSegmentSize)
+	case !isPow2(g.WALPageSize) || g.WALPageSize < 1*units.KiB || g.WALPageSize > 64*units.KiB:
+		return fmt.Errorf("invalid WAL page size: %d", g.WALPageSize)
+	case !isPow2(g.WALSegmentSize) || g.WALSegmentSize < 1*units.MiB || g.WALSegmentSize > 1*units.GiB:
+		return fmt.Errorf("invalid WAL segment size: %d", g.WALSegmentSize)
+	}
+
+	return nil
+}
+
+// SetGeometry updates the page and segment sizes used by the pg package (e.g.
+// LSN.WALFilename(), ParseWalfile(), LSN.Readahead(), and
+// HeapSegmentPageNum()).  SetGeometry is not safe for concurrent use and MUST
+// be called before any goroutines make use of the pg package.
+func SetGeometry(g Geometry) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	HeapPageSize = g.HeapPageSize
+	HeapMaxSegmentSize = g.HeapMaxSegmentSize
+	WALPageSize = g.WALPageSize
+	WALSegmentSize = g.WALSegmentSize
+	WALSegmentsPerWALID = (1 << 32) / uint64(WALSegmentSize)
+
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// controlFile builds a minimal pg_control for the given pg_control_version
+// with the floatFormat sentinel at floatOff and the CRC at crcOff.
+func controlFile(version uint32, floatOff, crcOff int, want *pg.ControlFile) []byte {
+	checkPointCopyOff, checkPointSize := 40, 88
+	if version < 1100 {
+		checkPointCopyOff = 48
+	}
+	if version < 1201 {
+		checkPointSize = 80
+	}
+	minRecoveryPointOff := checkPointCopyOff + checkPointSize + 8
+
+	g := want.Geometry
+	buf := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(buf[0:], want.SystemIdentifier)
+	binary.LittleEndian.PutUint32(buf[8:], version)
+	binary.LittleEndian.PutUint32(buf[12:], want.CatalogVersion)
+	binary.LittleEndian.PutUint32(buf[16:], uint32(want.State))
+	binary.LittleEndian.PutUint64(buf[checkPointCopyOff:], uint64(want.Redo))
+	binary.LittleEndian.PutUint32(buf[checkPointCopyOff+8:], uint32(want.RedoTimelineID))
+	binary.LittleEndian.PutUint64(buf[minRecoveryPointOff:], uint64(want.MinRecoveryPoint))
+	binary.LittleEndian.PutUint32(buf[minRecoveryPointOff+8:], uint32(want.MinRecoveryPointTimelineID))
+	binary.LittleEndian.PutUint64(buf[floatOff:], math.Float64bits(1234567.0))
+	binary.LittleEndian.PutUint32(buf[floatOff+8:], uint32(g.HeapPageSize))
+	binary.LittleEndian.PutUint32(buf[floatOff+12:], uint32(g.HeapMaxSegmentSize/g.HeapPageSize))
+	binary.LittleEndian.PutUint32(buf[floatOff+16:], uint32(g.WALPageSize))
+	binary.LittleEndian.PutUint32(buf[floatOff+20:], uint32(g.WALSegmentSize))
+	binary.LittleEndian.PutUint32(buf[floatOff+24:], 64) // nameDataLen
+	binary.LittleEndian.PutUint32(buf[floatOff+28:], 32) // indexMaxKeys
+	crc := crc32.Checksum(buf[:crcOff], crc32.MakeTable(crc32.Castagnoli))
+	binary.LittleEndian.PutUint32(buf[crcOff:], crc)
+
+	return buf
+}
+
+func TestParseControlFile(t *testing.T) {
+	tests := []struct {
+		floatOff int
+		crcOff   int
+		want     pg.ControlFile
+	}{
+		{ // 0: PG 10, 64MiB WAL segments
+			floatOff: 168,
+			crcOff:   224,
+			want: pg.ControlFile{
+				SystemIdentifier: 6543210987654321098,
+				ControlVersion:   1002,
+				CatalogVersion:   201707211,
+				State:            pg.DBStateInArchiveRecovery,
+				Geometry: pg.Geometry{
+					HeapPageSize:       16 * units.KiB,
+					HeapMaxSegmentSize: 1 * units.GiB,
+					WALPageSize:        8 * units.KiB,
+					WALSegmentSize:     64 * units.MiB,
+				},
+				Redo:                       pg.MustParseLSN("2/34000028"),
+				RedoTimelineID:             3,
+				MinRecoveryPoint:           pg.MustParseLSN("2/372E4558"),
+				MinRecoveryPointTimelineID: 3,
+			},
+		},
+		{ // 1: PG 13
+			floatOff: 176,
+			crcOff:   236,
+			want: pg.ControlFile{
+				SystemIdentifier: 6843210987654321098,
+				ControlVersion:   1300,
+				CatalogVersion:   202007201,
+				State:            pg.DBStateInProduction,
+				Geometry:         pg.DefaultGeometry(),
+				Redo:             pg.MustParseLSN("0/150E150"),
+				RedoTimelineID:   1,
+			},
+		},
+	}
+
+	for n, test := range tests {
+		cf, err := pg.ParseControlFile(controlFile(test.want.ControlVersion, test.floatOff, test.crcOff, &test.want))
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(cf, &test.want); diff != "" {
+			t.Fatalf("%d: ControlFile diff: (-got +want)\n%s", n, diff)
+		}
+
+		buf := controlFile(test.want.ControlVersion, test.floatOff, test.crcOff, &test.want)
+		buf[test.floatOff+8] ^= 0xFF // covered by the CRC
+		if _, err := pg.ParseControlFile(buf); err == nil {
+			t.Fatalf("%d: expected a CRC error", n)
+		}
+
+		if _, err := pg.ParseControlFile(buf[:64]); err == nil {
+			t.Fatalf("%d: expected an error for a short pg_control", n)
+		}
+	}
+}
+
+// TestGeometry is not run in parallel because it modifies the pg package's
+// geometry.
+func TestGeometry(t *testing.T) {
+	defer pg.SetGeometry(pg.DefaultGeometry())
+
+	bad := pg.DefaultGeometry()
+	bad.WALSegmentSize = 3 * units.MiB
+	if err := pg.SetGeometry(bad); err == nil {
+		t.Fatalf("expected an error for a non-power-of-two WAL segment size")
+	}
+
+	g := pg.DefaultGeometry()
+	g.WALSegmentSize = 64 * units.MiB
+	g.HeapPageSize = 32 * units.KiB
+	if err := pg.SetGeometry(g); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	lsn := pg.MustParseLSN("2/372E4558")
+	if diff := pretty.Compare(lsn.String(), "2/372E4558"); diff != "" {
+		t.Fatalf("String() diff: (-got +want)\n%s", diff)
+	}
+
+	if diff := pretty.Compare(lsn.ByteOffset(), pg.WALByteOffset(0x32E4558)); diff != "" {
+		t.Fatalf("ByteOffset() diff: (-got +want)\n%s", diff)
+	}
+
+	// 64 segments per 4GiB of WAL: 0x37 / 4 == 0x0D
+	if diff := pretty.Compare(lsn.WALFilename(1), pg.WALFilename("00000001000000020000000D")); diff != "" {
+		t.Fatalf("WALFilename() diff: (-got +want)\n%s", diff)
+	}
+
+	timelineID, walLSN, err := pg.ParseWalfile("00000001000000020000000D")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if diff := pretty.Compare(timelineID, pg.TimelineID(1)); diff != "" {
+		t.Fatalf("timeline diff: (-got +want)\n%s", diff)
+	}
+	if diff := pretty.Compare(walLSN, pg.MustParseLSN("2/34000001")); diff != "" {
+		t.Fatalf("ParseWalfile() diff: (-got +want)\n%s", diff)
+	}
+
+	wantFiles := pg.WALFiles{
+		"00000001000000020000000D",
+		"00000001000000020000000E",
+	}
+	if diff := pretty.Compare(walLSN.Readahead(1, 128*units.MiB), wantFiles); diff != "" {
+		t.Fatalf("Readahead() diff: (-got +want)\n%s", diff)
+	}
+
+	// 32KiB pages: 32768 pages per 1GiB segment
+	if diff := pretty.Compare(pg.HeapSegmentPageNum(32769), pg.HeapPageNumber(1)); diff != "" {
+		t.Fatalf("HeapSegmentPageNum() diff: (-got +want)\n%s", diff)
+	}
+}
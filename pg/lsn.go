@@ -15,7 +15,6 @@ package pg
 
 import (
 	"fmt"
-	"math"
 	"strconv"
 	"strings"
 
@@ -31,8 +30,10 @@ import (
 // 1. the WAL Segment
 // 2. the byte offset within an individual WAL segment
 //
-// The byte offset is the lower 24 bits of the LSN.  The WAL Segment number is
-// the uppwer 40 bits of the LSN.
+// With the default WALSegmentSize, the byte offset is the lower 24 bits of the
+// LSN and the WAL Segment number is the uppwer 40 bits of the LSN.  Both are
+// derived from WALSegmentSize so that clusters initialized with a different
+// --wal-segsize are supported.
 type LSN uint64
 
 const (
@@ -42,7 +43,7 @@ const (
 
 // NewLSN creates a new LSN from a segment ID and offset
 func NewLSN(segNo WALSegmentNumber, off WALByteOffset) LSN {
-	return LSN(uint64(LSNSegmentMask&segNo)<<24 | uint64(LSNByteMask&off))
+	return LSN(uint64(LSNSegmentMask&segNo)*uint64(WALSegmentSize) + uint64(off))
 }
 
 // LSNCmp compares x and y and returns:
@@ -96,11 +97,9 @@ func ParseLSN(in string) (LSN, error) {
 		return InvalidLSN, errors.Wrap(err, "unable to decode the WAL offset")
 	}
 
-	// NOTE(seanc@): the order of the AND NOT operator is significant.  See the
-	// type LSN comment for details on the extraction.
-	segNo = uint64(segNo<<8) | uint64((WALByteOffset(offset)&^LSNByteMask)>>24)
-
-	return NewLSN(WALSegmentNumber(segNo), LSNByteMask&WALByteOffset(offset)), nil
+	// The textual form of an LSN is the high and low 32 bits of the LSN,
+	// independent of the WAL segment size.
+	return LSN(segNo<<32 | offset), nil
 }
 
 // ParseWalfile returns a parsed LSN from a given WALFilename
@@ -147,23 +146,16 @@ func (lsn LSN) ByteOffset() WALByteOffset {
 
 // Readahead returns all of the anticipated WAL filenames that will be present
 // in the future based on the lsn and the readahead.
+//
+// Readahead assumes the WAL stays on timelineID.  See
+// TimelineHistory.Readahead() to read ahead across timeline switches.
 func (lsn LSN) Readahead(timelineID TimelineID, maxBytes units.Base2Bytes) WALFiles {
-	// Always read in at least the current WAL file
-	walFiles := make(WALFiles, 0, int(math.Ceil(float64(maxBytes)/float64(WALSegmentSize))))
-
-	cur := lsn
-	for remainingBytes := maxBytes; remainingBytes > 0; remainingBytes -= WALSegmentSize {
-		walFiles = append(walFiles, cur.WALFilename(timelineID))
-		cur = cur.AddBytes(WALSegmentSize)
-	}
-
-	return walFiles
+	return SingleTimelineHistory(timelineID).Readahead(lsn, maxBytes)
 }
 
 // String returns the string representation of an LSN.
 func (lsn LSN) String() string {
-	segNo := lsn.SegmentNumber()
-	return fmt.Sprintf("%X/%X%X", segNo.High(), segNo.Low(), lsn.ByteOffset())
+	return fmt.Sprintf("%X/%X", uint32(uint64(lsn)>>32), uint32(lsn))
 }
 
 // SegmentNumber returns the Segment number of the LSN.
@@ -0,0 +1,190 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// RelFileNode identifies the files of a relation (PostgreSQL's RelFileNode,
+// renamed RelFileLocator in 16).
+type RelFileNode struct {
+	Tablespace OID
+	Database   OID
+	Relation   OID
+}
+
+// String returns the RelFileNode in the format used by pg_waldump(1) (e.g.
+// "1663/16384/16385").
+func (rnode RelFileNode) String() string {
+	return fmt.Sprintf("%d/%d/%d", rnode.Tablespace, rnode.Database, rnode.Relation)
+}
+
+// RelationEventKind is the kind of change made to a relation's files.
+type RelationEventKind uint8
+
+const (
+	// RelationCreate is logged when a relation fork is created.  The
+	// relfilenode may have been used by a relation that has since been dropped.
+	RelationCreate RelationEventKind = iota + 1
+
+	// RelationTruncate is logged when a relation is truncated (e.g. by VACUUM).
+	RelationTruncate
+
+	// RelationDrop is logged when the transaction that dropped or rewrote a
+	// relation (e.g. DROP TABLE, TRUNCATE or VACUUM FULL) commits, or when the
+	// transaction that created it aborts.  The relation's files are unlinked.
+	RelationDrop
+)
+
+// String returns the name of the event.
+func (kind RelationEventKind) String() string {
+	switch kind {
+	case RelationCreate:
+		return "create"
+	case RelationTruncate:
+		return "truncate"
+	case RelationDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("event(%d)", uint8(kind))
+	}
+}
+
+// RelationEvent is a change to a relation fork's files logged in WAL.  Every
+// block of the fork at or beyond Block is invalid once the event has been
+// replayed.
+type RelationEvent struct {
+	Kind RelationEventKind
+	RelFileNode
+	Fork  ForkNumber
+	Block HeapBlockNumber
+}
+
+// Storage record info values and flags.  See PostgreSQL's
+// src/include/catalog/storage_xlog.h.
+const (
+	xlogSMGRCreate   = 0x10
+	xlogSMGRTruncate = 0x20
+
+	smgrTruncateHeap = 0x0001
+	smgrTruncateVM   = 0x0002
+	smgrTruncateFSM  = 0x0004
+	smgrTruncateAll  = smgrTruncateHeap | smgrTruncateVM | smgrTruncateFSM
+)
+
+// SMGRTruncateEvents returns the events for a relation truncated to nblocks
+// blocks.  flags is the set of forks truncated (SMGR_TRUNCATE_*).  The free
+// space map and visibility map are truncated to sizes derived from nblocks
+// and are invalidated in full.
+func SMGRTruncateEvents(rnode RelFileNode, nblocks HeapBlockNumber, flags uint32) []RelationEvent {
+	var events []RelationEvent
+	if flags&smgrTruncateHeap != 0 {
+		events = append(events, RelationEvent{Kind: RelationTruncate, RelFileNode: rnode, Fork: MainForkNum, Block: nblocks})
+	}
+	if flags&smgrTruncateFSM != 0 {
+		events = append(events, RelationEvent{Kind: RelationTruncate, RelFileNode: rnode, Fork: FSMForkNum})
+	}
+	if flags&smgrTruncateVM != 0 {
+		events = append(events, RelationEvent{Kind: RelationTruncate, RelFileNode: rnode, Fork: VisibilityMapForkNum})
+	}
+
+	return events
+}
+
+// DropEvents returns the events for a relation whose files are unlinked.
+func DropEvents(rnode RelFileNode) []RelationEvent {
+	events := make([]RelationEvent, 0, MaxForkNum+1)
+	for fork := MainForkNum; fork <= MaxForkNum; fork++ {
+		events = append(events, RelationEvent{Kind: RelationDrop, RelFileNode: rnode, Fork: fork})
+	}
+
+	return events
+}
+
+// RelationEvents returns the changes to relation files logged by rec: the
+// creation and truncation of relation forks by Storage records and the
+// relations dropped by Transaction commit and abort records.  Records of other
+// resource managers return no events.
+func (rec *WALRecord) RelationEvents() ([]RelationEvent, error) {
+	switch rec.Rmgr {
+	case RmgrStorage:
+		return rec.storageEvents()
+	case RmgrTransaction:
+		return rec.xactEvents()
+	default:
+		return nil, nil
+	}
+}
+
+// storageEvents decodes xl_smgr_create and xl_smgr_truncate.
+func (rec *WALRecord) storageEvents() ([]RelationEvent, error) {
+	data := rec.MainData
+
+	switch rec.RmgrInfo() {
+	case xlogSMGRCreate:
+		if len(data) < sizeOfRelFileNode+4 {
+			return nil, errors.Errorf("short SMGR CREATE record at %s", rec.LSN)
+		}
+
+		return []RelationEvent{{
+			Kind:        RelationCreate,
+			RelFileNode: decodeRelFileNode(data),
+			Fork:        ForkNumber(binary.LittleEndian.Uint32(data[sizeOfRelFileNode:])),
+		}}, nil
+	case xlogSMGRTruncate:
+		if len(data) < 4+sizeOfRelFileNode {
+			return nil, errors.Errorf("short SMGR TRUNCATE record at %s", rec.LSN)
+		}
+
+		// PostgreSQL 9.5 always truncates every fork and does not log flags.
+		flags := uint32(smgrTruncateAll)
+		if len(data) >= 4+sizeOfRelFileNode+4 {
+			flags = binary.LittleEndian.Uint32(data[4+sizeOfRelFileNode:])
+		}
+
+		nblocks := HeapBlockNumber(binary.LittleEndian.Uint32(data))
+		return SMGRTruncateEvents(decodeRelFileNode(data[4:]), nblocks, flags), nil
+	default:
+		return nil, nil
+	}
+}
+
+// xactEvents returns the relations dropped by Transaction commit and abort
+// records.
+func (rec *WALRecord) xactEvents() ([]RelationEvent, error) {
+	xact, ok, err := rec.decodeXactRecord()
+	if !ok || err != nil || len(xact.rels) == 0 {
+		return nil, err
+	}
+
+	events := make([]RelationEvent, 0, len(xact.rels)*int(MaxForkNum+1))
+	for _, rnode := range xact.rels {
+		events = append(events, DropEvents(rnode)...)
+	}
+
+	return events, nil
+}
+
+// decodeRelFileNode decodes a RelFileNode (spcNode, dbNode, relNode).
+func decodeRelFileNode(b []byte) RelFileNode {
+	return RelFileNode{
+		Tablespace: OID(binary.LittleEndian.Uint32(b[0:])),
+		Database:   OID(binary.LittleEndian.Uint32(b[4:])),
+		Relation:   OID(binary.LittleEndian.Uint32(b[8:])),
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// le encodes ints as little-endian uint32s and appends byte slices as-is.
+func le(values ...interface{}) []byte {
+	var buf []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case int:
+			b := make([]byte, 4)
+			binary.LittleEndian.PutUint32(b, uint32(v))
+			buf = append(buf, b...)
+		case []byte:
+			buf = append(buf, v...)
+		}
+	}
+	return buf
+}
+
+func TestWALRecord_RelationEvents(t *testing.T) {
+	rel := pg.RelFileNode{Tablespace: 1663, Database: 16384, Relation: 16385}
+	rel2 := pg.RelFileNode{Tablespace: 1664, Database: 0, Relation: 1262}
+	timestamp := make([]byte, 8)
+
+	dropped := func(rnode pg.RelFileNode) []pg.RelationEvent {
+		return []pg.RelationEvent{
+			{Kind: pg.RelationDrop, RelFileNode: rnode, Fork: pg.MainForkNum},
+			{Kind: pg.RelationDrop, RelFileNode: rnode, Fork: pg.FSMForkNum},
+			{Kind: pg.RelationDrop, RelFileNode: rnode, Fork: pg.VisibilityMapForkNum},
+			{Kind: pg.RelationDrop, RelFileNode: rnode, Fork: pg.InitForkNum},
+		}
+	}
+
+	tests := []struct {
+		name string
+		rec  pg.WALRecord
+		want []pg.RelationEvent
+		fail bool
+	}{
+		{
+			name: "heap insert",
+			rec:  pg.WALRecord{Rmgr: 10, Info: 0x00, MainData: []byte{1, 2, 3}},
+		},
+		{
+			name: "smgr create",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrStorage, Info: 0x10, MainData: le(1663, 16384, 16385, 1)},
+			want: []pg.RelationEvent{{Kind: pg.RelationCreate, RelFileNode: rel, Fork: pg.FSMForkNum}},
+		},
+		{
+			name: "smgr truncate heap and vm",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrStorage, Info: 0x20, MainData: le(10, 1663, 16384, 16385, 0x3)},
+			want: []pg.RelationEvent{
+				{Kind: pg.RelationTruncate, RelFileNode: rel, Fork: pg.MainForkNum, Block: 10},
+				{Kind: pg.RelationTruncate, RelFileNode: rel, Fork: pg.VisibilityMapForkNum},
+			},
+		},
+		{
+			name: "smgr truncate 9.5",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrStorage, Info: 0x20, MainData: le(10, 1663, 16384, 16385)},
+			want: []pg.RelationEvent{
+				{Kind: pg.RelationTruncate, RelFileNode: rel, Fork: pg.MainForkNum, Block: 10},
+				{Kind: pg.RelationTruncate, RelFileNode: rel, Fork: pg.FSMForkNum},
+				{Kind: pg.RelationTruncate, RelFileNode: rel, Fork: pg.VisibilityMapForkNum},
+			},
+		},
+		{
+			name: "smgr truncate short",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrStorage, Info: 0x20, MainData: le(10, 1663)},
+			fail: true,
+		},
+		{
+			name: "commit without info",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x00, MainData: timestamp},
+		},
+		{
+			name: "commit with dbinfo, subxacts and rels",
+			rec: pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x80, MainData: le(timestamp,
+				0x7|0x8,     // xinfo: dbinfo, subxacts, relfilenodes, invals
+				16384, 1663, // dbinfo
+				2, 1000, 1001, // subxacts
+				2, 1663, 16384, 16385, 1664, 0, 1262, // relfilenodes
+				1, 0, 0, 0, 0)}, // invals (ignored)
+			want: append(dropped(rel), dropped(rel2)...),
+		},
+		{
+			name: "abort prepared",
+			rec: pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x80 | 0x40, MainData: le(timestamp,
+				0x4, 1, 1663, 16384, 16385)},
+			want: dropped(rel),
+		},
+		{
+			name: "prepare",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x10, MainData: []byte{1, 2, 3}},
+		},
+		{
+			name: "commit truncated rels",
+			rec: pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x80, MainData: le(timestamp,
+				0x4, 2, 1663, 16384, 16385)},
+			fail: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.rec.RelationEvents()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: bad: %v", test.name, err)
+		}
+
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("%s: events diff: (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestParseRelationPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		rnode pg.RelFileNode
+		fork  pg.ForkNumber
+		fail  bool
+	}{
+		{path: "base/16384/16385", rnode: pg.RelFileNode{Tablespace: 1663, Database: 16384, Relation: 16385}},
+		{path: "base/16384/16385_vm", rnode: pg.RelFileNode{Tablespace: 1663, Database: 16384, Relation: 16385}, fork: pg.VisibilityMapForkNum},
+		{path: "global/1262_fsm", rnode: pg.RelFileNode{Tablespace: 1664, Relation: 1262}, fork: pg.FSMForkNum},
+		{path: "pg_tblspc/16400/PG_13_202007201/16384/16401_init", rnode: pg.RelFileNode{Tablespace: 16400, Database: 16384, Relation: 16401}, fork: pg.InitForkNum},
+		{path: "base/16384/t3_16385", fail: true},
+		{path: "base/16384/16385_bogus", fail: true},
+		{path: "pg_wal/000000010000000000000001", fail: true},
+	}
+
+	for _, test := range tests {
+		rnode, fork, err := pg.ParseRelationPath(test.path)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: bad: %v", test.path, err)
+		}
+
+		if diff := pretty.Compare(rnode, test.rnode); diff != "" {
+			t.Errorf("%s: RelFileNode diff: (-got +want)\n%s", test.path, diff)
+		}
+		if fork != test.fork {
+			t.Errorf("%s: fork: got %s want %s", test.path, fork, test.fork)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTablespaceOID is the OID of pg_default, stored in PGDATA/base.
+	DefaultTablespaceOID OID = 1663
+
+	// GlobalTablespaceOID is the OID of pg_global, stored in PGDATA/global.
+	// Relations in pg_global are shared catalogs and use database OID 0.
+	GlobalTablespaceOID OID = 1664
+
+	// TablespaceDirectory is the directory in PGDATA containing symlinks to
+	// user-defined tablespaces.
+	TablespaceDirectory = "pg_tblspc"
+)
+
+// ReadVersionFile returns the contents of PG_VERSION in pgdataPath (e.g. "9.6"
+// or "10").
+func ReadVersionFile(pgdataPath string) (string, error) {
+	buf, err := ioutil.ReadFile(path.Join(pgdataPath, "PG_VERSION"))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read PG_VERSION")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	var version string
+	for scanner.Scan() {
+		version = strings.TrimSpace(scanner.Text())
+		break
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "unable to extract PostgreSQL's version string")
+	}
+
+	if version == "" {
+		return "", errors.New("empty PG_VERSION")
+	}
+
+	return version, nil
+}
+
+// TablespaceVersionPrefix returns the prefix of the version-specific directory
+// PostgreSQL creates inside of a tablespace (i.e. TABLESPACE_VERSION_DIRECTORY
+// minus the catalog version number, "PG_10_").
+func TablespaceVersionPrefix(pgVersion string) string {
+	return "PG_" + pgVersion + "_"
+}
+
+// ParseRelationPath parses the path of a relation fork relative to PGDATA as
+// printed by pg_waldump(1) (i.e. relpathperm()), for example
+// "base/16384/16385_vm", "global/1262" or
+// "pg_tblspc/16400/PG_13_202007201/16384/16385".
+func ParseRelationPath(relPath string) (RelFileNode, ForkNumber, error) {
+	var rnode RelFileNode
+	parts := strings.Split(relPath, "/")
+
+	var err error
+	parseOID := func(s string) OID {
+		if err != nil {
+			return 0
+		}
+		var oid uint64
+		oid, err = strconv.ParseUint(s, 10, 32)
+		return OID(oid)
+	}
+
+	var filename string
+	switch {
+	case len(parts) == 2 && parts[0] == "global":
+		rnode.Tablespace = GlobalTablespaceOID
+		filename = parts[1]
+	case len(parts) == 3 && parts[0] == "base":
+		rnode.Tablespace = DefaultTablespaceOID
+		rnode.Database = parseOID(parts[1])
+		filename = parts[2]
+	case len(parts) == 5 && parts[0] == TablespaceDirectory:
+		rnode.Tablespace = parseOID(parts[1])
+		rnode.Database = parseOID(parts[3])
+		filename = parts[4]
+	default:
+		return RelFileNode{}, MainForkNum, fmt.Errorf("unknown relation path: %q", relPath)
+	}
+
+	fork := MainForkNum
+	if i := strings.IndexByte(filename, '_'); i >= 0 {
+		forkName := filename[i+1:]
+		filename = filename[:i]
+		if fork, err = ParseForkName(forkName); err != nil {
+			return RelFileNode{}, MainForkNum, errors.Wrapf(err, "unable to parse relation path %q", relPath)
+		}
+	}
+	rnode.Relation = parseOID(filename)
+	if err != nil {
+		return RelFileNode{}, MainForkNum, errors.Wrapf(err, "unable to parse relation path %q", relPath)
+	}
+
+	return rnode, fork, nil
+}
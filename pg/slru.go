@@ -0,0 +1,255 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// SLRU identifies one of PostgreSQL's SLRU ("simple LRU") stores.  SLRUs are
+// stored in segments of SLRUPagesPerSegment pages named after the segment
+// number (e.g. pg_xact/0000).  The zero value is not an SLRU and identifies a
+// relation.
+type SLRU uint8
+
+const (
+	NoSLRU SLRU = iota
+
+	// XactSLRU holds the commit status of transactions (pg_xact, pg_clog
+	// before 10).
+	XactSLRU
+
+	// SubtransSLRU holds the parent of subtransactions (pg_subtrans).
+	SubtransSLRU
+
+	// MultiXactOffsetSLRU holds the offset of each MultiXactId's members
+	// (pg_multixact/offsets).
+	MultiXactOffsetSLRU
+
+	// MultiXactMemberSLRU holds the members of MultiXactIds
+	// (pg_multixact/members).
+	MultiXactMemberSLRU
+)
+
+// SLRUPagesPerSegment is PostgreSQL's SLRU_PAGES_PER_SEGMENT.
+const SLRUPagesPerSegment = 32
+
+// String returns the name of the SLRU.
+func (slru SLRU) String() string {
+	switch slru {
+	case NoSLRU:
+		return "none"
+	case XactSLRU:
+		return "xact"
+	case SubtransSLRU:
+		return "subtrans"
+	case MultiXactOffsetSLRU:
+		return "multixact-offsets"
+	case MultiXactMemberSLRU:
+		return "multixact-members"
+	default:
+		return fmt.Sprintf("slru(%d)", uint8(slru))
+	}
+}
+
+// Dir returns the directory of the SLRU relative to PGDATA in the given major
+// version of PostgreSQL.
+func (slru SLRU) Dir(major uint64) string {
+	switch slru {
+	case XactSLRU:
+		if major < 100000 {
+			return "pg_clog"
+		}
+		return "pg_xact"
+	case SubtransSLRU:
+		return "pg_subtrans"
+	case MultiXactOffsetSLRU:
+		return "pg_multixact/offsets"
+	case MultiXactMemberSLRU:
+		return "pg_multixact/members"
+	default:
+		return ""
+	}
+}
+
+// SLRUSegmentFilename returns the name of the file holding the given segment of
+// an SLRU.
+func SLRUSegmentFilename(segment HeapSegmentNumber) string {
+	return fmt.Sprintf("%04X", uint32(segment))
+}
+
+// SLRUPage is a page of an SLRU.
+type SLRUPage struct {
+	SLRU SLRU
+	Page uint64
+}
+
+// SegmentNumber returns the segment holding the page.
+func (p SLRUPage) SegmentNumber() HeapSegmentNumber {
+	return HeapSegmentNumber(p.Page / SLRUPagesPerSegment)
+}
+
+// String returns the page in the format "xact/12".
+func (p SLRUPage) String() string {
+	return fmt.Sprintf("%s/%d", p.SLRU, p.Page)
+}
+
+// The number of entries per SLRU page depends on the page size (BLCKSZ).  See
+// CLOG_XACTS_PER_PAGE, SUBTRANS_XACTS_PER_PAGE, MULTIXACT_OFFSETS_PER_PAGE and
+// MULTIXACT_MEMBERS_PER_PAGE.
+const (
+	clogXactsPerByte           = 4
+	sizeOfMultiXactMemberGroup = 20
+	multiXactMembersPerGroup   = 4
+)
+
+// XactPage returns the pg_xact page holding the commit status of xid.
+func XactPage(xid TransactionID) SLRUPage {
+	return SLRUPage{SLRU: XactSLRU, Page: uint64(xid) / (uint64(HeapPageSize) * clogXactsPerByte)}
+}
+
+// SubtransPage returns the pg_subtrans page holding the parent of xid.
+func SubtransPage(xid TransactionID) SLRUPage {
+	return SLRUPage{SLRU: SubtransSLRU, Page: uint64(xid) / (uint64(HeapPageSize) / 4)}
+}
+
+// MultiXactOffsetPage returns the pg_multixact/offsets page holding the offset
+// of multi.
+func MultiXactOffsetPage(multi MultiXactID) SLRUPage {
+	return SLRUPage{SLRU: MultiXactOffsetSLRU, Page: uint64(multi) / (uint64(HeapPageSize) / 4)}
+}
+
+// MultiXactMemberPage returns the pg_multixact/members page holding the member
+// at offset.
+func MultiXactMemberPage(offset MultiXactOffset) SLRUPage {
+	membersPerPage := (uint64(HeapPageSize) / sizeOfMultiXactMemberGroup) * multiXactMembersPerGroup
+	return SLRUPage{SLRU: MultiXactMemberSLRU, Page: uint64(offset) / membersPerPage}
+}
+
+// MultiXactMemberPages returns the pg_multixact/members pages holding the
+// nmembers members starting at offset.  Member offsets wrap around at 2^32.
+func MultiXactMemberPages(offset MultiXactOffset, nmembers uint32) []SLRUPage {
+	if nmembers == 0 {
+		return nil
+	}
+
+	first := MultiXactMemberPage(offset).Page
+	last := MultiXactMemberPage(offset + MultiXactOffset(nmembers-1)).Page
+
+	var pages []SLRUPage
+	if last < first {
+		for page := first; page <= MultiXactMemberPage(math.MaxUint32).Page; page++ {
+			pages = append(pages, SLRUPage{SLRU: MultiXactMemberSLRU, Page: page})
+		}
+		first = 0
+	}
+	for page := first; page <= last; page++ {
+		pages = append(pages, SLRUPage{SLRU: MultiXactMemberSLRU, Page: page})
+	}
+
+	return pages
+}
+
+// MultiXact and Heap record info values and flags.  See PostgreSQL's
+// src/include/access/multixact.h and src/include/access/heapam_xlog.h.
+const (
+	xlogMultiXactCreateID = 0x20
+	sizeOfMultiXactCreate = 12
+
+	xlogHeapOpMask       = 0x70
+	xlogHeapLock         = 0x60
+	xlogHeap2LockUpdated = 0x60
+	sizeOfHeapLock       = 7 // flags were added in 9.6
+	xlhlXmaxIsMulti      = 0x01
+)
+
+// SLRUPages returns the SLRU pages read when rec is replayed or, for row
+// locks, when the locked tuple is next examined:
+//
+//   - pg_xact for the transaction and subtransactions of commit and abort
+//     records and for the locker of Heap LOCK and Heap2 LOCK_UPDATED records.
+//   - pg_subtrans for the subtransactions of Transaction ASSIGNMENT records.
+//   - pg_multixact/offsets and pg_multixact/members for MultiXact CREATE_ID
+//     records, and pg_multixact/offsets for multixact row locks.
+//
+// Consecutive duplicate pages are omitted.
+func (rec *WALRecord) SLRUPages() ([]SLRUPage, error) {
+	var pages []SLRUPage
+	add := func(page SLRUPage) {
+		if len(pages) == 0 || pages[len(pages)-1] != page {
+			pages = append(pages, page)
+		}
+	}
+
+	switch rec.Rmgr {
+	case RmgrTransaction:
+		if subxacts, ok, err := rec.decodeXactAssignment(); ok || err != nil {
+			for _, xid := range subxacts {
+				add(SubtransPage(xid))
+			}
+			return pages, err
+		}
+
+		xact, ok, err := rec.decodeXactRecord()
+		if !ok || err != nil {
+			return nil, err
+		}
+		if xact.xid != InvalidTransactionID {
+			add(XactPage(xact.xid))
+		}
+		for _, xid := range xact.subxacts {
+			add(XactPage(xid))
+		}
+	case RmgrMultiXact:
+		if rec.RmgrInfo() != xlogMultiXactCreateID {
+			return nil, nil
+		}
+
+		data := rec.MainData
+		if len(data) < sizeOfMultiXactCreate {
+			return nil, errors.Errorf("short MultiXact CREATE_ID record at %s", rec.LSN)
+		}
+		multi := MultiXactID(binary.LittleEndian.Uint32(data[0:]))
+		offset := MultiXactOffset(binary.LittleEndian.Uint32(data[4:]))
+		nmembers := binary.LittleEndian.Uint32(data[8:])
+
+		add(MultiXactOffsetPage(multi))
+		for _, page := range MultiXactMemberPages(offset, nmembers) {
+			add(page)
+		}
+	case RmgrHeap, RmgrHeap2:
+		if rec.Info&xlogHeapOpMask != xlogHeapLock {
+			return nil, nil
+		}
+
+		data := rec.MainData
+		if len(data) < sizeOfHeapLock {
+			return nil, errors.Errorf("short heap lock record at %s", rec.LSN)
+		}
+		xmax := binary.LittleEndian.Uint32(data[0:])
+		infobits := data[6]
+
+		if infobits&xlhlXmaxIsMulti != 0 {
+			add(MultiXactOffsetPage(MultiXactID(xmax)))
+		} else if TransactionID(xmax) != InvalidTransactionID {
+			add(XactPage(TransactionID(xmax)))
+		}
+	}
+
+	return pages, nil
+}
@@ -0,0 +1,158 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestWALRecord_SLRUPages(t *testing.T) {
+	timestamp := make([]byte, 8)
+	invals := make([]byte, 16)
+
+	xact := func(page uint64) pg.SLRUPage { return pg.SLRUPage{SLRU: pg.XactSLRU, Page: page} }
+	subtrans := func(page uint64) pg.SLRUPage { return pg.SLRUPage{SLRU: pg.SubtransSLRU, Page: page} }
+	offsets := func(page uint64) pg.SLRUPage { return pg.SLRUPage{SLRU: pg.MultiXactOffsetSLRU, Page: page} }
+	members := func(page uint64) pg.SLRUPage { return pg.SLRUPage{SLRU: pg.MultiXactMemberSLRU, Page: page} }
+
+	tests := []struct {
+		name string
+		rec  pg.WALRecord
+		want []pg.SLRUPage
+		fail bool
+	}{
+		{
+			name: "commit",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x00, XID: 742, MainData: timestamp},
+			want: []pg.SLRUPage{xact(0)},
+		},
+		{
+			name: "commit with subxacts",
+			rec: pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x80, XID: 70000, MainData: le(timestamp,
+				0x2, 2, 70001, 98304)},
+			want: []pg.SLRUPage{xact(2), xact(3)},
+		},
+		{
+			name: "commit prepared",
+			rec: pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x80 | 0x30, MainData: le(timestamp,
+				0x10|0x8,  // xinfo: twophase, invals
+				1, invals, // invals
+				131072)},
+			want: []pg.SLRUPage{xact(4)},
+		},
+		{
+			// The size of the dropped statistics differs between releases
+			name: "abort prepared with dropped stats",
+			rec: pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x80 | 0x40, MainData: le(timestamp,
+				0x10|0x100)},
+		},
+		{
+			name: "assignment",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x50, MainData: le(70000, 2, 70001, 72048)},
+			want: []pg.SLRUPage{subtrans(34), subtrans(35)},
+		},
+		{
+			name: "short assignment",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrTransaction, Info: 0x50, MainData: le(70000, 2, 70001)},
+			fail: true,
+		},
+		{
+			name: "multixact create",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrMultiXact, Info: 0x20, MainData: le(4097, 3270, 3)},
+			want: []pg.SLRUPage{offsets(2), members(1), members(2)},
+		},
+		{
+			name: "short multixact create",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrMultiXact, Info: 0x20, MainData: le(4097, 3270)},
+			fail: true,
+		},
+		{
+			name: "heap lock",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrHeap, Info: 0x60, MainData: le(70005, []byte{2, 0, 0x00, 0})},
+			want: []pg.SLRUPage{xact(2)},
+		},
+		{
+			name: "heap lock by a multixact",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrHeap, Info: 0x60, MainData: le(6145, []byte{3, 0, 0x01, 0})},
+			want: []pg.SLRUPage{offsets(3)},
+		},
+		{
+			// PostgreSQL 9.5 does not log flags
+			name: "heap2 lock updated",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrHeap2, Info: 0x60, MainData: le(70006, []byte{4, 0, 0x08})},
+			want: []pg.SLRUPage{xact(2)},
+		},
+		{
+			name: "heap insert",
+			rec:  pg.WALRecord{Rmgr: pg.RmgrHeap, Info: 0x00, MainData: le(3, 0)},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.rec.SLRUPages()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: bad: %v", test.name, err)
+		}
+
+		if diff := pretty.Compare(got, test.want); diff != "" {
+			t.Errorf("%s: SLRUPages diff: (-got +want)\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestMultiXactMemberPages(t *testing.T) {
+	// 1636 members per 8KB page.  The last page is partially used before the
+	// offsets wrap around.
+	got := pg.MultiXactMemberPages(4294967290, 10)
+	want := []pg.SLRUPage{
+		{SLRU: pg.MultiXactMemberSLRU, Page: 2625285},
+		{SLRU: pg.MultiXactMemberSLRU, Page: 0},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("MultiXactMemberPages diff: (-got +want)\n%s", diff)
+	}
+
+	if got := pg.MultiXactMemberPages(3270, 0); got != nil {
+		t.Errorf("MultiXactMemberPages: got %v want nil", got)
+	}
+}
+
+func TestSLRU_Dir(t *testing.T) {
+	tests := []struct {
+		slru  pg.SLRU
+		major uint64
+		dir   string
+	}{
+		{slru: pg.XactSLRU, major: 90600, dir: "pg_clog"},
+		{slru: pg.XactSLRU, major: 100000, dir: "pg_xact"},
+		{slru: pg.SubtransSLRU, major: 170000, dir: "pg_subtrans"},
+		{slru: pg.MultiXactOffsetSLRU, major: 90500, dir: "pg_multixact/offsets"},
+		{slru: pg.MultiXactMemberSLRU, major: 160000, dir: "pg_multixact/members"},
+	}
+
+	for _, test := range tests {
+		if got := test.slru.Dir(test.major); got != test.dir {
+			t.Errorf("%s: Dir(%d): got %q want %q", test.slru, test.major, got, test.dir)
+		}
+	}
+}
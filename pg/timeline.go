@@ -0,0 +1,203 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+)
+
+// timelineHistoryRE matches the name of a timeline history file in the WAL
+// directory (e.g. "00000002.history").
+var timelineHistoryRE = regexp.MustCompile(`^([0-9A-F]{8})\.history$`)
+
+// TimelineHistoryEntry is a timeline and the range of WAL that belongs to it.
+type TimelineHistoryEntry struct {
+	Timeline TimelineID
+
+	// Begin is the switch point from the parent timeline, or 0 for the first
+	// timeline in the history.
+	Begin LSN
+
+	// End is the switch point to the next timeline, or InvalidLSN for the
+	// newest timeline.
+	End LSN
+}
+
+// TimelineHistory is the ancestry of a timeline, oldest timeline first.  The
+// newest entry is the timeline the history was read for.
+type TimelineHistory []TimelineHistoryEntry
+
+// SingleTimelineHistory returns the history of a timeline without ancestors.
+func SingleTimelineHistory(timelineID TimelineID) TimelineHistory {
+	return TimelineHistory{{Timeline: timelineID, Begin: 0, End: InvalidLSN}}
+}
+
+// TimelineHistoryFilename returns the name of the history file of timelineID
+// (e.g. "00000002.history").
+func TimelineHistoryFilename(timelineID TimelineID) string {
+	return fmt.Sprintf("%08X.history", uint32(timelineID))
+}
+
+// ParseTimelineHistory parses the contents of the history file of timelineID.
+// The format is that of PostgreSQL's readTimeLineHistory(): one line per
+// parent timeline containing the parent's ID, the switch point, and a reason,
+// separated by tabs.  Blank lines and lines starting with '#' are ignored.
+func ParseTimelineHistory(r io.Reader, timelineID TimelineID) (TimelineHistory, error) {
+	var history TimelineHistory
+	var prevEnd LSN
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("syntax error in history file: %q", line)
+		}
+
+		parentID, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timeline ID in history file: %q", line)
+		}
+
+		switchPoint, err := ParseLSN(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid switch point in history file: %q", line)
+		}
+
+		if n := len(history); n > 0 && TimelineID(parentID) <= history[n-1].Timeline {
+			return nil, fmt.Errorf("timeline IDs must be in increasing sequence: %q", line)
+		}
+
+		history = append(history, TimelineHistoryEntry{
+			Timeline: TimelineID(parentID),
+			Begin:    prevEnd,
+			End:      switchPoint,
+		})
+		prevEnd = switchPoint
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read history file")
+	}
+
+	if n := len(history); n > 0 && timelineID <= history[n-1].Timeline {
+		return nil, fmt.Errorf("timeline ID %d must be newer than its parents", timelineID)
+	}
+
+	return append(history, TimelineHistoryEntry{
+		Timeline: timelineID,
+		Begin:    prevEnd,
+		End:      InvalidLSN,
+	}), nil
+}
+
+// ReadTimelineHistory reads the history of timelineID from walDir.  Timeline
+// 1 has no history file.
+func ReadTimelineHistory(walDir string, timelineID TimelineID) (TimelineHistory, error) {
+	if timelineID == 1 {
+		return SingleTimelineHistory(timelineID), nil
+	}
+
+	f, err := os.Open(path.Join(walDir, TimelineHistoryFilename(timelineID)))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open history file")
+	}
+	defer f.Close()
+
+	return ParseTimelineHistory(f, timelineID)
+}
+
+// LatestTimeline returns the newest timeline with a history file in walDir,
+// or InvalidTimelineID if there are none.
+func LatestTimeline(walDir string) (TimelineID, error) {
+	files, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return InvalidTimelineID, errors.Wrap(err, "unable to read the WAL directory")
+	}
+
+	latest := InvalidTimelineID
+	for _, fi := range files {
+		matches := timelineHistoryRE.FindStringSubmatch(fi.Name())
+		if matches == nil {
+			continue
+		}
+
+		timelineID, err := strconv.ParseUint(matches[1], 16, 32)
+		if err != nil {
+			continue
+		}
+
+		if TimelineID(timelineID) > latest {
+			latest = TimelineID(timelineID)
+		}
+	}
+
+	return latest, nil
+}
+
+// Contains returns true if timelineID is part of the history.
+func (h TimelineHistory) Contains(timelineID TimelineID) bool {
+	for _, entry := range h {
+		if entry.Timeline == timelineID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SegmentTimeline returns the timeline of the WAL segment containing lsn.
+// Like PostgreSQL's XLogFileReadAnyTLI(), the segment containing a switch
+// point is read from the new timeline.
+func (h TimelineHistory) SegmentTimeline(lsn LSN) TimelineID {
+	segNo := lsn.SegmentNumber()
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].Begin == 0 || segNo >= h[i].Begin.SegmentNumber() {
+			return h[i].Timeline
+		}
+	}
+
+	return InvalidTimelineID
+}
+
+// Readahead returns all of the anticipated WAL filenames that will be present
+// in the future based on the lsn and the readahead.  Each filename uses the
+// timeline the segment belongs to according to the history.
+func (h TimelineHistory) Readahead(lsn LSN, maxBytes units.Base2Bytes) WALFiles {
+	walFiles := make(WALFiles, 0, int(math.Ceil(float64(maxBytes)/float64(WALSegmentSize))))
+
+	cur := lsn
+	for remainingBytes := maxBytes; remainingBytes > 0; remainingBytes -= WALSegmentSize {
+		// See WALFilename() for the reason the segment of cur-1 is used.
+		walFiles = append(walFiles, cur.WALFilename(h.SegmentTimeline(cur-1)))
+		cur = cur.AddBytes(WALSegmentSize)
+	}
+
+	return walFiles
+}
@@ -0,0 +1,143 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testHistory = `1	0/3000000	no recovery target specified
+
+# comments and blank lines are ignored
+2	0/5000100	no recovery target specified
+`
+
+func TestParseTimelineHistory(t *testing.T) {
+	history, err := pg.ParseTimelineHistory(strings.NewReader(testHistory), 3)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	want := pg.TimelineHistory{
+		{Timeline: 1, Begin: 0, End: pg.MustParseLSN("0/3000000")},
+		{Timeline: 2, Begin: pg.MustParseLSN("0/3000000"), End: pg.MustParseLSN("0/5000100")},
+		{Timeline: 3, Begin: pg.MustParseLSN("0/5000100"), End: pg.InvalidLSN},
+	}
+	if diff := pretty.Compare(history, want); diff != "" {
+		t.Fatalf("history diff: (-got +want)\n%s", diff)
+	}
+
+	if !history.Contains(2) || history.Contains(4) {
+		t.Fatalf("bad Contains()")
+	}
+
+	for n, input := range []string{
+		"1\n",
+		"x\t0/3000000\treason\n",
+		"1\tbogus\treason\n",
+		"2\t0/3000000\treason\n1\t0/4000000\treason\n",
+		"3\t0/3000000\treason\n",
+	} {
+		if _, err := pg.ParseTimelineHistory(strings.NewReader(input), 3); err == nil {
+			t.Errorf("%d: expected an error for %q", n, input)
+		}
+	}
+}
+
+func TestTimelineHistory_Readahead(t *testing.T) {
+	history, err := pg.ParseTimelineHistory(strings.NewReader(testHistory), 3)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	_, lsn, err := pg.ParseWalfile("000000010000000000000002")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The segment containing a switch point is read from the new timeline
+	want := pg.WALFiles{
+		"000000010000000000000002",
+		"000000020000000000000003",
+		"000000020000000000000004",
+		"000000030000000000000005",
+		"000000030000000000000006",
+	}
+	if diff := pretty.Compare(history.Readahead(lsn, 5*pg.WALSegmentSize), want); diff != "" {
+		t.Fatalf("readahead diff: (-got +want)\n%s", diff)
+	}
+
+	single := pg.SingleTimelineHistory(1).Readahead(lsn, 2*pg.WALSegmentSize)
+	if diff := pretty.Compare(single, lsn.Readahead(1, 2*pg.WALSegmentSize)); diff != "" {
+		t.Fatalf("single timeline diff: (-got +want)\n%s", diff)
+	}
+}
+
+func TestReadTimelineHistory(t *testing.T) {
+	walDir, err := ioutil.TempDir("", "pg_wal")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	defer os.RemoveAll(walDir)
+
+	latest, err := pg.LatestTimeline(walDir)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if latest != pg.InvalidTimelineID {
+		t.Fatalf("unexpected latest timeline: %d", latest)
+	}
+
+	files := map[string]string{
+		"00000002.history":         "1\t0/3000000\treason\n",
+		"00000003.history":         testHistory,
+		"000000030000000000000005": "",
+		"0000000A.history.partial": "",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(path.Join(walDir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	if latest, err = pg.LatestTimeline(walDir); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if diff := pretty.Compare(latest, pg.TimelineID(3)); diff != "" {
+		t.Fatalf("latest diff: (-got +want)\n%s", diff)
+	}
+
+	history, err := pg.ReadTimelineHistory(walDir, latest)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("bad history: %+v", history)
+	}
+
+	if history, err = pg.ReadTimelineHistory(walDir, 1); err != nil || len(history) != 1 {
+		t.Fatalf("bad history for timeline 1: %+v %v", history, err)
+	}
+
+	if _, err := pg.ReadTimelineHistory(walDir, 4); err == nil {
+		t.Fatalf("expected an error for a missing history file")
+	}
+}
@@ -13,29 +13,75 @@
 
 package pg
 
-import "github.com/alecthomas/units"
+import (
+	"fmt"
+	"strconv"
+)
 
 type (
 	OID uint64
 
+	// ForkNumber identifies a relation fork (i.e. main, fsm, vm, or init).
+	ForkNumber uint8
+
 	// HeapBlockNumber represents a given HeapBlockNumber inside of a segment
 	HeapBlockNumber   uint64
 	HeapPageNumber    uint64
 	HeapSegmentNumber uint32
 
 	TimelineID uint32
+
+	// TransactionID is PostgreSQL's 32bit TransactionId.
+	TransactionID uint32
+
+	// MultiXactID and MultiXactOffset are PostgreSQL's MultiXactId and
+	// MultiXactOffset.
+	MultiXactID     uint32
+	MultiXactOffset uint32
+
+	// RmgrID is the resource manager ID of a WAL record.
+	RmgrID uint8
+)
+
+// Fork numbers as defined in PostgreSQL's src/include/common/relpath.h.
+const (
+	MainForkNum ForkNumber = iota
+	FSMForkNum
+	VisibilityMapForkNum
+	InitForkNum
+
+	MaxForkNum = InitForkNum
 )
 
 const (
 	InvalidTimelineID TimelineID = 0
 
-	HeapPageSize = WALPageSize
+	// InvalidTransactionID is PostgreSQL's InvalidTransactionId.
+	InvalidTransactionID TransactionID = 0
+)
 
-	// HeapMaxSegmentSize is the max size of a single file in a relation.
-	//
-	// TODO(seanc@): pull this value from: `SELECT blocks_per_segment FROM
-	// pg_control_init()` and multiply it by HeapPageSize.
-	HeapMaxSegmentSize = 1 * units.GiB
+// Resource manager IDs as defined in PostgreSQL's
+// src/include/access/rmgrlist.h.
+const (
+	RmgrXLOG        RmgrID = 0
+	RmgrTransaction RmgrID = 1
+	RmgrStorage     RmgrID = 2
+	RmgrDatabase    RmgrID = 4
+	RmgrMultiXact   RmgrID = 6
+	RmgrHeap2       RmgrID = 9
+	RmgrHeap        RmgrID = 10
+	RmgrBtree       RmgrID = 11
+)
+
+// See SetGeometry() for details on how the following values are initialized.
+var (
+	// HeapPageSize == PostgreSQL's Page Size (BLCKSZ).  HeapPageSize defaults to
+	// 8KB.
+	HeapPageSize = DefaultHeapPageSize
+
+	// HeapMaxSegmentSize is the max size of a single file in a relation
+	// (RELSEG_SIZE * BLCKSZ).  HeapMaxSegmentSize defaults to 1GB.
+	HeapMaxSegmentSize = DefaultHeapMaxSegmentSize
 )
 
 // HeapSegmentPageNum returns the page number of a given page inside of a heap
@@ -49,3 +95,47 @@ func HeapSegmentPageNum(block HeapBlockNumber) HeapPageNumber {
 func (heapBlockNo HeapBlockNumber) SegmentNumber() HeapSegmentNumber {
 	return HeapSegmentNumber(uint64(heapBlockNo) / uint64(HeapMaxSegmentSize/HeapPageSize))
 }
+
+// String returns the fork name used by PostgreSQL (i.e. "main", "fsm", "vm",
+// or "init").
+func (fork ForkNumber) String() string {
+	switch fork {
+	case MainForkNum:
+		return "main"
+	case FSMForkNum:
+		return "fsm"
+	case VisibilityMapForkNum:
+		return "vm"
+	case InitForkNum:
+		return "init"
+	default:
+		return fmt.Sprintf("fork(%d)", uint8(fork))
+	}
+}
+
+// FileSuffix returns the suffix PostgreSQL appends to a relation's filename
+// for the given fork (e.g. "_vm").  The main fork has no suffix.
+func (fork ForkNumber) FileSuffix() string {
+	if fork == MainForkNum {
+		return ""
+	}
+
+	return "_" + fork.String()
+}
+
+// ParseForkName parses a fork name as printed by pg_waldump(1) (i.e. "main",
+// "fsm", "vm", or "init").  pg_waldump(1) from PostgreSQL 16 and newer prints
+// the fork number instead, which is also accepted.
+func ParseForkName(name string) (ForkNumber, error) {
+	for fork := MainForkNum; fork <= MaxForkNum; fork++ {
+		if fork.String() == name {
+			return fork, nil
+		}
+	}
+
+	if forkNum, err := strconv.ParseUint(name, 10, 8); err == nil && ForkNumber(forkNum) <= MaxForkNum {
+		return ForkNumber(forkNum), nil
+	}
+
+	return MainForkNum, fmt.Errorf("unknown fork name: %q", name)
+}
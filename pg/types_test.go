@@ -26,3 +26,42 @@ func Test_Constants(t *testing.T) {
 		t.Fatalf("InvalidTimelineID diff: (-got +want)\n%s", diff)
 	}
 }
+
+func TestForkNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		fork   pg.ForkNumber
+		suffix string
+	}{
+		{name: "main", fork: pg.MainForkNum, suffix: ""},
+		{name: "fsm", fork: pg.FSMForkNum, suffix: "_fsm"},
+		{name: "vm", fork: pg.VisibilityMapForkNum, suffix: "_vm"},
+		{name: "init", fork: pg.InitForkNum, suffix: "_init"},
+	}
+
+	for n, test := range tests {
+		fork, err := pg.ParseForkName(test.name)
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(fork, test.fork); diff != "" {
+			t.Errorf("%d: ParseForkName diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(fork.FileSuffix(), test.suffix); diff != "" {
+			t.Errorf("%d: FileSuffix diff: (-got +want)\n%s", n, diff)
+		}
+	}
+
+	// pg_waldump(1) from PostgreSQL 16+ prints fork numbers
+	if fork, err := pg.ParseForkName("2"); err != nil || fork != pg.VisibilityMapForkNum {
+		t.Fatalf("bad fork number: %v %v", fork, err)
+	}
+
+	for _, name := range []string{"bogus", "4"} {
+		if _, err := pg.ParseForkName(name); err == nil {
+			t.Fatalf("expected an error for an unknown fork: %q", name)
+		}
+	}
+}
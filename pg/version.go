@@ -0,0 +1,74 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ParseMajorVersion parses a PostgreSQL version string (e.g. "9.6", "9.6.3",
+// "13.4", or "17devel") and returns its major version in the same form as
+// PostgreSQL's server_version_num with the minor version zeroed (e.g. 90600 or
+// 130000).
+func ParseMajorVersion(version string) (uint64, error) {
+	first, rest := leadingDigits(version)
+	if first == "" {
+		return 0, fmt.Errorf("invalid PostgreSQL version: %q", version)
+	}
+
+	major, err := strconv.ParseUint(first, 10, 32)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to parse first section of version")
+	}
+
+	if major >= 10 {
+		return major * 10000, nil
+	}
+
+	// Prior to PostgreSQL 10 the major version has two parts (e.g. 9.6)
+	if len(rest) < 2 || rest[0] != '.' {
+		return 0, fmt.Errorf("invalid PostgreSQL version: %q", version)
+	}
+
+	second, _ := leadingDigits(rest[1:])
+	minor, err := strconv.ParseUint(second, 10, 32)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to parse second section of version")
+	}
+
+	return major*10000 + minor*100, nil
+}
+
+// MajorVersionString returns the human readable form of a major version
+// returned by ParseMajorVersion() (e.g. "9.6" or "13").
+func MajorVersionString(major uint64) string {
+	if major < 100000 {
+		return fmt.Sprintf("%d.%d", major/10000, (major%10000)/100)
+	}
+
+	return fmt.Sprintf("%d", major/10000)
+}
+
+// leadingDigits splits s after its leading decimal digits.
+func leadingDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
@@ -0,0 +1,62 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg_test
+
+import (
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		major   uint64
+		str     string
+		fail    bool
+	}{
+		{version: "9.5", major: 90500, str: "9.5"},
+		{version: "9.6.3", major: 90600, str: "9.6"},
+		{version: "10", major: 100000, str: "10"},
+		{version: "10.21", major: 100000, str: "10"},
+		{version: "13.4", major: 130000, str: "13"},
+		{version: "16beta2", major: 160000, str: "16"},
+		{version: "17devel", major: 170000, str: "17"},
+		{version: "9", fail: true},
+		{version: "devel", fail: true},
+		{version: "", fail: true},
+	}
+
+	for n, test := range tests {
+		major, err := pg.ParseMajorVersion(test.version)
+		if test.fail {
+			if err == nil {
+				t.Fatalf("%d: expected an error for %q", n, test.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(major, test.major); diff != "" {
+			t.Errorf("%d: major diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(pg.MajorVersionString(major), test.str); diff != "" {
+			t.Errorf("%d: MajorVersionString diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
@@ -14,7 +14,7 @@
 package pg
 
 import (
-	"github.com/alecthomas/units"
+	"sort"
 )
 
 type (
@@ -60,24 +60,25 @@ type (
 )
 
 const (
-	// WALPageSize == PostgreSQL's Page Size.  Page Size == BLKSZ WALPageSize
-	// defaults to 8KB.  The same value used in the WAL is used in the PostgreSQL
-	// Heap.
-	//
-	// TODO(seanc@): pull this data from `SELECT database_block_size FROM pg_control_init()`
-	WALPageSize = 8 * units.KiB
-
-	// WALSegmentSize == PostgreSQL WAL File Size.
-	// WALSegmentSize defaults to 16MB
-	//
-	// TODO(seanc@): pull this value from `SELECT bytes_per_wal_segment FROM pg_control_init()`
-	WALSegmentSize = 16 * units.MiB
-
-	// WALMaxByteOffset == WALSegmentSize-1 (2^24 - 1)
+	// WALMaxByteOffset == WALSegmentSize-1 (2^24 - 1) for the default
+	// WALSegmentSize.
 	WALMaxByteOffset WALByteOffset = 1<<24 - 1
 
 	// WALMaxSegmentNumber == WALMaxSegmentNumber-1 (2^40 - 1)
 	WALMaxSegmentNumber WALSegmentNumber = 1<<40 - 1
+)
+
+// The following values describe the geometry of the cluster's WAL.  They are
+// initialized to PostgreSQL's compile-time defaults and are updated by
+// SetGeometry() once the cluster's actual geometry has been detected.
+var (
+	// WALPageSize == PostgreSQL's WAL Page Size (XLOG_BLCKSZ).  WALPageSize
+	// defaults to 8KB.
+	WALPageSize = DefaultWALPageSize
+
+	// WALSegmentSize == PostgreSQL WAL File Size.
+	// WALSegmentSize defaults to 16MB
+	WALSegmentSize = DefaultWALSegmentSize
 
 	// #define XLogSegmentsPerXLogId   (UINT64CONST(0x100000000) / XLOG_SEG_SIZE)
 	WALSegmentsPerWALID uint64 = (1 << 32) / uint64(WALSegmentSize)
@@ -91,8 +92,9 @@ func NewWAL() WAL {
 	}
 }
 
-// Unique returns a set of unique WAL files, deduplicating the inputs.
-// The resulting set is in a random order.
+// Unique returns a set of unique WAL files, deduplicating the inputs.  The
+// resulting set is sorted by timeline and then by LSN so that the WAL file
+// PostgreSQL will replay next is first.
 func (walFiles WALFiles) Unique() WALFiles {
 	m := make(map[WALFilename]struct{}, len(walFiles))
 	for n := range walFiles {
@@ -104,5 +106,9 @@ func (walFiles WALFiles) Unique() WALFiles {
 		uniq = append(uniq, k)
 	}
 
+	// WAL filenames are fixed-width hex, which sorts lexically in the same order
+	// as (timeline, segment).
+	sort.Slice(uniq, func(i, j int) bool { return uniq[i] < uniq[j] })
+
 	return uniq
 }
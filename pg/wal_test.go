@@ -34,3 +34,24 @@ func TestWAL_Constants(t *testing.T) {
 		t.Fatalf("WALSegmentsPerWALID diff: (-got +want)\n%s", diff)
 	}
 }
+
+func TestWALFiles_Unique(t *testing.T) {
+	walFiles := pg.WALFiles{
+		"000000020000000000000001",
+		"0000000100000001000000FF",
+		"000000010000000200000000",
+		"0000000100000001000000FF",
+		"000000010000000100000000",
+	}
+
+	want := pg.WALFiles{
+		"000000010000000100000000",
+		"0000000100000001000000FF",
+		"000000010000000200000000",
+		"000000020000000000000001",
+	}
+
+	if diff := pretty.Compare(walFiles.Unique(), want); diff != "" {
+		t.Fatalf("Unique diff: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,436 @@
+package pg_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/bschofield/pg_prefaulter/pg"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// walBuilder assembles a synthetic WAL segment written by PostgreSQL 10.
+type walBuilder struct {
+	buf      []byte
+	segStart uint64
+	pos      int
+}
+
+func newWALBuilder(walFile pg.WALFilename) *walBuilder {
+	return newWALBuilderN(walFile, 1)
+}
+
+// newWALBuilderN creates a builder for n consecutive segments beginning with
+// walFile.
+func newWALBuilderN(walFile pg.WALFilename, n int) *walBuilder {
+	_, lsn, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		panic(err)
+	}
+
+	return &walBuilder{
+		buf:      make([]byte, n*int(pg.WALSegmentSize)),
+		segStart: uint64(lsn - 1),
+	}
+}
+
+func (b *walBuilder) pageHeader(remLen uint32) {
+	var info uint16
+	hdrSize := 24
+	if remLen > 0 {
+		info |= 0x0001
+	}
+	longHeader := b.pos%int(pg.WALSegmentSize) == 0
+	if longHeader {
+		info |= 0x0002
+		hdrSize = 40
+	}
+
+	p := b.buf[b.pos:]
+	binary.LittleEndian.PutUint16(p[0:], 0xD097)
+	binary.LittleEndian.PutUint16(p[2:], info)
+	binary.LittleEndian.PutUint32(p[4:], 1)
+	binary.LittleEndian.PutUint64(p[8:], b.segStart+uint64(b.pos))
+	binary.LittleEndian.PutUint32(p[16:], remLen)
+	if longHeader {
+		binary.LittleEndian.PutUint64(p[24:], 0xDEADBEEF)
+		binary.LittleEndian.PutUint32(p[32:], uint32(pg.WALSegmentSize))
+		binary.LittleEndian.PutUint32(p[36:], uint32(pg.WALPageSize))
+	}
+	b.pos += hdrSize
+}
+
+// add appends a record to the segment and returns its LSN.
+func (b *walBuilder) add(rec []byte) pg.LSN {
+	pageSize := int(pg.WALPageSize)
+	b.pos = (b.pos + 7) &^ 7
+	if b.pos%pageSize == 0 {
+		b.pageHeader(0)
+	}
+
+	lsn := pg.LSN(b.segStart + uint64(b.pos))
+	for len(rec) > 0 {
+		if b.pos%pageSize == 0 {
+			b.pageHeader(uint32(len(rec)))
+		}
+		n := copy(b.buf[b.pos:b.pos+(pageSize-b.pos%pageSize)], rec)
+		rec = rec[n:]
+		b.pos += n
+	}
+
+	return lsn
+}
+
+type testBlock struct {
+	fork     uint8
+	flags    uint8
+	rel      [3]uint32
+	block    uint32
+	data     []byte
+	image    []byte
+	bimgInfo uint8
+}
+
+func encodeRecord(xid uint32, rmgr, info uint8, blocks []testBlock, mainData []byte) []byte {
+	var hdrs, payload bytes.Buffer
+	for i, blk := range blocks {
+		forkFlags := blk.fork | blk.flags
+		if len(blk.data) > 0 {
+			forkFlags |= 0x20
+		}
+		if len(blk.image) > 0 {
+			forkFlags |= 0x10
+		}
+		if i > 0 && blk.rel == blocks[i-1].rel {
+			forkFlags |= 0x80
+		}
+		hdrs.WriteByte(uint8(i))
+		hdrs.WriteByte(forkFlags)
+		binary.Write(&hdrs, binary.LittleEndian, uint16(len(blk.data)))
+		if len(blk.image) > 0 {
+			binary.Write(&hdrs, binary.LittleEndian, uint16(len(blk.image)))
+			binary.Write(&hdrs, binary.LittleEndian, uint16(0))
+			hdrs.WriteByte(blk.bimgInfo)
+		}
+		if forkFlags&0x80 == 0 {
+			binary.Write(&hdrs, binary.LittleEndian, blk.rel)
+		}
+		binary.Write(&hdrs, binary.LittleEndian, blk.block)
+		payload.Write(blk.image)
+		payload.Write(blk.data)
+	}
+
+	if len(mainData) > 0 {
+		if len(mainData) < 256 {
+			hdrs.WriteByte(255)
+			hdrs.WriteByte(uint8(len(mainData)))
+		} else {
+			hdrs.WriteByte(254)
+			binary.Write(&hdrs, binary.LittleEndian, uint32(len(mainData)))
+		}
+		payload.Write(mainData)
+	}
+
+	body := append(hdrs.Bytes(), payload.Bytes()...)
+	rec := make([]byte, 24, 24+len(body))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(24+len(body)))
+	binary.LittleEndian.PutUint32(rec[4:], xid)
+	rec[16] = info
+	rec[17] = rmgr
+	rec = append(rec, body...)
+
+	table := crc32.MakeTable(crc32.Castagnoli)
+	crc := crc32.Update(crc32.Checksum(rec[24:], table), table, rec[:20])
+	binary.LittleEndian.PutUint32(rec[20:], crc)
+
+	return rec
+}
+
+func TestWALReader(t *testing.T) {
+	const walFile pg.WALFilename = "000000010000000A00000003"
+	b := newWALBuilder(walFile)
+
+	type want struct {
+		lsn    pg.LSN
+		rmgr   pg.RmgrID
+		xid    pg.TransactionID
+		blocks []pg.WALBlockRef
+		main   int
+	}
+	var wants []want
+
+	// Heap INSERT with a single block reference
+	wants = append(wants, want{
+		lsn: b.add(encodeRecord(1851, 10, 0x00, []testBlock{
+			{rel: [3]uint32{1663, 16398, 16399}, block: 4408314, data: []byte("tuple")},
+		}, []byte{1, 0, 0})),
+		rmgr: 10,
+		xid:  1851,
+		blocks: []pg.WALBlockRef{
+			{Tablespace: 1663, Database: 16398, Relation: 16399, Block: 4408314, HasData: true},
+		},
+		main: 3,
+	})
+
+	// Heap2 VISIBLE with a VM fork reference followed by a same-rel block
+	wants = append(wants, want{
+		lsn: b.add(encodeRecord(0, 9, 0x40, []testBlock{
+			{rel: [3]uint32{1663, 16400, 2619}, fork: 2, block: 0},
+			{rel: [3]uint32{1663, 16400, 2619}, block: 10},
+		}, []byte{0, 0, 0, 0, 1})),
+		rmgr: 9,
+		blocks: []pg.WALBlockRef{
+			{ID: 0, Tablespace: 1663, Database: 16400, Relation: 2619, Fork: pg.VisibilityMapForkNum, Block: 0},
+			{ID: 1, Tablespace: 1663, Database: 16400, Relation: 2619, Block: 10},
+		},
+		main: 5,
+	})
+
+	// A full-page image large enough to span several pages
+	image := bytes.Repeat([]byte{0xAB}, 3*int(pg.WALPageSize))
+	wants = append(wants, want{
+		lsn: b.add(encodeRecord(2000, 11, 0x00, []testBlock{
+			{rel: [3]uint32{1663, 16400, 16434}, block: 9578854, image: image, bimgInfo: 0x04},
+		}, bytes.Repeat([]byte{1}, 300))),
+		rmgr: 11,
+		xid:  2000,
+		blocks: []pg.WALBlockRef{
+			{Tablespace: 1663, Database: 16400, Relation: 16434, Block: 9578854, HasImage: true, ApplyImage: true},
+		},
+		main: 300,
+	})
+
+	// Records without block references
+	for i := 0; i < 3; i++ {
+		wants = append(wants, want{
+			lsn:  b.add(encodeRecord(uint32(3000+i), 1, 0x00, nil, []byte{1, 2, 3, 4, 5, 6, 7, 8})),
+			rmgr: 1,
+			xid:  pg.TransactionID(3000 + i),
+			main: 8,
+		})
+	}
+
+	wr, err := pg.NewWALReader(bytes.NewReader(b.buf), walFile)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	for n, w := range wants {
+		rec, err := wr.Next()
+		if err != nil {
+			t.Fatalf("%d: bad: %v", n, err)
+		}
+
+		if diff := pretty.Compare(rec.LSN, w.lsn); diff != "" {
+			t.Errorf("%d: LSN diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(rec.Rmgr, w.rmgr); diff != "" {
+			t.Errorf("%d: Rmgr diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(rec.XID, w.xid); diff != "" {
+			t.Errorf("%d: XID diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(rec.Blocks, w.blocks); diff != "" {
+			t.Errorf("%d: Blocks diff: (-got +want)\n%s", n, diff)
+		}
+
+		if diff := pretty.Compare(len(rec.MainData), w.main); diff != "" {
+			t.Errorf("%d: MainData length diff: (-got +want)\n%s", n, diff)
+		}
+	}
+
+	if diff := pretty.Compare(wr.Major(), uint64(100000)); diff != "" {
+		t.Errorf("Major diff: (-got +want)\n%s", diff)
+	}
+
+	if _, err := wr.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of WAL, got: %v", err)
+	}
+}
+
+func TestWALReader_BadCRC(t *testing.T) {
+	const walFile pg.WALFilename = "000000010000000000000001"
+	b := newWALBuilder(walFile)
+
+	rec := encodeRecord(1, 10, 0x00, []testBlock{
+		{rel: [3]uint32{1663, 1, 1259}, block: 1},
+	}, nil)
+	rec[len(rec)-1] ^= 0xFF
+	b.add(rec)
+
+	wr, err := pg.NewWALReader(bytes.NewReader(b.buf), walFile)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if _, err := wr.Next(); err == nil {
+		t.Fatalf("expected a CRC failure")
+	}
+}
+
+func TestWALReader_RecycledSegment(t *testing.T) {
+	// A segment whose page addresses belong to a different segment (i.e. a
+	// recycled segment) contains no valid WAL.
+	b := newWALBuilder("000000010000000000000001")
+	b.add(encodeRecord(1, 10, 0x00, nil, []byte{1}))
+
+	wr, err := pg.NewWALReader(bytes.NewReader(b.buf), "000000010000000000000002")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if _, err := wr.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF for a recycled segment, got: %v", err)
+	}
+}
+
+func TestReadWALSegmentAddress(t *testing.T) {
+	b := newWALBuilder("000000010000000A00000003")
+	b.add(encodeRecord(1, 10, 0x00, nil, []byte{1}))
+
+	addr, err := pg.ReadWALSegmentAddress(bytes.NewReader(b.buf))
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	if want := pg.LSN(0xA03000000); addr != want {
+		t.Fatalf("bad address: got %s want %s", addr, want)
+	}
+
+	if _, err := pg.ReadWALSegmentAddress(bytes.NewReader(make([]byte, 64))); err == nil {
+		t.Fatalf("expected an error for a zeroed page")
+	}
+}
+
+func TestWALReader_Continue(t *testing.T) {
+	const walFile pg.WALFilename = "000000010000000000000001"
+	b := newWALBuilderN(walFile, 2)
+
+	// Fill the first segment until a record straddles the segment boundary.
+	filler := encodeRecord(1, 1, 0x00, nil, bytes.Repeat([]byte{7}, 50000))
+	for b.pos+len(filler) < int(pg.WALSegmentSize) {
+		b.add(filler)
+	}
+	spanLSN := b.add(encodeRecord(42, 10, 0x00, []testBlock{
+		{rel: [3]uint32{1663, 16384, 16385}, block: 7, data: []byte("tuple")},
+	}, bytes.Repeat([]byte{9}, 50000)))
+	nextLSN := b.add(encodeRecord(43, 10, 0x00, []testBlock{
+		{rel: [3]uint32{1663, 16384, 16385}, block: 8},
+	}, nil))
+
+	segSize := int(pg.WALSegmentSize)
+	wr, err := pg.NewWALReader(bytes.NewReader(b.buf[:segSize]), walFile)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	for {
+		if _, err = wr.Next(); err != nil {
+			break
+		}
+	}
+	if err != pg.ErrWALRecordSpansSegment {
+		t.Fatalf("expected ErrWALRecordSpansSegment, got: %v", err)
+	}
+
+	rec, err := wr.Continue(bytes.NewReader(b.buf[segSize:]))
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if diff := pretty.Compare(rec.LSN, spanLSN); diff != "" {
+		t.Errorf("LSN diff: (-got +want)\n%s", diff)
+	}
+
+	if diff := pretty.Compare(rec.XID, pg.TransactionID(42)); diff != "" {
+		t.Errorf("XID diff: (-got +want)\n%s", diff)
+	}
+
+	// The same segment decoded on its own skips the tail of the record that
+	// began in the previous segment.
+	wr, err = pg.NewWALReader(bytes.NewReader(b.buf[segSize:]), "000000010000000000000002")
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	rec, err = wr.Next()
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if diff := pretty.Compare(rec.LSN, nextLSN); diff != "" {
+		t.Errorf("next segment LSN diff: (-got +want)\n%s", diff)
+	}
+}
+
+func TestWALReader_Resume(t *testing.T) {
+	const walFile pg.WALFilename = "000000010000000000000001"
+	b := newWALBuilder(walFile)
+
+	var lsns []pg.LSN
+	for i := 0; i < 20; i++ {
+		lsns = append(lsns, b.add(encodeRecord(uint32(i), 10, 0x00, []testBlock{
+			{rel: [3]uint32{1663, 16384, 16385}, block: uint32(i)},
+		}, bytes.Repeat([]byte{1}, 1000*i))))
+	}
+
+	_, segLSN, err := pg.ParseWalfile(walFile)
+	if err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+	segStart := segLSN - 1
+
+	decode := func(buf []byte, start pg.LSN) (got []pg.LSN, next pg.LSN) {
+		wr, err := pg.NewWALReaderAt(bytes.NewReader(buf), walFile, start)
+		if err != nil {
+			t.Fatalf("bad: %v", err)
+		}
+
+		next = start
+		for {
+			rec, err := wr.Next()
+			if err != nil {
+				return got, next
+			}
+			got = append(got, rec.LSN)
+			next = wr.Position()
+		}
+	}
+
+	// Cut the segment in the middle of a record and at a page boundary, as if
+	// the walreceiver had only written part of it so far.
+	for n, cut := range []int{int(lsns[7]-segStart) + 100, 2 * int(pg.WALPageSize)} {
+		partial := make([]byte, len(b.buf))
+		copy(partial, b.buf[:cut])
+
+		first, next := decode(partial, segStart)
+		rest, _ := decode(b.buf, next)
+
+		if diff := pretty.Compare(append(first, rest...), lsns); diff != "" {
+			t.Fatalf("%d: resumed LSNs diff: (-got +want)\n%s", n, diff)
+		}
+	}
+}
+
+func TestWALBlockRef_NeedsRead(t *testing.T) {
+	tests := []struct {
+		blk  pg.WALBlockRef
+		read bool
+	}{
+		{blk: pg.WALBlockRef{HasData: true}, read: true},
+		{blk: pg.WALBlockRef{HasImage: true, ApplyImage: true}, read: false},
+		// Images taken for wal_consistency_checking are not applied by redo
+		{blk: pg.WALBlockRef{HasImage: true, ApplyImage: false}, read: true},
+		{blk: pg.WALBlockRef{WillInit: true, HasData: true}, read: false},
+	}
+
+	for n, test := range tests {
+		if got := test.blk.NeedsRead(); got != test.read {
+			t.Errorf("%d: NeedsRead: got %t, want %t", n, got, test.read)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright © 2019 Joyent, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pg
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Transaction record info values and flags.  See PostgreSQL's
+// src/include/access/xact.h.
+const (
+	xlogXactCommit         = 0x00
+	xlogXactAbort          = 0x20
+	xlogXactCommitPrepared = 0x30
+	xlogXactAbortPrepared  = 0x40
+	xlogXactAssignment     = 0x50
+	xlogXactOpMask         = 0x70
+	xlogXactHasInfo        = 0x80
+
+	xactXInfoHasDBInfo       = 1 << 0
+	xactXInfoHasSubxacts     = 1 << 1
+	xactXInfoHasRelfilenodes = 1 << 2
+	xactXInfoHasInvals       = 1 << 3
+	xactXInfoHasTwophase     = 1 << 4
+	xactXInfoHasDroppedStats = 1 << 8
+
+	sizeOfXactTimestamp             = 8
+	sizeOfXactDBInfo                = 8
+	sizeOfSharedInvalidationMessage = 16
+)
+
+// _XactRecord is a decoded Transaction commit or abort record (see
+// PostgreSQL's ParseCommitRecord() and ParseAbortRecord()).
+type _XactRecord struct {
+	// xid is the transaction that committed or aborted: the record's XID or,
+	// for COMMIT PREPARED and ROLLBACK PREPARED, the prepared transaction.  xid
+	// is InvalidTransactionID if it could not be determined.
+	xid      TransactionID
+	subxacts []TransactionID
+	rels     []RelFileNode
+}
+
+// decodeXactRecord decodes a Transaction commit or abort record.  ok is false
+// for any other Transaction record.
+func (rec *WALRecord) decodeXactRecord() (xact _XactRecord, ok bool, err error) {
+	info := rec.RmgrInfo()
+	op := info & xlogXactOpMask
+	switch op {
+	case xlogXactCommit, xlogXactAbort, xlogXactCommitPrepared, xlogXactAbortPrepared:
+	default:
+		return _XactRecord{}, false, nil
+	}
+
+	data := rec.MainData
+	short := func() error {
+		return errors.Errorf("short Transaction record at %s", rec.LSN)
+	}
+	take := func(n uint64) ([]byte, error) {
+		if uint64(len(data)) < n {
+			return nil, short()
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, nil
+	}
+	count := func() (uint32, error) {
+		b, err := take(4)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(b), nil
+	}
+
+	if _, err := take(sizeOfXactTimestamp); err != nil {
+		return _XactRecord{}, false, err
+	}
+
+	var xinfo uint32
+	if info&xlogXactHasInfo != 0 {
+		if xinfo, err = count(); err != nil {
+			return _XactRecord{}, false, err
+		}
+	}
+
+	if xinfo&xactXInfoHasDBInfo != 0 {
+		if _, err := take(sizeOfXactDBInfo); err != nil {
+			return _XactRecord{}, false, err
+		}
+	}
+
+	xact.xid = rec.XID
+	if xinfo&xactXInfoHasSubxacts != 0 {
+		nsubxacts, err := count()
+		if err != nil {
+			return _XactRecord{}, false, err
+		}
+		b, err := take(4 * uint64(nsubxacts))
+		if err != nil {
+			return _XactRecord{}, false, err
+		}
+		xact.subxacts = make([]TransactionID, nsubxacts)
+		for i := range xact.subxacts {
+			xact.subxacts[i] = TransactionID(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+	}
+
+	if xinfo&xactXInfoHasRelfilenodes != 0 {
+		nrels, err := count()
+		if err != nil {
+			return _XactRecord{}, false, err
+		}
+		b, err := take(sizeOfRelFileNode * uint64(nrels))
+		if err != nil {
+			return _XactRecord{}, false, err
+		}
+		xact.rels = make([]RelFileNode, nrels)
+		for i := range xact.rels {
+			xact.rels[i] = decodeRelFileNode(b[sizeOfRelFileNode*i:])
+		}
+	}
+
+	if op != xlogXactCommitPrepared && op != xlogXactAbortPrepared {
+		return xact, true, nil
+	}
+
+	// The prepared transaction's XID follows the dropped statistics (15+),
+	// whose size differs between releases, and the invalidation messages.
+	xact.xid = InvalidTransactionID
+	if xinfo&xactXInfoHasTwophase == 0 || xinfo&xactXInfoHasDroppedStats != 0 {
+		return xact, true, nil
+	}
+
+	if xinfo&xactXInfoHasInvals != 0 && op == xlogXactCommitPrepared {
+		nmsgs, err := count()
+		if err != nil {
+			return _XactRecord{}, false, err
+		}
+		if _, err := take(sizeOfSharedInvalidationMessage * uint64(nmsgs)); err != nil {
+			return _XactRecord{}, false, err
+		}
+	}
+
+	twophaseXID, err := count()
+	if err != nil {
+		return _XactRecord{}, false, err
+	}
+	xact.xid = TransactionID(twophaseXID)
+
+	return xact, true, nil
+}
+
+// decodeXactAssignment decodes the subtransactions of a Transaction
+// ASSIGNMENT record (xl_xact_assignment).  ok is false for any other
+// Transaction record.
+func (rec *WALRecord) decodeXactAssignment() (subxacts []TransactionID, ok bool, err error) {
+	if rec.RmgrInfo()&xlogXactOpMask != xlogXactAssignment {
+		return nil, false, nil
+	}
+
+	data := rec.MainData
+	if len(data) < 8 {
+		return nil, false, errors.Errorf("short Transaction ASSIGNMENT record at %s", rec.LSN)
+	}
+
+	nsubxacts := binary.LittleEndian.Uint32(data[4:])
+	if uint64(len(data)) < 8+4*uint64(nsubxacts) {
+		return nil, false, errors.Errorf("short Transaction ASSIGNMENT record at %s", rec.LSN)
+	}
+
+	subxacts = make([]TransactionID, nsubxacts)
+	for i := range subxacts {
+		subxacts[i] = TransactionID(binary.LittleEndian.Uint32(data[8+4*i:]))
+	}
+
+	return subxacts, true, nil
+}
@@ -0,0 +1,115 @@
+#!/bin/sh
+#
+# Captures the pg_waldump(1) output used as a fixture by the parser tests in
+# agent/walcache (testdata/pg_waldump/<major>.txt).  A scratch cluster is
+# created with the given PostgreSQL installation, a workload producing every
+# record the parsers care about is run against it, and the WAL it wrote is
+# dumped.  Regenerate the goldens and review their diff afterwards:
+#
+#   scripts/capture-pg_waldump-fixtures.sh /usr/lib/postgresql/16/bin
+#   go test ./agent/walcache -run TestWalDumpParsers -update
+#
+# Usage: capture-pg_waldump-fixtures.sh <bindir> [outdir]
+
+set -eu
+
+if [ $# -lt 1 ]; then
+	echo "usage: $0 <bindir> [outdir]" >&2
+	exit 2
+fi
+
+bindir=$1
+outdir=${2:-$(dirname "$0")/../agent/walcache/testdata/pg_waldump}
+port=${PGPORT:-54329}
+
+version=$("$bindir/postgres" --version | awk '{ print $3 }')
+major=${version%%.*}
+if [ "$major" -lt 10 ]; then
+	fixture=$(echo "$version" | cut -d. -f1,2)
+	waldump=pg_xlogdump
+	waldir=pg_xlog
+	currentlsn=pg_current_xlog_location
+	switchwal=pg_switch_xlog
+else
+	fixture=$major
+	waldump=pg_waldump
+	waldir=pg_wal
+	currentlsn=pg_current_wal_lsn
+	switchwal=pg_switch_wal
+fi
+
+# Databases are only created by copying the template's directory by default
+# before 15.
+strategy=
+if [ "$major" -ge 15 ]; then
+	strategy="STRATEGY FILE_COPY"
+fi
+
+datadir=$(mktemp -d)
+trap '"$bindir/pg_ctl" -D "$datadir" -m immediate stop >/dev/null 2>&1 || true; rm -rf "$datadir"' EXIT
+
+"$bindir/initdb" -D "$datadir" -U postgres -A trust >/dev/null
+cat >>"$datadir/postgresql.conf" <<CONF
+listen_addresses = ''
+unix_socket_directories = '$datadir'
+port = $port
+wal_level = hot_standby
+max_prepared_transactions = 2
+autovacuum = off
+CONF
+"$bindir/pg_ctl" -D "$datadir" -w -l "$datadir/postgresql.log" start >/dev/null
+
+psql() {
+	"$bindir/psql" -h "$datadir" -p "$port" -U postgres -X -q -v ON_ERROR_STOP=1 "$@"
+}
+
+psql -c "CHECKPOINT" -c "SELECT $switchwal()" >/dev/null
+start=$(psql -At -c "SELECT $currentlsn()")
+
+psql >/dev/null <<SQL
+-- Heap and Btree inserts, including leaf splits.
+CREATE TABLE t (id int PRIMARY KEY, v text);
+INSERT INTO t SELECT g, repeat('x', 100) FROM generate_series(1, 5000) g;
+
+-- The first modification of each page after a checkpoint is a full-page image.
+CHECKPOINT;
+UPDATE t SET v = 'y' WHERE id % 10 = 0;
+
+-- Btree VACUUM and heap pruning, then truncation of the emptied tail.
+DELETE FROM t WHERE id <= 1000 OR id > 4000;
+VACUUM t;
+
+-- A prepared transaction with subtransactions.
+BEGIN;
+INSERT INTO t VALUES (5001, 'a');
+SAVEPOINT a;
+INSERT INTO t VALUES (5002, 'b');
+SAVEPOINT b;
+INSERT INTO t VALUES (5003, 'c');
+PREPARE TRANSACTION 'fixture';
+COMMIT PREPARED 'fixture';
+
+-- Upgrading a row lock in a subtransaction creates a MultiXact.
+BEGIN;
+SELECT id FROM t WHERE id = 2000 FOR SHARE;
+SAVEPOINT s;
+SELECT id FROM t WHERE id = 2000 FOR UPDATE;
+COMMIT;
+
+-- Relations created and dropped in the same transaction.
+BEGIN;
+CREATE TABLE u (id int);
+INSERT INTO u VALUES (1);
+TRUNCATE u;
+DROP TABLE u;
+COMMIT;
+DROP TABLE t;
+
+CREATE DATABASE fixture TEMPLATE template0 $strategy;
+DROP DATABASE fixture;
+SQL
+
+end=$(psql -At -c "SELECT $currentlsn()")
+
+"$bindir/$waldump" -p "$datadir/$waldir" -s "$start" -e "$end" >"$outdir/$fixture.txt"
+echo "wrote $outdir/$fixture.txt ($start - $end)"